@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go"
+)
+
+// APIKeyHeader is a request header with API key
+const APIKeyHeader = "X-API-Key"
+
+// KeyStoreTTL is a period of reloading storage-backed keystore
+const KeyStoreTTL = time.Minute
+
+// Operations permitted to API keys
+const (
+	OpUpload      = "upload"
+	OpDelete      = "delete"
+	OpList        = "list"
+	OpReadPrivate = "read-private"
+	OpModerate    = "moderate"
+)
+
+// AllBuckets is a wildcard for API key buckets
+const AllBuckets = "*"
+
+type principalKey struct{}
+
+// APIKey represents API key with its permissions.
+type APIKey struct {
+	Name       string   `json:"name"`
+	Key        string   `json:"key"`
+	Buckets    []string `json:"buckets"`
+	Operations []string `json:"operations"`
+}
+
+// Principal represents authenticated client with its permissions.
+// Prefix restricts object names if it's presented.
+type Principal struct {
+	Name       string
+	Buckets    []string
+	Operations []string
+	Prefix     string
+}
+
+// Can reports whether principal is permitted to do operation in bucket.
+func (p *Principal) Can(bucketName string, operation string) bool {
+	return contains(p.Buckets, bucketName, AllBuckets) && contains(p.Operations, operation, "")
+}
+
+// CanAccessObject reports whether object name is within principal prefix.
+func (p *Principal) CanAccessObject(objName string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(objName, "/"), p.Prefix)
+}
+
+// KeyStore looks up API keys.
+type KeyStore interface {
+	// Lookup returns API key matching given key or nil if there is no such key.
+	Lookup(key string) (*APIKey, error)
+}
+
+// StaticKeyStore is a keystore with fixed set of keys.
+type StaticKeyStore struct {
+	keys    []APIKey
+	digests [][sha256.Size]byte
+}
+
+// NewStaticKeyStore returns new keystore with given keys.
+func NewStaticKeyStore(keys []APIKey) *StaticKeyStore {
+	ks := &StaticKeyStore{keys: keys}
+	for _, key := range keys {
+		ks.digests = append(ks.digests, sha256.Sum256([]byte(key.Key)))
+	}
+	return ks
+}
+
+// Lookup compares key with every stored key in constant time.
+// Digests are compared instead of keys to not leak keys length.
+func (ks *StaticKeyStore) Lookup(key string) (*APIKey, error) {
+	var found *APIKey
+	digest := sha256.Sum256([]byte(key))
+	for i := range ks.keys {
+		if subtle.ConstantTimeCompare(digest[:], ks.digests[i][:]) == 1 {
+			found = &ks.keys[i]
+		}
+	}
+	return found, nil
+}
+
+// StorageKeyStore is a keystore backed by JSON object in storage.
+// Keys are reloaded periodically, so they can be rotated without restart.
+type StorageKeyStore struct {
+	storage    *minio.Client
+	bucketName string
+	objName    string
+
+	mu       sync.Mutex
+	keys     *StaticKeyStore
+	loadedAt time.Time
+}
+
+// NewStorageKeyStore returns new storage-backed keystore.
+func NewStorageKeyStore(storage *minio.Client, bucketName string, objName string) *StorageKeyStore {
+	return &StorageKeyStore{
+		storage:    storage,
+		bucketName: bucketName,
+		objName:    objName,
+	}
+}
+
+// Lookup reloads keys if they are expired & looks up given key.
+func (ks *StorageKeyStore) Lookup(key string) (*APIKey, error) {
+	ks.mu.Lock()
+	if ks.keys == nil || time.Since(ks.loadedAt) > KeyStoreTTL {
+		keys, err := ks.load()
+		if err != nil && ks.keys == nil {
+			ks.mu.Unlock()
+			return nil, err
+		}
+		// Keep previous keys if storage is temporarily unavailable
+		if err == nil {
+			ks.keys = keys
+		}
+		ks.loadedAt = time.Now()
+	}
+	keys := ks.keys
+	ks.mu.Unlock()
+
+	return keys.Lookup(key)
+}
+
+func (ks *StorageKeyStore) load() (*StaticKeyStore, error) {
+	obj, err := ks.storage.GetObject(ks.bucketName, ks.objName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return decodeKeys(obj)
+}
+
+// LoadKeyStoreFile returns keystore with keys from JSON file.
+func LoadKeyStoreFile(path string) (*StaticKeyStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeKeys(file)
+}
+
+func decodeKeys(input io.Reader) (*StaticKeyStore, error) {
+	var keys []APIKey
+	if err := json.NewDecoder(input).Decode(&keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Key == "" {
+			return nil, errors.New("API key can't be empty")
+		}
+	}
+	return NewStaticKeyStore(keys), nil
+}
+
+// initKeyStore returns keystore due to config or nil if authentication is disabled
+func initKeyStore(cfg *Config, storage *minio.Client) (KeyStore, error) {
+	if cfg.AuthKeysFile != "" {
+		return LoadKeyStoreFile(cfg.AuthKeysFile)
+	}
+	if cfg.AuthKeysBucket != "" && cfg.AuthKeysObject != "" {
+		return NewStorageKeyStore(storage, cfg.AuthKeysBucket, cfg.AuthKeysObject), nil
+	}
+	return nil, nil
+}
+
+// AuthMW is a wrapper to provide appContext to authentication middleware.
+type AuthMW struct {
+	ctx *AppContext
+}
+
+// Middleware for AuthMW authenticates client by API key or JWT & checks its bucket permissions.
+func (amw *AuthMW) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation, anonymous := amw.requiredOperation(r)
+		if (amw.ctx.KeyStore == nil && amw.ctx.JWTVerifier == nil) || operation == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get(APIKeyHeader)
+		token := bearerToken(r)
+		if key == "" && token == "" && anonymous {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := amw.authenticate(key, token)
+		if err == errAuthLookup {
+			renderJSONError(w, err, "CANT_LOOKUP_API_KEY", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			renderJSONError(w, err, "UNAUTHORIZED", http.StatusUnauthorized)
+			return
+		}
+
+		// Bucket of job isn't known by route, so it's checked by handler
+		if routeName(r) == "jobs" {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+			return
+		}
+
+		bucketName := mux.Vars(r)["bucket"]
+		if !principal.Can(bucketName, operation) {
+			renderJSONError(w, errors.New("Client isn't permitted to "+operation+" in this bucket"), "FORBIDDEN", http.StatusForbidden)
+			return
+		}
+		// Objects of moderation decisions are checked by handler
+		if operation != OpUpload && operation != OpModerate && !principal.CanAccessObject(requestObject(r)) {
+			renderJSONError(w, errors.New("Client isn't permitted to access this object"), "FORBIDDEN", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+var errAuthLookup = errors.New("Can't lookup API key")
+
+// authenticate returns principal for given API key or JWT
+func (amw *AuthMW) authenticate(key string, token string) (*Principal, error) {
+	if token != "" && amw.ctx.JWTVerifier != nil {
+		return amw.ctx.JWTVerifier.Verify(token)
+	}
+
+	if key == "" || amw.ctx.KeyStore == nil {
+		return nil, errors.New("API key or bearer token is required")
+	}
+
+	apiKey, err := amw.ctx.KeyStore.Lookup(key)
+	if err != nil {
+		log.Println(err)
+		return nil, errAuthLookup
+	}
+	if apiKey == nil {
+		return nil, errors.New("API key is invalid")
+	}
+
+	return &Principal{Name: apiKey.Name, Buckets: apiKey.Buckets, Operations: apiKey.Operations}, nil
+}
+
+// bearerToken returns token from Authorization header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, BearerPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(header, BearerPrefix)
+}
+
+// requiredOperation returns operation for matched route & whether it's allowed for anonymous clients
+func (amw *AuthMW) requiredOperation(r *http.Request) (string, bool) {
+	switch routeName(r) {
+	case "upload":
+		return OpUpload, false
+	case "delete":
+		return OpDelete, false
+	case "moderation":
+		return OpModerate, false
+	case "download", "info", "srcset", "similar", "iiif.info", "iiif.image":
+		if policy := BucketPolicyFromRequest(r); policy != nil {
+			return OpReadPrivate, policy.Public
+		}
+		return OpReadPrivate, amw.ctx.Config.AuthAnonymousRead
+	case "jobs":
+		return OpReadPrivate, true
+	}
+	return "", false
+}
+
+// requestObject returns object name of request by route variable, query of similar route or path
+func requestObject(r *http.Request) string {
+	vars := mux.Vars(r)
+	if objName, ok := vars["object"]; ok {
+		return objName
+	}
+	if routeName(r) == "similar" {
+		return r.URL.Query().Get("object")
+	}
+	return strings.TrimPrefix(r.URL.Path, "/"+vars["bucket"]+"/")
+}
+
+// PrincipalFromRequest returns authenticated principal or nil for anonymous requests.
+func PrincipalFromRequest(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// contains reports whether items contain value or wildcard
+func contains(items []string, value string, wildcard string) bool {
+	for _, item := range items {
+		if item == value || (wildcard != "" && item == wildcard) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+var testKeys = []APIKey{
+	{Name: "uploader", Key: "upload-key", Buckets: []string{"avatars"}, Operations: []string{OpUpload}},
+	{Name: "admin", Key: "admin-key", Buckets: []string{AllBuckets}, Operations: []string{OpUpload, OpReadPrivate}},
+}
+
+func TestStaticKeyStoreLookup(t *testing.T) {
+	ks := NewStaticKeyStore(testKeys)
+
+	key, err := ks.Lookup("admin-key")
+	assert.Nil(t, err)
+	assert.Equal(t, "admin", key.Name)
+
+	key, err = ks.Lookup("admin-key-2")
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+}
+
+func TestPrincipalCan(t *testing.T) {
+	cases := []struct {
+		principal Principal
+		bucket    string
+		operation string
+		expected  bool
+	}{
+		{Principal{Buckets: []string{"avatars"}, Operations: []string{OpUpload}}, "avatars", OpUpload, true},
+		{Principal{Buckets: []string{"avatars"}, Operations: []string{OpUpload}}, "docs", OpUpload, false},
+		{Principal{Buckets: []string{"avatars"}, Operations: []string{OpUpload}}, "avatars", OpDelete, false},
+		{Principal{Buckets: []string{AllBuckets}, Operations: []string{OpList}}, "docs", OpList, true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.principal.Can(c.bucket, c.operation))
+	}
+}
+
+func TestAuthMW(t *testing.T) {
+	cases := []struct {
+		method    string
+		url       string
+		key       string
+		anonymous bool
+		expected  int
+	}{
+		{"POST", "/avatars", "", true, http.StatusUnauthorized},
+		{"POST", "/avatars", "wrong-key", true, http.StatusUnauthorized},
+		{"POST", "/avatars", "upload-key", true, http.StatusOK},
+		{"POST", "/docs", "upload-key", true, http.StatusForbidden},
+		{"POST", "/docs", "admin-key", true, http.StatusOK},
+		{"GET", "/avatars/a.jpg", "", true, http.StatusOK},
+		{"GET", "/avatars/a.jpg", "", false, http.StatusUnauthorized},
+		{"GET", "/avatars/a.jpg", "upload-key", false, http.StatusForbidden},
+		{"GET", "/avatars/a.jpg", "admin-key", false, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		appCtx := &AppContext{
+			Config:   &Config{AuthAnonymousRead: c.anonymous},
+			KeyStore: NewStaticKeyStore(testKeys),
+		}
+		ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		router := mux.NewRouter()
+		router.PathPrefix("/{bucket}").Handler(ok).Methods("POST").Name("upload")
+		router.PathPrefix("/{bucket}/").Handler(ok).Methods("GET").Name("download")
+		amw := &AuthMW{appCtx}
+		router.Use(amw.Middleware)
+
+		req, err := http.NewRequest(c.method, c.url, nil)
+		assert.Nil(t, err)
+		req.Header.Set(APIKeyHeader, c.key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expected, rr.Code, c)
+		if rr.Code != http.StatusOK {
+			er := ErrorResponse{}
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &er))
+			assert.NotEmpty(t, er.Error)
+		}
+	}
+}
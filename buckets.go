@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type bucketPolicyKey struct{}
+
+// BucketsConfig represents exposed buckets, resize presets & watermarks.
+type BucketsConfig struct {
+	Presets    map[string]Preset        `json:"presets"`
+	Buckets    map[string]*BucketPolicy `json:"buckets"`
+	Watermarks map[string]*Watermark    `json:"watermarks"`
+}
+
+// Preset represents named resize options.
+// Watermark of preset is mandatory.
+type Preset struct {
+	Resize    string `json:"resize"`
+	Enlarge   bool   `json:"enlarge"`
+	Watermark string `json:"watermark"`
+}
+
+// Variant represents image variant generated in background after upload.
+type Variant struct {
+	Preset string `json:"preset"`
+	Format string `json:"format"` // Conversion of GIF, f.ex. "webp"
+}
+
+// Name returns variant name, f.ex. "thumb" or "thumb.webp".
+func (v *Variant) Name() string {
+	if v.Preset == "" || v.Format == "" {
+		return v.Preset + v.Format
+	}
+	return v.Preset + "." + v.Format
+}
+
+// Options returns download options served by variant.
+func (v *Variant) Options() Options {
+	return Options{Preset: v.Preset, Format: v.Format}
+}
+
+// ObjectName returns name of variant object of given file, f.ex. ".variants/thumb/a.jpg".
+func (v *Variant) ObjectName(file string) string {
+	return VariantPrefix + v.Name() + "/" + strings.TrimLeft(file, "/")
+}
+
+// BucketPolicy represents per-bucket policy.
+// Empty fields are filled with app defaults.
+type BucketPolicy struct {
+	Public           bool     `json:"public"`
+	AllowedTypes     []string `json:"allowedTypes"`
+	MaxUploadSize    int64    `json:"maxUploadSize"`
+	Presets          []string `json:"presets"`
+	ResizeOnUpload   *bool    `json:"resizeOnUpload"`
+	ResizeOnDownload *bool    `json:"resizeOnDownload"`
+	FullDecode       *bool    `json:"fullDecode"`     // Decode uploads fully to reject corrupted images
+	ResizeFallback   *bool    `json:"resizeFallback"` // Serve original if resizer is unavailable, respond 503 otherwise
+	Moderation       bool     `json:"moderation"`     // Hold uploads till approval
+
+	Variants      []Variant `json:"variants"`      // Generated in background after upload
+	AsyncAnalysis bool      `json:"asyncAnalysis"` // Compute placeholders & hashes in background
+
+	Webhooks         []WebhookEndpoint `json:"webhooks"`
+	CacheControl     string            `json:"cacheControl"`
+	Watermark        string            `json:"watermark"`  // Mandatory for downloads
+	Operations       []string          `json:"operations"` // Allowed pipeline operations, all by default
+	OperationsBudget int               `json:"operationsBudget"`
+
+	Normalize NormalizeOptions `json:"normalize"`
+}
+
+// DefaultAllowedTypes are image types allowed for uploading by default, they're validated by ValidateImage.
+// Buckets may restrict them.
+var DefaultAllowedTypes = []string{MIMEImageJPEG, MIMEImageGIF, MIMEImagePNG}
+
+// LoadBucketsConfigFile returns buckets config from JSON file.
+func LoadBucketsConfigFile(path string) (*BucketsConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bc := &BucketsConfig{}
+	if err := json.NewDecoder(file).Decode(bc); err != nil {
+		return nil, err
+	}
+
+	// Validate allowed types, presets & watermarks references, variants, webhooks
+	for _, policy := range bc.Buckets {
+		for _, fileType := range policy.AllowedTypes {
+			if !contains(DefaultAllowedTypes, fileType, "") {
+				return nil, errors.New("Unsupported allowed type " + fileType)
+			}
+		}
+		for _, name := range policy.Presets {
+			if _, ok := bc.Presets[name]; !ok {
+				return nil, errors.New("Unknown preset " + name)
+			}
+		}
+		if _, ok := bc.Watermarks[policy.Watermark]; policy.Watermark != "" && !ok {
+			return nil, errors.New("Unknown watermark " + policy.Watermark)
+		}
+		for _, variant := range policy.Variants {
+			if variant.Name() == "" {
+				return nil, errors.New("Variant must have preset or format")
+			}
+			if variant.Preset != "" && !contains(policy.Presets, variant.Preset, "") {
+				return nil, errors.New("Variant preset " + variant.Preset + " isn't allowed in bucket")
+			}
+			if err := validateFormat(variant.Format); err != nil {
+				return nil, err
+			}
+		}
+		for _, endpoint := range policy.Webhooks {
+			if err := endpoint.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, preset := range bc.Presets {
+		if _, err := PrepareDimensions(preset.Resize); err != nil {
+			return nil, err
+		}
+		if _, ok := bc.Watermarks[preset.Watermark]; preset.Watermark != "" && !ok {
+			return nil, errors.New("Unknown watermark " + preset.Watermark)
+		}
+	}
+	for _, wm := range bc.Watermarks {
+		if err := wm.prepare(); err != nil {
+			return nil, err
+		}
+	}
+
+	return bc, nil
+}
+
+// initBucketsConfig returns buckets config or nil if all buckets are exposed
+func initBucketsConfig(cfg *Config) (*BucketsConfig, error) {
+	if cfg.BucketsConfigFile == "" {
+		return nil, nil
+	}
+	return LoadBucketsConfigFile(cfg.BucketsConfigFile)
+}
+
+// BucketPolicy returns policy for given bucket filled with defaults.
+// Reports false if bucket isn't exposed.
+func (ctx *AppContext) BucketPolicy(bucketName string) (*BucketPolicy, bool) {
+	policy := &BucketPolicy{Public: ctx.Config.AuthAnonymousRead}
+	if ctx.Buckets != nil {
+		configured, ok := ctx.Buckets.Buckets[bucketName]
+		if !ok {
+			return nil, false
+		}
+		*policy = *configured
+	}
+
+	if len(policy.AllowedTypes) == 0 {
+		policy.AllowedTypes = DefaultAllowedTypes
+	}
+	if policy.MaxUploadSize == 0 {
+		policy.MaxUploadSize = MaxUploadSize
+	}
+	if policy.ResizeOnUpload == nil {
+		policy.ResizeOnUpload = &ctx.Config.ResizeOnUpload
+	}
+	if policy.ResizeOnDownload == nil {
+		policy.ResizeOnDownload = &ctx.Config.ResizeOnDownload
+	}
+	if policy.FullDecode == nil {
+		policy.FullDecode = &ctx.Config.UploadFullDecode
+	}
+	if policy.ResizeFallback == nil {
+		policy.ResizeFallback = &ctx.Config.ResizeFallback
+	}
+
+	return policy, true
+}
+
+// VariantFor returns variant generated with given download options.
+func (p *BucketPolicy) VariantFor(opts *Options) (*Variant, bool) {
+	for i := range p.Variants {
+		if p.Variants[i].Options() == *opts {
+			return &p.Variants[i], true
+		}
+	}
+	return nil, false
+}
+
+// AllowsType reports whether file type is allowed for uploading.
+func (p *BucketPolicy) AllowsType(fileType string) bool {
+	return contains(p.AllowedTypes, fileType, "")
+}
+
+// ResolveOptions applies preset to options & validates them against policy.
+// Mandatory watermark of preset or bucket replaces requested one.
+func (p *BucketPolicy) ResolveOptions(opts *Options, presets map[string]Preset) (*Options, error) {
+	resolved := *opts
+
+	if opts.Op != "" && (opts.Resize != "" || opts.Preset != "") {
+		return nil, errors.New("Operations can't be combined with resize or preset")
+	}
+
+	if opts.Preset == "" {
+		// Arbitrary resizing is forbidden if bucket restricts presets & doesn't allow operations explicitly
+		if opts.Resize != "" && len(p.Presets) > 0 {
+			return nil, errors.New("Only presets are allowed for resizing in this bucket")
+		}
+		if opts.Op != "" && len(p.Presets) > 0 && len(p.Operations) == 0 {
+			return nil, errors.New("Only presets are allowed in this bucket")
+		}
+	} else {
+		preset, ok := presets[opts.Preset]
+		if !ok || !contains(p.Presets, opts.Preset, "") {
+			return nil, errors.New("Preset isn't allowed in this bucket")
+		}
+
+		resolved.Resize = preset.Resize
+		resolved.Enlarge = preset.Enlarge
+		if preset.Watermark != "" {
+			resolved.Watermark = preset.Watermark
+			return &resolved, nil
+		}
+	}
+
+	if p.Watermark != "" {
+		resolved.Watermark = p.Watermark
+	}
+	return &resolved, nil
+}
+
+// BucketMW is a wrapper to provide appContext to bucket middleware.
+type BucketMW struct {
+	ctx *AppContext
+}
+
+// Middleware for BucketMW rejects requests to unknown buckets without touching storage.
+func (bmw *BucketMW) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucketName, ok := mux.Vars(r)["bucket"]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy, ok := bmw.ctx.BucketPolicy(bucketName)
+		if !ok {
+			renderJSONError(w, errors.New("Bucket isn't found"), "BUCKET_NOT_FOUND", http.StatusNotFound)
+			return
+		}
+
+		// Uploads held for moderation aren't readable
+		if policy.Moderation && r.Method == "GET" && isModerationObject(requestObject(r)) {
+			renderJSONError(w, errors.New("Object isn't found"), "OBJECT_NOT_FOUND", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), bucketPolicyKey{}, policy)))
+	})
+}
+
+// BucketPolicyFromRequest returns bucket policy of request or nil for requests without bucket.
+func BucketPolicyFromRequest(r *http.Request) *BucketPolicy {
+	policy, _ := r.Context().Value(bucketPolicyKey{}).(*BucketPolicy)
+	return policy
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testBucketsConfig = `{
+	"presets": {
+		"thumb": {"resize": "200x200"},
+		"large": {"resize": "1200", "enlarge": true},
+		"branded": {"resize": "600", "watermark": "logo"}
+	},
+	"buckets": {
+		"avatars": {
+			"public": true,
+			"allowedTypes": ["image/jpeg"],
+			"maxUploadSize": 1048576,
+			"presets": ["thumb"],
+			"resizeOnDownload": false,
+			"cacheControl": "public, max-age=31536000"
+		},
+		"docs": {},
+		"photos": {"presets": ["branded", "thumb"], "watermark": "copyright"}
+	},
+	"watermarks": {
+		"copyright": {"text": "(c) ACME", "opacity": 0.5},
+		"logo": {"image": {"bucket": "assets", "object": "logo.png"}, "position": "center"}
+	}
+}`
+
+func loadTestBucketsConfig(t *testing.T) *BucketsConfig {
+	file, err := ioutil.TempFile("", "buckets")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(testBucketsConfig)
+	file.Close()
+
+	bc, err := LoadBucketsConfigFile(file.Name())
+	assert.Nil(t, err)
+	return bc
+}
+
+func TestBucketPolicy(t *testing.T) {
+	appCtx := &AppContext{
+		Config:  &Config{ResizeOnUpload: true, ResizeOnDownload: true},
+		Buckets: loadTestBucketsConfig(t),
+	}
+
+	policy, ok := appCtx.BucketPolicy("avatars")
+	assert.True(t, ok)
+	assert.True(t, policy.Public)
+	assert.True(t, policy.AllowsType(MIMEImageJPEG))
+	assert.False(t, policy.AllowsType(MIMEImagePNG))
+	assert.Equal(t, int64(1048576), policy.MaxUploadSize)
+	assert.True(t, *policy.ResizeOnUpload)
+	assert.False(t, *policy.ResizeOnDownload)
+
+	policy, ok = appCtx.BucketPolicy("docs")
+	assert.True(t, ok)
+	assert.False(t, policy.Public)
+	assert.Equal(t, DefaultAllowedTypes, policy.AllowedTypes)
+	assert.Equal(t, int64(MaxUploadSize), policy.MaxUploadSize)
+	assert.False(t, *policy.FullDecode)
+
+	_, ok = appCtx.BucketPolicy("unknown")
+	assert.False(t, ok)
+
+	// All buckets are exposed without config
+	appCtx.Buckets = nil
+	_, ok = appCtx.BucketPolicy("unknown")
+	assert.True(t, ok)
+}
+
+func TestLoadBucketsConfigFileInvalid(t *testing.T) {
+	configs := []string{
+		`{"buckets": {"docs": {"allowedTypes": ["image/webp"]}}}`,
+		`{"buckets": {"docs": {"presets": ["unknown"]}}}`,
+		`{"buckets": {"docs": {"watermark": "unknown"}}}`,
+		`{"buckets": {"docs": {"webhooks": [{"url": "https://example.com/hook"}]}}}`,
+		`{"presets": {"thumb": {"resize": "200"}}, "buckets": {"docs": {"variants": [{"preset": "thumb"}]}}}`,
+		`{"buckets": {"docs": {"variants": [{"format": "avif"}]}}}`,
+		`{"buckets": {"docs": {"variants": [{}]}}}`,
+		`{"buckets": {"docs": {"webhooks": [{"url": "https://example.com/hook", "secret": "s", "events": ["unknown"]}]}}}`,
+	}
+
+	for _, config := range configs {
+		file, err := ioutil.TempFile("", "buckets")
+		assert.Nil(t, err)
+		file.WriteString(config)
+		file.Close()
+
+		_, err = LoadBucketsConfigFile(file.Name())
+		assert.NotNil(t, err, config)
+		os.Remove(file.Name())
+	}
+}
+
+func TestResolveOptions(t *testing.T) {
+	bc := loadTestBucketsConfig(t)
+	cases := []struct {
+		bucket    string
+		opts      Options
+		expected  string
+		watermark string
+		valid     bool
+	}{
+		{"avatars", Options{Preset: "thumb"}, "200x200", "", true},
+		{"avatars", Options{Preset: "large"}, "", "", false},
+		{"avatars", Options{Preset: "unknown"}, "", "", false},
+		{"avatars", Options{Resize: "300"}, "", "", false},
+		{"avatars", Options{}, "", "", true},
+		{"docs", Options{Resize: "300"}, "300", "", true},
+		{"docs", Options{Watermark: "logo"}, "", "logo", true},
+		{"photos", Options{Preset: "branded"}, "600", "logo", true},
+		{"photos", Options{Preset: "thumb"}, "200x200", "copyright", true},
+		{"photos", Options{Watermark: "logo"}, "", "copyright", true},
+		{"docs", Options{Op: "grayscale"}, "", "", true},
+		{"docs", Options{Op: "grayscale", Resize: "300"}, "", "", false},
+		{"avatars", Options{Op: "grayscale"}, "", "", false},
+	}
+
+	for _, c := range cases {
+		opts, err := bc.Buckets[c.bucket].ResolveOptions(&c.opts, bc.Presets)
+		assert.Equal(t, c.valid, err == nil, c)
+		if c.valid {
+			assert.Equal(t, c.expected, opts.Resize)
+			assert.Equal(t, c.watermark, opts.Watermark, c)
+		}
+	}
+}
+
+func TestBucketMW(t *testing.T) {
+	// Storage isn't set, so unknown buckets must be rejected before touching it
+	appCtx := &AppContext{Config: &Config{}, Buckets: loadTestBucketsConfig(t)}
+	router := InitRouter(appCtx)
+
+	for _, method := range []string{"GET", "POST"} {
+		req, err := http.NewRequest(method, "/unknown/a.jpg", nil)
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.Contains(t, rr.Body.String(), "BUCKET_NOT_FOUND")
+	}
+}
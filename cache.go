@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache levels, they're exported as metric labels
+const (
+	CacheLevelMemory = "memory"
+	CacheLevelDisk   = "disk"
+)
+
+// CachedImage is a downloaded image in cache.
+type CachedImage struct {
+	ContentType string
+	Data        []byte
+}
+
+func (img CachedImage) size() int64 {
+	return int64(len(img.ContentType) + len(img.Data))
+}
+
+// ImageCache caches downloaded images by object & transform in memory LRU in front of optional disk LRU.
+// Entries of object are invalidated together on its deletion or overwrite by this instance,
+// changes made elsewhere are picked up after TTL.
+type ImageCache struct {
+	memory *memoryCache
+	disk   *diskCache
+	ttl    time.Duration
+
+	// Invalidation bumps generation of object fetched in flight, so image fetched before it isn't cached
+	mu      sync.Mutex
+	fetches map[string]*objectFetches
+}
+
+// objectFetches counts fetches of object in flight, generation is kept while there are any
+type objectFetches struct {
+	count      int
+	generation uint64
+}
+
+// NewImageCache returns cache bounded by given sizes in bytes, disk level is disabled without directory.
+// Entries expire after TTL unless it's zero.
+func NewImageCache(memorySize int64, dir string, diskSize int64, ttl time.Duration) (*ImageCache, error) {
+	cache := &ImageCache{ttl: ttl, fetches: map[string]*objectFetches{}}
+	if memorySize > 0 {
+		cache.memory = newMemoryCache(memorySize)
+	}
+	if dir != "" {
+		disk, err := newDiskCache(dir, diskSize)
+		if err != nil {
+			return nil, err
+		}
+		cache.disk = disk
+	}
+	return cache, nil
+}
+
+// initImageCache returns image cache due to config or nil if caching is disabled
+func initImageCache(cfg *Config) (*ImageCache, error) {
+	if cfg.CacheMemorySize <= 0 && cfg.CacheDir == "" {
+		return nil, nil
+	}
+	return NewImageCache(cfg.CacheMemorySize, cfg.CacheDir, cfg.CacheDiskSize, cfg.CacheTTL)
+}
+
+// Get returns cached image, disk hits are promoted to memory till their expiration.
+func (c *ImageCache) Get(object string, key string) (CachedImage, bool) {
+	if c.memory != nil {
+		if img, ok := c.memory.Get(key); ok {
+			observeCache(true)
+			return img, true
+		}
+	}
+	if c.disk != nil {
+		if img, expires, ok := c.disk.Get(object, key); ok {
+			if c.memory != nil {
+				c.memory.Put(object, key, img, expires)
+			}
+			observeCache(true)
+			return img, true
+		}
+	}
+	observeCache(false)
+	return CachedImage{}, false
+}
+
+// Begin registers fetch of object in flight & returns its generation, fetch is finished by End.
+func (c *ImageCache) Begin(object string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fetches, ok := c.fetches[object]
+	if !ok {
+		fetches = &objectFetches{}
+		c.fetches[object] = fetches
+	}
+	fetches.count++
+	return fetches.generation
+}
+
+// End finishes fetch of object registered by Begin.
+func (c *ImageCache) End(object string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fetches, ok := c.fetches[object]; ok {
+		if fetches.count--; fetches.count == 0 {
+			delete(c.fetches, object)
+		}
+	}
+}
+
+// Put caches image fetched at given generation on every level.
+// Image isn't cached if object is invalidated since fetch began.
+func (c *ImageCache) Put(object string, key string, img CachedImage, generation uint64) {
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fetches, ok := c.fetches[object]; ok && fetches.generation != generation {
+		return
+	}
+	if c.memory != nil {
+		c.memory.Put(object, key, img, expires)
+	}
+	if c.disk != nil {
+		c.disk.Put(object, key, img, expires)
+	}
+}
+
+// Invalidate removes all cached entries of object.
+func (c *ImageCache) Invalidate(object string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fetches, ok := c.fetches[object]; ok {
+		fetches.generation++
+	}
+	if c.memory != nil {
+		c.memory.Invalidate(object)
+	}
+	if c.disk != nil {
+		c.disk.Invalidate(object)
+	}
+}
+
+// cacheObject returns cache object of storage object, leading slash of download path is ignored
+func cacheObject(bucketName string, objName string) string {
+	return bucketName + "/" + strings.TrimPrefix(objName, "/")
+}
+
+// invalidateCache drops cached downloads of object if caching is enabled
+func (ctx *AppContext) invalidateCache(bucketName string, objName string) {
+	if ctx.Cache != nil {
+		ctx.Cache.Invalidate(cacheObject(bucketName, objName))
+	}
+}
+
+// beginFetch registers fetch of object if caching is enabled & returns its generation with function finishing it
+func (ctx *AppContext) beginFetch(bucketName string, objName string) (uint64, func()) {
+	if ctx.Cache == nil {
+		return 0, func() {}
+	}
+	object := cacheObject(bucketName, objName)
+	return ctx.Cache.Begin(object), func() { ctx.Cache.End(object) }
+}
+
+// cacheImage caches downloaded image by download key if caching is enabled & object isn't invalidated since fetch
+func (ctx *AppContext) cacheImage(bucketName string, objName string, key string, generation uint64, contentType string, data []byte) {
+	if ctx.Cache != nil {
+		ctx.Cache.Put(cacheObject(bucketName, objName), key, CachedImage{ContentType: contentType, Data: data}, generation)
+	}
+}
+
+// serveCached responds with cached image, reports false on cache miss or if caching is disabled
+func serveCached(w http.ResponseWriter, ctx *AppContext, policy *BucketPolicy, bucketName string, objName string, key string) bool {
+	if ctx.Cache == nil {
+		return false
+	}
+	img, ok := ctx.Cache.Get(cacheObject(bucketName, objName), key)
+	if !ok {
+		return false
+	}
+	if policy.CacheControl != "" {
+		w.Header().Set("Cache-Control", policy.CacheControl)
+	}
+	if img.ContentType != "" {
+		w.Header().Set("Content-Type", img.ContentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(img.Data); err != nil {
+		log.Println("CANT_RESPOND_FILE", err)
+	}
+	return true
+}
+
+type memoryEntry struct {
+	object  string
+	key     string
+	image   CachedImage
+	expires time.Time
+}
+
+// memoryCache is LRU bounded by total size of images
+type memoryCache struct {
+	maxSize int64
+
+	mu       sync.Mutex
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+	byObject map[string]map[string]struct{}
+}
+
+func newMemoryCache(maxSize int64) *memoryCache {
+	return &memoryCache{
+		maxSize:  maxSize,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		byObject: map[string]map[string]struct{}{},
+	}
+}
+
+func (mc *memoryCache) Get(key string) (CachedImage, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	el, ok := mc.entries[key]
+	if !ok {
+		return CachedImage{}, false
+	}
+	entry := el.Value.(*memoryEntry)
+	if expired(entry.expires) {
+		mc.remove(el)
+		cacheSize.WithLabelValues(CacheLevelMemory).Set(float64(mc.size))
+		return CachedImage{}, false
+	}
+	mc.order.MoveToFront(el)
+	return entry.image, true
+}
+
+func (mc *memoryCache) Put(object string, key string, img CachedImage, expires time.Time) {
+	// Image larger than the whole cache would evict everything for nothing
+	if img.size() > mc.maxSize {
+		return
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el, ok := mc.entries[key]; ok {
+		mc.remove(el)
+	}
+	mc.entries[key] = mc.order.PushFront(&memoryEntry{object: object, key: key, image: img, expires: expires})
+	if mc.byObject[object] == nil {
+		mc.byObject[object] = map[string]struct{}{}
+	}
+	mc.byObject[object][key] = struct{}{}
+	mc.size += img.size()
+
+	for mc.size > mc.maxSize {
+		mc.remove(mc.order.Back())
+	}
+	cacheSize.WithLabelValues(CacheLevelMemory).Set(float64(mc.size))
+}
+
+func (mc *memoryCache) Invalidate(object string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for key := range mc.byObject[object] {
+		mc.remove(mc.entries[key])
+	}
+	cacheSize.WithLabelValues(CacheLevelMemory).Set(float64(mc.size))
+}
+
+func (mc *memoryCache) remove(el *list.Element) {
+	entry := mc.order.Remove(el).(*memoryEntry)
+	delete(mc.entries, entry.key)
+	delete(mc.byObject[entry.object], entry.key)
+	if len(mc.byObject[entry.object]) == 0 {
+		delete(mc.byObject, entry.object)
+	}
+	mc.size -= entry.image.size()
+}
+
+type diskEntry struct {
+	path    string
+	size    int64
+	expires time.Time
+}
+
+// diskCache is LRU of files bounded by their total size.
+// Files of object are kept in its own directory, so object is invalidated by removal of directory.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// newDiskCache returns empty disk cache, files left by previous run are removed
+// since objects may be deleted or overwritten meanwhile
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Only directories of cached objects are removed, so misconfigured directory isn't wiped
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() && cacheHashPattern.MatchString(file.Name()) {
+			if err = os.RemoveAll(filepath.Join(dir, file.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	cacheSize.WithLabelValues(CacheLevelDisk).Set(0)
+	return &diskCache{dir: dir, maxSize: maxSize, order: list.New(), entries: map[string]*list.Element{}}, nil
+}
+
+// Get returns cached image & its expiration time
+func (dc *diskCache) Get(object string, key string) (CachedImage, time.Time, bool) {
+	path := dc.path(object, key)
+	var expires time.Time
+	dc.mu.Lock()
+	el, ok := dc.entries[path]
+	if ok {
+		expires = el.Value.(*diskEntry).expires
+		if expired(expires) {
+			dc.remove(el)
+			cacheSize.WithLabelValues(CacheLevelDisk).Set(float64(dc.size))
+			ok = false
+		} else {
+			dc.order.MoveToFront(el)
+		}
+	}
+	dc.mu.Unlock()
+	if !ok {
+		return CachedImage{}, expires, false
+	}
+
+	// File may be evicted or invalidated meanwhile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return CachedImage{}, expires, false
+	}
+	img, ok := decodeCachedImage(data)
+	return img, expires, ok
+}
+
+func (dc *diskCache) Put(object string, key string, img CachedImage, expires time.Time) {
+	data := encodeCachedImage(img)
+	size := int64(len(data))
+	if size > dc.maxSize {
+		return
+	}
+
+	// Files are written under lock, so invalidation doesn't race with them
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	path := dc.path(object, key)
+	if err := writeCacheFile(path, data); err != nil {
+		log.Println("CANT_WRITE_CACHE", err)
+		return
+	}
+	if el, ok := dc.entries[path]; ok {
+		dc.size -= el.Value.(*diskEntry).size
+		dc.order.Remove(el)
+	}
+	dc.entries[path] = dc.order.PushFront(&diskEntry{path: path, size: size, expires: expires})
+	dc.size += size
+	dc.evict()
+}
+
+func (dc *diskCache) Invalidate(object string) {
+	dir := filepath.Join(dc.dir, cacheHash(object))
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	prefix := dir + string(os.PathSeparator)
+	for path, el := range dc.entries {
+		if strings.HasPrefix(path, prefix) {
+			dc.size -= el.Value.(*diskEntry).size
+			dc.order.Remove(el)
+			delete(dc.entries, path)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Println("CANT_REMOVE_CACHE", err)
+	}
+	cacheSize.WithLabelValues(CacheLevelDisk).Set(float64(dc.size))
+}
+
+// evict removes least recently used files till total size fits, it must be called under lock
+func (dc *diskCache) evict() {
+	for dc.size > dc.maxSize {
+		dc.remove(dc.order.Back())
+	}
+	cacheSize.WithLabelValues(CacheLevelDisk).Set(float64(dc.size))
+}
+
+// remove removes file of entry, it must be called under lock
+func (dc *diskCache) remove(el *list.Element) {
+	entry := dc.order.Remove(el).(*diskEntry)
+	delete(dc.entries, entry.path)
+	dc.size -= entry.size
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.Println("CANT_REMOVE_CACHE", err)
+	}
+	// Directory of object is removed with its last file
+	os.Remove(filepath.Dir(entry.path))
+}
+
+func (dc *diskCache) path(object string, key string) string {
+	return filepath.Join(dc.dir, cacheHash(object), cacheHash(key))
+}
+
+// expired reports whether expiration time is passed, zero time never expires
+func expired(expires time.Time) bool {
+	return !expires.IsZero() && time.Now().After(expires)
+}
+
+// cacheHashPattern matches file names of cache objects & keys
+var cacheHashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// cacheHash returns file name for cache object or key
+func cacheHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeCacheFile writes file atomically, so partially written file is never read
+func writeCacheFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// encodeCachedImage returns content type line followed by image data
+func encodeCachedImage(img CachedImage) []byte {
+	return append([]byte(img.ContentType+"\n"), img.Data...)
+}
+
+func decodeCachedImage(data []byte) (CachedImage, bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return CachedImage{}, false
+	}
+	return CachedImage{ContentType: string(data[:i]), Data: data[i+1:]}, true
+}
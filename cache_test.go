@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCache(t *testing.T) {
+	mc := newMemoryCache(30)
+	image := func(data string) CachedImage { return CachedImage{ContentType: "a", Data: []byte(data)} }
+
+	mc.Put("docs/a.jpg", "a-200", image("123456789"), time.Time{})
+	mc.Put("docs/a.jpg", "a-400", image("123456789"), time.Time{})
+	mc.Put("docs/b.jpg", "b-200", image("123456789"), time.Time{})
+	assert.Equal(t, int64(30), mc.size)
+
+	// The least recently used image is evicted
+	_, ok := mc.Get("a-200")
+	assert.True(t, ok)
+	mc.Put("docs/c.jpg", "c-200", image("123456789"), time.Time{})
+	_, ok = mc.Get("a-400")
+	assert.False(t, ok)
+	img, ok := mc.Get("a-200")
+	assert.True(t, ok)
+	assert.Equal(t, "123456789", string(img.Data))
+
+	// Image larger than cache isn't cached
+	mc.Put("docs/d.jpg", "d-200", image("1234567890123456789012345678901"), time.Time{})
+	_, ok = mc.Get("d-200")
+	assert.False(t, ok)
+
+	// All transforms of object are invalidated
+	mc.Put("docs/a.jpg", "a-400", image("1"), time.Time{})
+	mc.Invalidate("docs/a.jpg")
+	_, ok = mc.Get("a-200")
+	assert.False(t, ok)
+	_, ok = mc.Get("a-400")
+	assert.False(t, ok)
+	_, ok = mc.Get("c-200")
+	assert.True(t, ok)
+	assert.NotContains(t, mc.byObject, "docs/a.jpg")
+
+	// Expired image isn't served
+	mc.Put("docs/e.jpg", "e-200", image("1"), time.Now().Add(-time.Second))
+	_, ok = mc.Get("e-200")
+	assert.False(t, ok)
+	assert.NotContains(t, mc.entries, "e-200")
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Files of previous run are removed, other files are kept
+	stale := filepath.Join(dir, cacheHash("docs/a.jpg"))
+	assert.Nil(t, os.MkdirAll(stale, 0700))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(stale, cacheHash("a-200")), []byte("\nstale"), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("keep"), 0600))
+	dc, err := newDiskCache(dir, 30)
+	assert.Nil(t, err)
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "README"))
+	assert.Nil(t, err)
+
+	expires := time.Now().Add(time.Minute)
+	dc.Put("docs/a.jpg", "a-200", CachedImage{ContentType: MIMEImageJPEG, Data: []byte("12345")}, expires)
+	dc.Put("docs/a.jpg", "a-400", CachedImage{Data: []byte("12345")}, expires)
+	img, imgExpires, ok := dc.Get("docs/a.jpg", "a-200")
+	assert.True(t, ok)
+	assert.Equal(t, expires, imgExpires)
+	assert.Equal(t, CachedImage{ContentType: MIMEImageJPEG, Data: []byte("12345")}, img)
+	img, _, ok = dc.Get("docs/a.jpg", "a-400")
+	assert.True(t, ok)
+	assert.Equal(t, "", img.ContentType)
+
+	// Files are evicted to fit size
+	dc.Put("docs/b.jpg", "b-200", CachedImage{ContentType: MIMEImageJPEG, Data: []byte("12345")}, expires)
+	_, _, ok = dc.Get("docs/a.jpg", "a-200")
+	assert.False(t, ok)
+	_, err = os.Stat(dc.path("docs/a.jpg", "a-200"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Expired file is removed
+	dc.Put("docs/c.jpg", "c-200", CachedImage{Data: []byte("1")}, time.Now().Add(-time.Second))
+	_, _, ok = dc.Get("docs/c.jpg", "c-200")
+	assert.False(t, ok)
+	_, err = os.Stat(filepath.Join(dir, cacheHash("docs/c.jpg")))
+	assert.True(t, os.IsNotExist(err))
+
+	// Directory of object is removed on invalidation
+	dc.Invalidate("docs/b.jpg")
+	_, _, ok = dc.Get("docs/b.jpg", "b-200")
+	assert.False(t, ok)
+	assert.Equal(t, int64(6), dc.size)
+	_, err = os.Stat(filepath.Join(dir, cacheHash("docs/b.jpg")))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestImageCacheFetch(t *testing.T) {
+	cache, err := NewImageCache(1024, "", 0, 0)
+	assert.Nil(t, err)
+	img := CachedImage{Data: []byte("image")}
+
+	// Image fetched before invalidation isn't cached
+	generation := cache.Begin("docs/a.jpg")
+	cache.Invalidate("docs/a.jpg")
+	cache.Put("docs/a.jpg", "a-200", img, generation)
+	cache.End("docs/a.jpg")
+	_, ok := cache.Get("docs/a.jpg", "a-200")
+	assert.False(t, ok)
+
+	// Image fetched after invalidation is cached
+	generation = cache.Begin("docs/a.jpg")
+	cache.Put("docs/a.jpg", "a-200", img, generation)
+	cache.End("docs/a.jpg")
+	_, ok = cache.Get("docs/a.jpg", "a-200")
+	assert.True(t, ok)
+	assert.Empty(t, cache.fetches)
+}
+
+func TestDownloadCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := NewImageCache(1024, dir, 1024, time.Minute)
+	assert.Nil(t, err)
+	appCtx := &AppContext{Config: &Config{}, Buckets: loadTestBucketsConfig(t), Cache: cache}
+	req := httptest.NewRequest("GET", "/avatars/a.jpg", nil)
+	key := downloadKey(appCtx.ForRequest(req), "avatars", "/a.jpg")
+	appCtx.cacheImage("avatars", "/a.jpg", key, 0, MIMEImageJPEG, []byte("image"))
+
+	// Cached image is served without storage
+	rr := httptest.NewRecorder()
+	InitRouter(appCtx).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, MIMEImageJPEG, rr.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=31536000", rr.Header().Get("Cache-Control"))
+	assert.Equal(t, "image", rr.Body.String())
+
+	// Transforms don't make distinct downloads in bucket without resizing
+	rr = httptest.NewRecorder()
+	InitRouter(appCtx).ServeHTTP(rr, httptest.NewRequest("GET", "/avatars/a.jpg?preset=thumb&quality=50", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image", rr.Body.String())
+
+	// Disk hit is promoted to memory
+	cache.memory.Invalidate("avatars/a.jpg")
+	_, ok := cache.Get("avatars/a.jpg", key)
+	assert.True(t, ok)
+	_, ok = cache.memory.Get(key)
+	assert.True(t, ok)
+
+	// Deleted object isn't cached anymore
+	appCtx.invalidateCache("avatars", "a.jpg")
+	_, ok = cache.Get("avatars/a.jpg", key)
+	assert.False(t, ok)
+}
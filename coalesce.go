@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Coalescer runs function once for concurrent calls with the same key & shares its result with waiters.
+type Coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done   chan struct{}
+	result *bufferedResponse
+}
+
+// NewCoalescer returns empty coalescer.
+func NewCoalescer() *Coalescer {
+	return &Coalescer{calls: map[string]*coalescedCall{}}
+}
+
+// Do returns response recorded by function or waits for in-flight call with the same key.
+// Reports whether response is shared with another call, waiting is stopped if context is done.
+func (c *Coalescer) Do(ctx context.Context, key string, fn func(w http.ResponseWriter)) (*bufferedResponse, bool, error) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.result, true, nil
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+	call := &coalescedCall{done: make(chan struct{}), result: newBufferedResponse()}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	fn(call.result)
+	return call.result, false, nil
+}
+
+// bufferedResponse records response to replay it for coalesced requests
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: http.Header{}}
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) WriteHeader(code int) {
+	if br.status == 0 {
+		br.status = code
+	}
+}
+
+func (br *bufferedResponse) Write(data []byte) (int, error) {
+	br.WriteHeader(http.StatusOK)
+	return br.body.Write(data)
+}
+
+// Status returns recorded status code.
+func (br *bufferedResponse) Status() int {
+	if br.status == 0 {
+		return http.StatusOK
+	}
+	return br.status
+}
+
+// replay writes recorded response, body isn't modified, so it's shared by waiters
+func (br *bufferedResponse) replay(w http.ResponseWriter) error {
+	for key, values := range br.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(br.Status())
+	_, err := w.Write(br.body.Bytes())
+	return err
+}
+
+// detachedContext keeps values of parent context like trace span without its cancellation,
+// so coalesced requests aren't failed by disconnected client which started the call.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// downloadKey returns key of download by object & normalized transform, f.ex. presets & DPR are resolved to dimensions
+func downloadKey(ctx *AppContext, bucketName string, objName string) string {
+	opts := ctx.Options
+	return fmt.Sprintf("%s/%s?dimensions=%v&enlarge=%t&still=%t&format=%s&quality=%d&op=%s&watermark=%s",
+		bucketName, objName, ctx.Dimensions, opts.Enlarge, opts.Still, opts.Format, opts.Quality, ctx.Pipeline, opts.Watermark)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := NewCoalescer()
+	release := make(chan struct{})
+	var calls int32
+	fn := func(w http.ResponseWriter) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Header().Set("Content-Type", MIMEImagePNG)
+		w.Write([]byte("resized"))
+	}
+
+	// The first call is in flight till release
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		response, shared, err := c.Do(context.Background(), "docs/a.png?resize=600", fn)
+		assert.Nil(t, err)
+		assert.False(t, shared)
+		assert.Equal(t, "resized", response.body.String())
+	}()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+
+	var sharedCalls int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, shared, err := c.Do(context.Background(), "docs/a.png?resize=600", fn)
+			assert.Nil(t, err)
+			if shared {
+				atomic.AddInt32(&sharedCalls, 1)
+			}
+			rr := httptest.NewRecorder()
+			assert.Nil(t, response.replay(rr))
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, MIMEImagePNG, rr.Header().Get("Content-Type"))
+			assert.Equal(t, "resized", rr.Body.String())
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Waiter of disconnected client doesn't wait for the call
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, shared, err := c.Do(ctx, "docs/a.png?resize=600", fn)
+	assert.True(t, shared)
+	assert.Equal(t, context.Canceled, err)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&sharedCalls))
+
+	// Finished call isn't shared
+	response, shared, err := c.Do(context.Background(), "docs/a.png?resize=600", func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	assert.Nil(t, err)
+	assert.False(t, shared)
+	assert.Equal(t, http.StatusNotFound, response.Status())
+}
+
+func TestDetachedContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "span"))
+	ctx := detachedContext{parent}
+	cancel()
+
+	assert.NotNil(t, parent.Err())
+	assert.Nil(t, ctx.Err())
+	assert.Nil(t, ctx.Done())
+	assert.Equal(t, "span", ctx.Value(key{}))
+}
+
+func TestDownloadKey(t *testing.T) {
+	appCtx := &AppContext{Options: &Options{Preset: "thumb", Resize: "200x200"}, Dimensions: []int{200, 200}}
+	resized := &AppContext{Options: &Options{Resize: "200x200"}, Dimensions: []int{200, 200}}
+	assert.Equal(t, downloadKey(appCtx, "docs", "/a.jpg"), downloadKey(resized, "docs", "/a.jpg"))
+
+	// Operations are compared in canonical form
+	rotated := func(op string) *AppContext {
+		pipeline, err := ParsePipeline(op, false)
+		assert.Nil(t, err)
+		return &AppContext{Options: &Options{Op: op}, Pipeline: pipeline}
+	}
+	assert.Equal(t, downloadKey(rotated("rotate:90|rotate:180"), "docs", "/a.jpg"), downloadKey(rotated("rotate:270"), "docs", "/a.jpg"))
+	assert.NotEqual(t, downloadKey(rotated("rotate:90"), "docs", "/a.jpg"), downloadKey(rotated("rotate:270"), "docs", "/a.jpg"))
+
+	watermarked := &AppContext{Options: &Options{Resize: "200x200", Watermark: "logo"}, Dimensions: []int{200, 200}}
+	assert.NotEqual(t, downloadKey(resized, "docs", "/a.jpg"), downloadKey(watermarked, "docs", "/a.jpg"))
+	assert.NotEqual(t, downloadKey(resized, "docs", "/a.jpg"), downloadKey(resized, "docs", "/b.jpg"))
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"mime"
 	"net/http"
@@ -14,10 +16,12 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/minio/minio-go"
 	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const MaxUploadSize = 10 * 1024 * 1024 // 10mb
@@ -29,7 +33,11 @@ type UploadHandler struct {
 
 // UploadResponse represents response for uploaded image
 type UploadResponse struct {
-	File string `json:"file"`
+	File        string       `json:"file"`
+	Moderation  string       `json:"moderation,omitempty"` // Pending for moderated buckets
+	Placeholder *Placeholder `json:"placeholder,omitempty"`
+	Hashes      *ImageHashes `json:"hashes,omitempty"`
+	Jobs        []string     `json:"jobs,omitempty"` // IDs of background jobs
 }
 
 // DownloadHandler is a wrapper to provide appContext to download handler
@@ -86,6 +94,19 @@ func (u *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//     name: resize
 	//     type: string
 	//     description: Resize string. It must follow one of two patterns, '100x100' as width x height or '100' as width.
+	//   - in: query
+	//     name: preset
+	//     type: string
+	//     description: Resize preset name. Presets are configured per bucket.
+	//   - in: query
+	//     name: still
+	//     type: boolean
+	//     description: Keep the first frame of animated GIF only.
+	//   - in: query
+	//     name: format
+	//     type: string
+	//     enum: [gif, webp]
+	//     description: Output format of GIF, f.ex. webp converts animation into animated WebP.
 	//   - in: formData
 	//     name: file
 	//     type: file
@@ -102,30 +123,65 @@ func (u *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//         file:
 	//           type: string
 	//           description: Generated file name of uploaded image.
+	//         moderation:
+	//           type: string
+	//           description: Moderation status (pending) for moderated buckets, file isn't readable till approval.
+	//         placeholder:
+	//           $ref: '#/definitions/placeholder'
+	//         hashes:
+	//           $ref: '#/definitions/imageHashes'
+	//         jobs:
+	//           type: array
+	//           items:
+	//             type: string
+	//           description: IDs of background jobs generating variants or computing placeholders & hashes, see GET /jobs/{id}.
 	//   '400':
-	//     description: Bad request (RESIZE_PARAMS_ARE_INVALID, FILE_TOO_BIG, INVALID_FILE_CONTENT, INVALID_FILE_TYPE).
+	//     description: Bad request (RESIZE_PARAMS_ARE_INVALID, RESIZE_NOT_ALLOWED, FILE_TOO_BIG, INVALID_FILE_CONTENT, INVALID_FILE_TYPE, IMAGE_TOO_LARGE, CANT_NORMALIZE_FILE).
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND).
+	//   '422':
+	//     description: File is flagged by malware scanner (FILE_IS_INFECTED).
+	//   '429':
+	//     description: Too many requests (RATE_LIMIT_EXCEEDED).
 	//   '500':
-	//     description: Internal error (CANT_GENERATE_FILENAME, CANT_RESIZE_FILE, CANT_POST_TO_STORAGE, CANT_MARSHAL_DATA).
+	//     description: Internal error (CANT_GENERATE_FILENAME, CANT_RESIZE_FILE, CANT_READ_FILE, CANT_POST_TO_STORAGE, CANT_MARSHAL_DATA).
+	//   '503':
+	//     description: Scanner is unavailable for fail-closed scanning (CANT_SCAN_FILE) or resizer is unavailable without fallback (RESIZER_UNAVAILABLE).
 	var result io.Reader
 	var err error
-	var ctx = u.ctx
+	var ctx = u.ctx.ForRequest(r)
+	var policy = BucketPolicyFromRequest(r)
+
+	// Apply bucket presets to options
+	ctx.Options, err = policy.ResolveOptions(ctx.Options, ctx.Presets())
+	if err != nil {
+		renderError(w, err, "RESIZE_NOT_ALLOWED", http.StatusBadRequest)
+		return
+	}
 
 	// Get resize dimensions with validation
 	ctx.Dimensions, err = PrepareDimensions(ctx.Options.Resize)
+	if err == nil {
+		err = validateMaxDimensions(ctx.Dimensions)
+	}
 	if err != nil {
 		renderError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
 		return
 	}
+	if err = validateOptions(ctx.Options); err != nil {
+		renderError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
 
 	// Validate file size
-	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
-	if err = r.ParseMultipartForm(MaxUploadSize); err != nil {
+	r.Body = http.MaxBytesReader(w, r.Body, policy.MaxUploadSize)
+	if err = r.ParseMultipartForm(policy.MaxUploadSize); err != nil {
 		renderError(w, err, "FILE_TOO_BIG", http.StatusBadRequest)
 		return
 	}
 
 	// Validate file pt.1
-	file, handler, err := r.FormFile("file")
+	file, _, err := r.FormFile("file")
 	if err != nil {
 		renderError(w, err, "INVALID_FILE_CONTENT", http.StatusBadRequest)
 		return
@@ -138,45 +194,156 @@ func (u *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		renderError(w, err, "INVALID_FILE_CONTENT", http.StatusBadRequest)
 		return
 	}
+	uploadSize.Observe(float64(buf.Len()))
 
 	// Validate content type
-	fileType := http.DetectContentType(buf.Bytes())
-	if fileType != MIMEImageJPEG && fileType != MIMEImageGIF && fileType != MIMEImagePNG {
+	bucketName := mux.Vars(r)["bucket"]
+	fileType := detectContentType(r.Context(), buf.Bytes())
+	if !policy.AllowsType(fileType) {
+		emitRejection(ctx, bucketName, "INVALID_FILE_TYPE", errors.New("Type "+fileType+" isn't allowed"))
 		renderError(w, nil, "INVALID_FILE_TYPE", http.StatusBadRequest)
 		return
 	}
 
+	// Validate declared dimensions before resizing or storing
+	if err = CheckImageLimits(buf.Bytes(), imageLimits(ctx.Config)); err != nil {
+		code := "INVALID_FILE_CONTENT"
+		if errors.Is(err, ErrImageTooLarge) {
+			code = "IMAGE_TOO_LARGE"
+		}
+		emitRejection(ctx, bucketName, code, err)
+		renderImageLimitsError(w, err)
+		return
+	}
+
+	// Validate image structure & decode it fully due to bucket policy
+	_, span := startSpan(r.Context(), "content.validate")
+	err = ValidateImage(buf.Bytes(), fileType, *policy.FullDecode)
+	endSpan(span, err)
+	if err != nil {
+		emitRejection(ctx, bucketName, "INVALID_FILE_CONTENT", err)
+		renderError(w, err, "INVALID_FILE_CONTENT", http.StatusBadRequest)
+		return
+	}
+
+	// Scan original for malware before storing
+	if ctx.Scanner != nil {
+		if err = scanUpload(r.Context(), ctx, bucketName, buf.Bytes(), fileType); errors.Is(err, ErrInfected) {
+			emitRejection(ctx, bucketName, "FILE_IS_INFECTED", err)
+			renderError(w, err, "FILE_IS_INFECTED", http.StatusUnprocessableEntity)
+			return
+		} else if err != nil {
+			renderError(w, err, "CANT_SCAN_FILE", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// Animated GIF may be converted on resizing
+	resultType := fileType
+	if *policy.ResizeOnUpload {
+		resultType = ResultType(fileType, ctx.Options)
+	}
+
 	// Generate hashed filename
-	fileName, err := GenerateFileName(fileType)
+	fileName, err := GenerateFileName(resultType)
 	if err != nil {
 		renderError(w, err, "CANT_GENERATE_FILENAME", http.StatusInternalServerError)
 	}
 
 	// Resize image or don't
-	if ctx.Config.ResizeOnUpload {
-		result, err = ResizeImage(ctx, buf, fileType)
+	if *policy.ResizeOnUpload {
+		result, _, err = resizeWithFallback(r.Context(), ctx, policy, buf.Bytes(), fileType)
 		if err != nil {
-			renderError(w, err, "CANT_RESIZE_FILE", http.StatusInternalServerError)
+			renderResizeError(w, err)
 			return
 		}
 	} else {
 		result = buf
 	}
 
+	// Normalize orientation & strip metadata due to bucket policy
+	if policy.Normalize.Enabled() {
+		result, err = normalizeImage(r.Context(), result, fileType, policy.Normalize)
+		if err != nil {
+			renderError(w, err, "CANT_NORMALIZE_FILE", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Restrict uploads by principal prefix, f.ex. "users/{sub}/"
+	if principal := PrincipalFromRequest(r); principal != nil {
+		fileName = principal.Prefix + fileName
+	}
+
+	// Compute placeholders & hashes of stored image, upload doesn't fail without them
+	data, err := ioutil.ReadAll(result)
+	if err != nil {
+		renderError(w, err, "CANT_READ_FILE", http.StatusInternalServerError)
+		return
+	}
+	analysis := &ImageAnalysis{}
+	if !policy.AsyncAnalysis || ctx.Jobs == nil {
+		if analysis, err = analyzeImage(r.Context(), ctx.Config, data, resultType); err != nil {
+			log.Println("CANT_ANALYZE_IMAGE", err)
+		}
+	}
+
+	// Uploads to moderated bucket are held under pending prefix till approval
+	objName, metadata, moderation := fileName, analysis.Metadata(), ""
+	if policy.Moderation {
+		objName, moderation = ModerationPendingPrefix+fileName, ModerationPending
+		metadata[MetadataModerationStatus] = moderation
+	}
+
 	// Post to storage
-	n, err := ctx.Storage.PutObject(mux.Vars(r)["bucket"], fileName, result, -1, minio.PutObjectOptions{
-		ContentType: handler.Header.Get("Content-Type"),
+	_, span = startSpan(r.Context(), "storage.put", storageAttributes(bucketName, objName)...)
+	start := time.Now()
+	// Sniffed type is stored rather than declared by client
+	n, err := ctx.Storage.PutObject(bucketName, objName, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  resultType,
+		UserMetadata: metadata,
 	})
+	observeStorage(StorageOpPut, start, err)
+	endSpan(span, err)
 	if err != nil {
 		renderError(w, err, "CANT_POST_TO_STORAGE", http.StatusInternalServerError)
 		return
 	}
 
 	log.Println("Uploaded: ", n)
-	log.Printf("%#v\n", ctx.Storage)
+	ctx.invalidateCache(bucketName, objName)
+
+	// Index hash for similarity search, moderated uploads are indexed after approval
+	if analysis.Hashes != nil && ctx.SimilarityIndex != nil && !policy.Moderation {
+		hash, _ := ParseHash(analysis.Hashes.PHash)
+		if err = ctx.SimilarityIndex.Add(bucketName, fileName, hash); err != nil {
+			log.Println("CANT_INDEX_IMAGE", err)
+		}
+	}
+
+	emitEvent(ctx, EventImageUploaded, bucketName, fileName, map[string]interface{}{
+		"contentType": resultType,
+		"size":        len(data),
+		"moderation":  moderation,
+		"placeholder": analysis.Placeholder,
+		"hashes":      analysis.Hashes,
+	})
+	// Variants & analysis are processed in background, moderated uploads are processed after approval
+	var jobs []string
+	if policy.Moderation {
+		notifyModeration(ctx, ModerationEvent{
+			Bucket:      bucketName,
+			File:        fileName,
+			ContentType: resultType,
+			Data:        data,
+			Callback:    publicURL(r, ctx) + "/moderation/callback",
+		})
+	} else {
+		jobs = enqueueJobs(ctx, bucketName, fileName, policy)
+	}
 
 	// Prepare json with result file URL
-	ur := UploadResponse{fileName}
+	ur := UploadResponse{File: fileName, Moderation: moderation, Placeholder: analysis.Placeholder, Hashes: analysis.Hashes, Jobs: jobs}
 	resultURL, err := json.Marshal(ur)
 	if err != nil {
 		renderError(w, err, "CANT_MARSHAL_DATA", http.StatusInternalServerError)
@@ -210,6 +377,40 @@ func (d *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//     type: string
 	//     required: true
 	//     description: Object name in storage.
+	//   - in: query
+	//     name: preset
+	//     type: string
+	//     description: Resize preset name. Presets are configured per bucket.
+	//   - in: query
+	//     name: still
+	//     type: boolean
+	//     description: Keep the first frame of animated GIF only.
+	//   - in: query
+	//     name: format
+	//     type: string
+	//     enum: [gif, webp]
+	//     description: Output format of GIF, f.ex. webp converts animation into animated WebP.
+	//   - in: query
+	//     name: watermark
+	//     type: string
+	//     description: Watermark name. Mandatory watermarks of bucket or preset replace it.
+	//   - in: query
+	//     name: op
+	//     type: string
+	//     description: Operations chain, f.ex. crop:0,0,800,600|resize:400|rotate:90|blur:3|grayscale. Can't be combined with resize or preset.
+	//   - in: query
+	//     name: quality
+	//     type: integer
+	//     description: JPEG quality of transformed image, 1..100.
+	//   - in: query
+	//     name: dpr
+	//     type: integer
+	//     enum: [1, 2, 3]
+	//     description: Device pixel ratio multiplying resize dimensions, they're clamped by 3000px.
+	//   - in: query
+	//     name: signature
+	//     type: string
+	//     description: Signature of path & query, required for transforms if URL_SIGNATURE_QUERY is set.
 	// responses:
 	//   '200':
 	//     description: OK. Returns file from storage.
@@ -226,23 +427,79 @@ func (d *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//         schema:
 	//           type: string
 	//           format: binary
+	//       'image/webp':
+	//         schema:
+	//           type: string
+	//           format: binary
 	//   '400':
-	//     description: Bad request (RESIZE_PARAMS_ARE_INVALID, INVALID_FILE_TYPE).
+	//     description: Bad request (RESIZE_PARAMS_ARE_INVALID, RESIZE_NOT_ALLOWED, WATERMARK_IS_INVALID, OPERATIONS_NOT_ALLOWED, INVALID_FILE_TYPE, INVALID_FILE_CONTENT, IMAGE_TOO_LARGE).
+	//   '403':
+	//     description: Forbidden (SIGNATURE_IS_INVALID).
 	//   '404':
-	//     description: Not found (CANT_PROCESS_FILE_ON_STORAGE).
+	//     description: Not found (BUCKET_NOT_FOUND, CANT_PROCESS_FILE_ON_STORAGE).
+	//   '429':
+	//     description: Too many requests (RATE_LIMIT_EXCEEDED).
 	//   '500':
-	//     description: Internal error (CANT_READ_FILE, CANT_RESIZE_FILE, CANT_RESPOND_FILE).
-	var result io.Reader
+	//     description: Internal error (CANT_READ_FILE, CANT_RESIZE_FILE, CANT_NORMALIZE_FILE, CANT_TRANSFORM_FILE, CANT_WATERMARK_FILE, CANT_RESPOND_FILE).
+	//   '503':
+	//     description: Resizer is unavailable without fallback (RESIZER_UNAVAILABLE).
 	var err error
-	var ctx = d.ctx
+	var ctx = d.ctx.ForRequest(r)
+	var policy = BucketPolicyFromRequest(r)
+
+	// Apply bucket presets to options
+	ctx.Options, err = policy.ResolveOptions(ctx.Options, ctx.Presets())
+	if err != nil {
+		renderError(w, err, "RESIZE_NOT_ALLOWED", http.StatusBadRequest)
+		return
+	}
 
 	// Get resize dimensions with validation
 	ctx.Dimensions, err = PrepareDimensions(ctx.Options.Resize)
+	if err == nil {
+		err = validateMaxDimensions(ctx.Dimensions)
+	}
+	if err != nil {
+		renderError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+	if err = validateOptions(ctx.Options); err != nil {
+		renderError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+
+	// Multiply dimensions by device pixel ratio
+	ctx.Dimensions, err = ApplyDPR(ctx.Dimensions, ctx.Options.DPR)
 	if err != nil {
 		renderError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
 		return
 	}
 
+	// Get operations pipeline validated against bucket policy
+	ctx.Pipeline, err = ParsePipeline(ctx.Options.Op, ctx.Options.Enlarge)
+	if err != nil {
+		renderError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+	if err = policy.AllowsPipeline(ctx.Pipeline); err != nil {
+		renderJSONError(w, err, "OPERATIONS_NOT_ALLOWED", http.StatusBadRequest)
+		return
+	}
+
+	// Get requested or mandatory watermark
+	ctx.Watermark, err = ctx.WatermarkByName(ctx.Options.Watermark)
+	if err != nil {
+		renderError(w, err, "WATERMARK_IS_INVALID", http.StatusBadRequest)
+		return
+	}
+
+	// Only watermark is applied if resizing is disabled, so other options don't make distinct downloads
+	if !*policy.ResizeOnDownload {
+		ctx.Dimensions = nil
+		ctx.Options = &Options{Watermark: ctx.Options.Watermark}
+		ctx.Pipeline = nil
+	}
+
 	// Get bucket & object names from request url
 	var bucketName string
 	var objName string
@@ -265,44 +522,208 @@ func (d *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Remove from objName all params (e.g. "resize")
 	objName = strings.Split(objName, "?")[0]
 
+	// Serve cached image or variant generated in background if it's ready
+	key := downloadKey(ctx, bucketName, objName)
+	if serveCached(w, ctx, policy, bucketName, objName, key) {
+		return
+	}
+	if serveVariant(w, r, ctx, policy, bucketName, objName, key) {
+		return
+	}
+
+	// Identical concurrent downloads are fetched & transformed once
+	if d.ctx.Coalescer == nil {
+		d.respond(w, r, ctx, policy, bucketName, objName, key)
+		return
+	}
+	flightReq := r.WithContext(detachedContext{r.Context()})
+	response, shared, err := d.ctx.Coalescer.Do(r.Context(), key, func(w http.ResponseWriter) {
+		d.respond(w, flightReq, ctx, policy, bucketName, objName, key)
+	})
+	// Client is gone while waiting for identical download
+	if err != nil {
+		return
+	}
+	if shared {
+		observeCoalesced()
+		// Transform rate limit of another client isn't shared
+		if response.Status() == http.StatusTooManyRequests {
+			d.respond(w, r, ctx, policy, bucketName, objName, key)
+			return
+		}
+	}
+	if err := response.replay(w); err != nil {
+		log.Println("CANT_RESPOND_FILE", err)
+	}
+}
+
+// respond fetches object, transforms it due to request & responds with result cached by download key
+func (d *DownloadHandler) respond(w http.ResponseWriter, r *http.Request, ctx *AppContext, policy *BucketPolicy, bucketName string, objName string, key string) {
+	var result io.Reader
+
+	// Result isn't cached if object is invalidated while it's fetched & transformed
+	generation, endFetch := ctx.beginFetch(bucketName, objName)
+	defer endFetch()
+
 	// Get object from storage
+	_, span := startSpan(r.Context(), "storage.get", storageAttributes(bucketName, objName)...)
+	start := time.Now()
 	obj, err := ctx.Storage.GetObject(bucketName, objName, minio.GetObjectOptions{})
 	if err != nil {
+		observeStorage(StorageOpGet, start, err)
+		endSpan(span, err)
 		renderError(w, err, "CANT_PROCESS_FILE_ON_STORAGE", http.StatusNotFound)
 		return
 	}
 
 	// Create buffer for following operations
+	// GOTCHA: Minio fetches object lazily, so reading is a part of storage operation
 	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, obj); err != nil {
+	_, err = io.Copy(buf, obj)
+	observeStorage(StorageOpGet, start, err)
+	endSpan(span, err)
+	if err != nil {
 		renderError(w, err, "CANT_READ_FILE", http.StatusInternalServerError)
 		return
 	}
 
-	// Resize image or don't
-	if ctx.Config.ResizeOnDownload {
+	// Transform image or don't
+	fellBack := false
+	if *policy.ResizeOnDownload || ctx.Watermark != nil {
 		// Get content type
-		fileType := http.DetectContentType(buf.Bytes())
+		fileType := detectContentType(r.Context(), buf.Bytes())
 		if fileType != MIMEImageJPEG && fileType != MIMEImageGIF && fileType != MIMEImagePNG {
 			renderError(w, nil, "INVALID_FILE_TYPE", http.StatusBadRequest)
 			return
 		}
 
-		result, err = ResizeImage(ctx, buf, fileType)
+		// Transforms are expensive, so they're limited separately
+		if ctx.HasTransforms(fileType) {
+			if allowed, wait := ctx.RateLimiter.Allow(r, RateClassTransform); !allowed {
+				renderRateLimited(w, wait)
+				return
+			}
+
+			// Validate declared dimensions before resizing
+			if err = CheckImageLimits(buf.Bytes(), imageLimits(ctx.Config)); err != nil {
+				renderImageLimitsError(w, err)
+				return
+			}
+		}
+
+		result, fellBack, err = resizeWithFallback(r.Context(), ctx, policy, buf.Bytes(), fileType)
 		if err != nil {
-			renderError(w, err, "CANT_RESIZE_FILE", http.StatusInternalServerError)
+			renderResizeError(w, err)
 			return
 		}
+		w.Header().Set("Content-Type", ResultType(fileType, ctx.Options))
+
+		// Apply the same normalization as on upload to resized image
+		if len(ctx.Dimensions) > 0 && policy.Normalize.Enabled() {
+			result, err = normalizeImage(r.Context(), result, fileType, policy.Normalize)
+			if err != nil {
+				renderError(w, err, "CANT_NORMALIZE_FILE", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// GIFs are transformed & watermarked frame by frame on resizing
+		if len(ctx.Pipeline) > 0 && fileType != MIMEImageGIF {
+			result, err = applyPipeline(r.Context(), ctx, result, fileType)
+			if err != nil {
+				renderError(w, err, "CANT_TRANSFORM_FILE", http.StatusInternalServerError)
+				return
+			}
+		}
+		if ctx.Watermark != nil && fileType != MIMEImageGIF {
+			result, err = watermarkImage(r.Context(), ctx, result, fileType)
+			if err != nil {
+				renderError(w, err, "CANT_WATERMARK_FILE", http.StatusInternalServerError)
+				return
+			}
+		}
 	} else {
 		result = buf
 	}
 
+	data, err := ioutil.ReadAll(result)
+	if err != nil {
+		renderError(w, err, "CANT_RESPOND_FILE", http.StatusInternalServerError)
+		return
+	}
+	// Original served in place of transform isn't cached, so it's transformed once resizer is back
+	if !fellBack {
+		ctx.cacheImage(bucketName, objName, key, generation, w.Header().Get("Content-Type"), data)
+	}
+
 	// Respond with data
+	if policy.CacheControl != "" {
+		w.Header().Set("Cache-Control", policy.CacheControl)
+	}
 	w.WriteHeader(http.StatusOK)
-	if _, err := io.Copy(w, result); err != nil {
-		renderError(w, err, "CANT_RESPOND_FILE", http.StatusInternalServerError)
+	if _, err := w.Write(data); err != nil {
+		log.Println("CANT_RESPOND_FILE", err)
+	}
+}
+
+// validateOptions validates options which aren't validated elsewhere
+func validateOptions(opts *Options) error {
+	if opts.Quality < 0 || opts.Quality > 100 {
+		return errors.New("Quality must be within 1..100")
+	}
+	if opts.DPR < 0 || opts.DPR > MaxDPR {
+		return fmt.Errorf("DPR must be within 1..%d", MaxDPR)
+	}
+	return validateFormat(opts.Format)
+}
+
+// HasTransforms reports whether image of given type is transformed due to request.
+func (ctx *AppContext) HasTransforms(fileType string) bool {
+	if len(ctx.Dimensions) > 0 || len(ctx.Pipeline) > 0 || ctx.Watermark != nil {
+		return true
+	}
+	return fileType == MIMEImageGIF && ctx.Options.HasGIFTransforms()
+}
+
+// renderImageLimitsError responds with dedicated code for too large images
+func renderImageLimitsError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrImageTooLarge) {
+		renderJSONError(w, err, "IMAGE_TOO_LARGE", http.StatusBadRequest)
 		return
 	}
+	renderError(w, err, "INVALID_FILE_CONTENT", http.StatusBadRequest)
+}
+
+// normalizeImage reads image & normalizes it due to options
+func normalizeImage(ctx context.Context, input io.Reader, mimeType string, opts NormalizeOptions) (io.Reader, error) {
+	_, span := startSpan(ctx, "image.normalize")
+	data, err := ioutil.ReadAll(input)
+	if err == nil {
+		data, err = NormalizeImage(data, mimeType, opts)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// detectContentType sniffs content type of given data
+func detectContentType(ctx context.Context, data []byte) string {
+	_, span := startSpan(ctx, "content.sniff")
+	defer span.End()
+
+	fileType := http.DetectContentType(data)
+	span.SetAttributes(attribute.String("content.type", fileType))
+	return fileType
+}
+
+// storageAttributes returns span attributes for storage operations
+func storageAttributes(bucketName string, objName string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("storage.bucket", bucketName),
+		attribute.String("storage.object", objName),
+	}
 }
 
 // PrepareDimensions returns dimensions from string input.
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go"
+)
+
+// DeleteHandler is a wrapper to provide appContext to delete handler.
+type DeleteHandler struct {
+	ctx *AppContext
+}
+
+// DeleteController removes image from storage & similarity index
+func (h *DeleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation DELETE /{bucket}/{object} delete
+	// ---
+	// summary: Delete
+	// description: Delete image from storage, client must have delete operation.
+	// parameters:
+	//   - in: path
+	//     name: bucket
+	//     type: string
+	//     required: true
+	//     description: Bucket name in storage.
+	//   - in: path
+	//     name: object
+	//     type: string
+	//     required: true
+	//     description: Object name in storage.
+	// responses:
+	//   '204':
+	//     description: Image is deleted.
+	//   '403':
+	//     description: Forbidden (FORBIDDEN).
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND, CANT_PROCESS_FILE_ON_STORAGE).
+	//   '429':
+	//     description: Too many requests (RATE_LIMIT_EXCEEDED).
+	//   '500':
+	//     description: Internal error (CANT_DELETE_FILE).
+
+	// Deletion isn't open to anonymous clients even if authentication is disabled
+	principal := PrincipalFromRequest(r)
+	if principal == nil {
+		renderJSONError(w, errors.New("Deletion requires authenticated client"), "FORBIDDEN", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bucketName, objName := vars["bucket"], vars["object"]
+
+	// Stat object to respond 404 for missing one, S3 removal is idempotent
+	_, span := startSpan(r.Context(), "storage.stat", storageAttributes(bucketName, objName)...)
+	start := time.Now()
+	_, err := h.ctx.Storage.StatObject(bucketName, objName, minio.StatObjectOptions{})
+	observeStorage(StorageOpStat, start, err)
+	endSpan(span, err)
+	if err != nil {
+		renderJSONError(w, err, "CANT_PROCESS_FILE_ON_STORAGE", http.StatusNotFound)
+		return
+	}
+
+	_, span = startSpan(r.Context(), "storage.remove", storageAttributes(bucketName, objName)...)
+	start = time.Now()
+	err = h.ctx.Storage.RemoveObject(bucketName, objName)
+	observeStorage(StorageOpRemove, start, err)
+	endSpan(span, err)
+	if err != nil {
+		renderJSONError(w, err, "CANT_DELETE_FILE", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Deleted: %s/%s by %s\n", bucketName, objName, principal.Name)
+	h.ctx.invalidateCache(bucketName, objName)
+
+	// Variants generated in background are removed with original
+	for _, variant := range BucketPolicyFromRequest(r).Variants {
+		if err = h.ctx.Storage.RemoveObject(bucketName, variant.ObjectName(objName)); err != nil {
+			log.Println("CANT_DELETE_VARIANT", err)
+		}
+	}
+
+	if h.ctx.SimilarityIndex != nil {
+		if err = h.ctx.SimilarityIndex.Remove(bucketName, objName); err != nil {
+			log.Println("CANT_INDEX_IMAGE", err)
+		}
+	}
+	emitEvent(h.ctx, EventImageDeleted, bucketName, objName, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Output formats of GIF transforms
+const (
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+)
+
+// GIFOptions represents options of native GIF transforms.
+type GIFOptions struct {
+	Dimensions []int
+	Enlarge    bool
+	Still      bool   // Keep first frame only
+	Format     string // Output format, GIF by default
+	Pipeline   Pipeline
+	Watermark  func(draw.Image)
+}
+
+// validateFormat validates requested output format
+func validateFormat(format string) error {
+	if format != "" && format != FormatGIF && format != FormatWebP {
+		return errors.New("Requested format isn't supported")
+	}
+	return nil
+}
+
+// HasGIFTransforms reports whether GIF transforms besides resizing are requested.
+func (o *Options) HasGIFTransforms() bool {
+	return o.Still || o.Format != ""
+}
+
+// ResultType returns content type of transformed image.
+func ResultType(mimeType string, opts *Options) string {
+	if mimeType == MIMEImageGIF && opts.Format == FormatWebP {
+		return MIMEImageWebP
+	}
+	return mimeType
+}
+
+// resizeGIF resizes GIF natively, Imaginary doesn't support it
+func resizeGIF(reqCtx context.Context, ctx *AppContext, input io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	watermark, err := watermarkFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startSpan(reqCtx, "gif.resize", attribute.Bool("gif.still", ctx.Options.Still), attribute.String("gif.format", ctx.Options.Format))
+	start := time.Now()
+	data, err = ResizeGIF(data, GIFOptions{
+		Dimensions: ctx.Dimensions,
+		Enlarge:    ctx.Options.Enlarge,
+		Still:      ctx.Options.Still,
+		Format:     ctx.Options.Format,
+		Pipeline:   ctx.Pipeline,
+		Watermark:  watermark,
+	})
+	observeResize(ResizerNative, start, err != nil)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// ResizeGIF resizes GIF frame by frame preserving delays, disposal & loop count.
+// Frames are scaled by nearest neighbour to keep their palettes & transparency intact.
+func ResizeGIF(data []byte, opts GIFOptions) ([]byte, error) {
+	if err := validateFormat(opts.Format); err != nil {
+		return nil, err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := fitDimensions(g.Config.Width, g.Config.Height, opts.Dimensions, opts.Enlarge)
+	resized := width != g.Config.Width || height != g.Config.Height
+	if !resized && !opts.Still && opts.Format != FormatWebP && len(opts.Pipeline) == 0 && opts.Watermark == nil {
+		return data, nil
+	}
+
+	if opts.Still {
+		g.Image, g.Delay, g.Disposal = g.Image[:1], g.Delay[:1], g.Disposal[:1]
+	}
+	if resized {
+		scaleGIF(g, width, height)
+	}
+
+	// Operations & watermark are applied to composed frames, so they don't depend on frame offsets & disposal
+	if opts.Format == FormatWebP || len(opts.Pipeline) > 0 || opts.Watermark != nil {
+		frames := composeGIF(g)
+		for i := range frames {
+			if frames[i].Image, err = opts.Pipeline.Apply(frames[i].Image); err != nil {
+				return nil, err
+			}
+		}
+		g.Config.Width, g.Config.Height = frames[0].Image.Bounds().Dx(), frames[0].Image.Bounds().Dy()
+
+		if opts.Watermark != nil {
+			for _, frame := range frames {
+				opts.Watermark(frame.Image)
+			}
+		}
+
+		if opts.Format == FormatWebP {
+			if opts.Still {
+				return EncodeWebP(frames[0].Image), nil
+			}
+			return EncodeAnimatedWebP(frames, webpLoopCount(g.LoopCount)), nil
+		}
+		quantizeGIF(g, frames)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fitDimensions returns size of image fitted into requested dimensions keeping aspect ratio.
+// Image isn't enlarged without `enlarge` option.
+func fitDimensions(width int, height int, dimensions []int, enlarge bool) (int, int) {
+	if len(dimensions) == 0 || width == 0 || height == 0 {
+		return width, height
+	}
+
+	scale := float64(dimensions[0]) / float64(width)
+	if len(dimensions) == 2 {
+		scale = math.Min(scale, float64(dimensions[1])/float64(height))
+	}
+	if scale >= 1 && !enlarge {
+		return width, height
+	}
+
+	return maxInt(1, int(math.Round(float64(width)*scale))), maxInt(1, int(math.Round(float64(height)*scale)))
+}
+
+// scaleGIF scales frames & their offsets to given canvas size
+func scaleGIF(g *gif.GIF, width int, height int) {
+	sx := float64(width) / float64(g.Config.Width)
+	sy := float64(height) / float64(g.Config.Height)
+
+	for i, frame := range g.Image {
+		src := frame.Bounds()
+		dst := image.Rect(
+			int(math.Round(float64(src.Min.X)*sx)), int(math.Round(float64(src.Min.Y)*sy)),
+			int(math.Round(float64(src.Max.X)*sx)), int(math.Round(float64(src.Max.Y)*sy)),
+		).Intersect(image.Rect(0, 0, width, height))
+
+		// Keep tiny frames visible
+		if dst.Dx() == 0 {
+			dst.Min.X, dst.Max.X = minInt(dst.Min.X, width-1), minInt(dst.Min.X, width-1)+1
+		}
+		if dst.Dy() == 0 {
+			dst.Min.Y, dst.Max.Y = minInt(dst.Min.Y, height-1), minInt(dst.Min.Y, height-1)+1
+		}
+
+		scaled := image.NewPaletted(dst, frame.Palette)
+		for y := dst.Min.Y; y < dst.Max.Y; y++ {
+			srcY := src.Min.Y + (2*(y-dst.Min.Y)+1)*src.Dy()/(2*dst.Dy())
+			for x := dst.Min.X; x < dst.Max.X; x++ {
+				srcX := src.Min.X + (2*(x-dst.Min.X)+1)*src.Dx()/(2*dst.Dx())
+				scaled.SetColorIndex(x, y, frame.ColorIndexAt(srcX, srcY))
+			}
+		}
+		g.Image[i] = scaled
+	}
+
+	g.Config.Width, g.Config.Height = width, height
+}
+
+// composeGIF renders frames on the whole canvas applying disposal methods
+func composeGIF(g *gif.GIF) []WebPFrame {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewNRGBA(bounds)
+	frames := make([]WebPFrame, 0, len(g.Image))
+
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, WebPFrame{Image: cloneNRGBA(canvas), Duration: g.Delay[i] * 10})
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames
+}
+
+// quantizeGIF replaces frames with composed ones.
+// Palette of each frame consists of its most frequent colors, so colors of previous frames are kept.
+func quantizeGIF(g *gif.GIF, frames []WebPFrame) {
+	for i, frame := range frames {
+		bounds := frame.Image.Bounds()
+		counts := map[color.NRGBA]int{}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				counts[opaqueOrTransparent(frame.Image.NRGBAAt(x, y))]++
+			}
+		}
+
+		colors := make([]color.NRGBA, 0, len(counts))
+		for c := range counts {
+			colors = append(colors, c)
+		}
+		sort.Slice(colors, func(a, b int) bool {
+			if counts[colors[a]] != counts[colors[b]] {
+				return counts[colors[a]] > counts[colors[b]]
+			}
+			return colorKey(colors[a]) < colorKey(colors[b])
+		})
+		if len(colors) > 256 {
+			colors = colors[:256]
+		}
+
+		palette := make(color.Palette, len(colors))
+		indexes := map[color.NRGBA]uint8{}
+		for j, c := range colors {
+			palette[j] = c
+			indexes[c] = uint8(j)
+		}
+
+		paletted := image.NewPaletted(bounds, palette)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := opaqueOrTransparent(frame.Image.NRGBAAt(x, y))
+				index, ok := indexes[c]
+				if !ok {
+					index = uint8(palette.Index(c))
+					indexes[c] = index
+				}
+				paletted.SetColorIndex(x, y, index)
+			}
+		}
+
+		g.Image[i] = paletted
+		g.Disposal[i] = gif.DisposalNone
+	}
+}
+
+// opaqueOrTransparent returns color as GIF can store it
+func opaqueOrTransparent(c color.NRGBA) color.NRGBA {
+	if c.A < 0x80 {
+		return color.NRGBA{}
+	}
+	c.A = 0xff
+	return c
+}
+
+func colorKey(c color.NRGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
+
+// webpLoopCount converts GIF loop count (number of repeats, -1 for none) into number of plays
+func webpLoopCount(gifLoopCount int) int {
+	switch {
+	case gifLoopCount == 0:
+		return 0
+	case gifLoopCount < 0:
+		return 1
+	}
+	return minInt(gifLoopCount+1, math.MaxUint16)
+}
+
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	clone := image.NewNRGBA(img.Bounds())
+	copy(clone.Pix, img.Pix)
+	return clone
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
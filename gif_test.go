@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testAnimatedGIF returns 40x20 animation: full background frame & two moving transparent frames
+func testAnimatedGIF() []byte {
+	pal := color.Palette{color.Transparent, color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}}
+	background := image.NewPaletted(image.Rect(0, 0, 40, 20), pal)
+	for i := range background.Pix {
+		background.Pix[i] = 2
+	}
+	frame := func(x int) *image.Paletted {
+		img := image.NewPaletted(image.Rect(x, 4, x+8, 12), pal)
+		for i := range img.Pix {
+			img.Pix[i] = 1
+		}
+		return img
+	}
+
+	buf := bytes.NewBuffer(nil)
+	gif.EncodeAll(buf, &gif.GIF{
+		Image:     []*image.Paletted{background, frame(0), frame(20)},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious},
+		LoopCount: 2,
+		Config:    image.Config{ColorModel: pal, Width: 40, Height: 20},
+	})
+	return buf.Bytes()
+}
+
+func TestResizeGIF(t *testing.T) {
+	data := testAnimatedGIF()
+
+	result, err := ResizeGIF(data, GIFOptions{Dimensions: []int{20}})
+	assert.Nil(t, err)
+	g, err := gif.DecodeAll(bytes.NewReader(result))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, g.Config.Width)
+	assert.Equal(t, 10, g.Config.Height)
+	assert.Equal(t, []int{10, 20, 30}, g.Delay)
+	assert.Equal(t, []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious}, g.Disposal)
+	assert.Equal(t, 2, g.LoopCount)
+	assert.Equal(t, image.Rect(10, 2, 14, 6), g.Image[2].Bounds())
+	assert.Equal(t, uint8(1), g.Image[2].ColorIndexAt(12, 4))
+
+	// Small image isn't enlarged
+	result, err = ResizeGIF(data, GIFOptions{Dimensions: []int{80, 40}})
+	assert.Nil(t, err)
+	assert.Equal(t, data, result)
+
+	// First frame only
+	result, err = ResizeGIF(data, GIFOptions{Still: true})
+	assert.Nil(t, err)
+	g, err = gif.DecodeAll(bytes.NewReader(result))
+	assert.Nil(t, err)
+	assert.Len(t, g.Image, 1)
+
+	// Unknown format
+	_, err = ResizeGIF(data, GIFOptions{Format: "bmp"})
+	assert.NotNil(t, err)
+}
+
+func TestResizeGIFToWebP(t *testing.T) {
+	result, err := ResizeGIF(testAnimatedGIF(), GIFOptions{Dimensions: []int{20}, Format: FormatWebP})
+	assert.Nil(t, err)
+	assert.Equal(t, "WEBP", string(result[8:12]))
+
+	chunks := webpChunks(result[12:])
+	assert.Len(t, chunks["ANMF"], 3)
+	assert.Equal(t, uint16(3), binary.LittleEndian.Uint16(chunks["ANIM"][0][4:]))
+	assert.Equal(t, byte(200), chunks["ANMF"][1][12])
+}
+
+func TestComposeGIF(t *testing.T) {
+	g, _ := gif.DecodeAll(bytes.NewReader(testAnimatedGIF()))
+	frames := composeGIF(g)
+	red := color.NRGBA{255, 0, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+
+	assert.Equal(t, blue, frames[0].Image.NRGBAAt(2, 6))
+	assert.Equal(t, red, frames[1].Image.NRGBAAt(2, 6))
+	// Second frame is disposed to background
+	assert.Equal(t, color.NRGBA{}, frames[2].Image.NRGBAAt(2, 6))
+	assert.Equal(t, red, frames[2].Image.NRGBAAt(22, 6))
+}
+
+func TestFitDimensions(t *testing.T) {
+	cases := []struct {
+		dimensions []int
+		enlarge    bool
+		width      int
+		height     int
+	}{
+		{nil, false, 400, 200},
+		{[]int{100}, false, 100, 50},
+		{[]int{100, 100}, false, 100, 50},
+		{[]int{400, 50}, false, 100, 50},
+		{[]int{800}, false, 400, 200},
+		{[]int{800}, true, 800, 400},
+	}
+
+	for _, c := range cases {
+		width, height := fitDimensions(400, 200, c.dimensions, c.enlarge)
+		assert.Equal(t, c.width, width, c.dimensions)
+		assert.Equal(t, c.height, height, c.dimensions)
+	}
+}
+
+func TestResizeGIFLimits(t *testing.T) {
+	// Oversized GIF target is rejected before frames are allocated
+	appCtx := &AppContext{Config: &Config{}, Options: &Options{Enlarge: true}, Dimensions: []int{60000}}
+	_, err := ResizeImage(context.Background(), appCtx, bytes.NewReader(testAnimatedGIF()), MIMEImageGIF)
+	assert.NotNil(t, err)
+
+	appCtx = &AppContext{Config: &Config{ResizeOnDownload: true}, Buckets: loadTestBucketsConfig(t)}
+	appCtx.Buckets.Buckets["docs"].Public = true
+	rr := httptest.NewRecorder()
+	InitRouter(appCtx).ServeHTTP(rr, httptest.NewRequest("GET", "/docs/a.gif?resize=60000&enlarge=true", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "abnormal")
+}
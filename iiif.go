@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// IIIF Image API 3.0 constants
+const (
+	IIIFPrefix   = "/iiif/3/"
+	IIIFContext  = "http://iiif.io/api/image/3/context.json"
+	IIIFProtocol = "http://iiif.io/api/image"
+	IIIFLevel0   = "level0"
+	IIIFLevel2   = "level2"
+
+	MIMEApplicationLDJSON = `application/ld+json;profile="` + IIIFContext + `"`
+)
+
+// IIIF routes, identifier is "{bucket}:{object}" with URL-encoded slashes in object
+const (
+	iiifIdentifierRoute = IIIFPrefix + "{bucket:[^/:]+}:{object:.+}"
+	iiifInfoRoute       = iiifIdentifierRoute + "/info.json"
+	iiifImageRoute      = iiifIdentifierRoute + "/{region}/{size}/{rotation}/{quality}.{format}"
+)
+
+// ErrIIIFNotImplemented is returned for valid IIIF requests with unsupported features
+var ErrIIIFNotImplemented = errors.New("Feature isn't implemented")
+
+// IIIF formats & qualities supported besides level 2 ones
+var (
+	iiifFormats = map[string]string{
+		"jpg":  MIMEImageJPEG,
+		"png":  MIMEImagePNG,
+		"webp": MIMEImageWebP,
+	}
+	iiifExtraFormats   = []string{"webp"}
+	iiifExtraQualities = []string{"color", "gray"}
+	iiifExtraFeatures  = []string{"sizeUpscaling"}
+)
+
+// IIIFRequest represents parsed IIIF image request.
+type IIIFRequest struct {
+	Region     string     // full, square, px or pct
+	RegionXYWH [4]float64 // For px & pct regions
+	Size       string     // max, w, h, wh, confined or pct
+	Width      int
+	Height     int
+	Percent    float64
+	Upscale    bool
+	Rotation   int
+	Gray       bool
+	MIMEType   string
+}
+
+// ParseIIIFRequest parses region, size, rotation, quality & format of IIIF image request.
+// Unsupported features (arbitrary rotation, mirroring, bitonal quality & other formats) are reported by ErrIIIFNotImplemented.
+func ParseIIIFRequest(region string, size string, rotation string, quality string, format string) (*IIIFRequest, error) {
+	req := &IIIFRequest{}
+	if err := req.parseRegion(region); err != nil {
+		return nil, err
+	}
+	if err := req.parseSize(size); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(rotation, "!") {
+		return nil, fmt.Errorf("%w: mirroring", ErrIIIFNotImplemented)
+	}
+	angle, err := strconv.ParseFloat(rotation, 64)
+	if err != nil || angle < 0 || angle > 360 {
+		return nil, errors.New("Rotation must be within 0..360")
+	}
+	if math.Mod(angle, 90) != 0 {
+		return nil, fmt.Errorf("%w: arbitrary rotation", ErrIIIFNotImplemented)
+	}
+	req.Rotation = int(angle) % 360
+
+	switch quality {
+	case "default", "color":
+	case "gray":
+		req.Gray = true
+	case "bitonal":
+		return nil, fmt.Errorf("%w: bitonal quality", ErrIIIFNotImplemented)
+	default:
+		return nil, errors.New("Unknown quality " + quality)
+	}
+
+	var ok bool
+	if req.MIMEType, ok = iiifFormats[format]; !ok {
+		return nil, fmt.Errorf("%w: %s format", ErrIIIFNotImplemented, format)
+	}
+	return req, nil
+}
+
+func (req *IIIFRequest) parseRegion(region string) error {
+	if region == "full" || region == "square" {
+		req.Region = region
+		return nil
+	}
+
+	req.Region = "px"
+	if strings.HasPrefix(region, "pct:") {
+		req.Region, region = "pct", strings.TrimPrefix(region, "pct:")
+	}
+	parts := strings.Split(region, ",")
+	if len(parts) != 4 {
+		return errors.New("Region must be full, square, x,y,w,h or pct:x,y,w,h")
+	}
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || value < 0 || (req.Region == "px" && value != math.Trunc(value)) {
+			return errors.New("Region is invalid")
+		}
+		req.RegionXYWH[i] = value
+	}
+	if req.RegionXYWH[2] == 0 || req.RegionXYWH[3] == 0 {
+		return errors.New("Region width & height must be positive")
+	}
+	return nil
+}
+
+func (req *IIIFRequest) parseSize(size string) error {
+	if strings.HasPrefix(size, "^") {
+		req.Upscale, size = true, strings.TrimPrefix(size, "^")
+	}
+
+	switch {
+	case size == "max":
+		req.Size = "max"
+		return nil
+	case strings.HasPrefix(size, "pct:"):
+		percent, err := strconv.ParseFloat(strings.TrimPrefix(size, "pct:"), 64)
+		if err != nil || percent <= 0 || (percent > 100 && !req.Upscale) {
+			return errors.New("Size percent is invalid")
+		}
+		req.Size, req.Percent = "pct", percent
+		return nil
+	case strings.HasPrefix(size, "!"):
+		req.Size, size = "confined", strings.TrimPrefix(size, "!")
+	}
+
+	parts := strings.Split(size, ",")
+	if len(parts) != 2 || (parts[0] == "" && parts[1] == "") {
+		return errors.New("Size must be max, w,, ,h, w,h, !w,h or pct:n")
+	}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		value, err := strconv.Atoi(part)
+		if err != nil || value <= 0 {
+			return errors.New("Size width & height must be positive integers")
+		}
+		if i == 0 {
+			req.Width = value
+		} else {
+			req.Height = value
+		}
+	}
+
+	switch {
+	case req.Size == "confined" && (req.Width == 0 || req.Height == 0):
+		return errors.New("Confined size requires width & height")
+	case req.Size == "confined":
+	case req.Height == 0:
+		req.Size = "w"
+	case req.Width == 0:
+		req.Size = "h"
+	default:
+		req.Size = "wh"
+	}
+	return nil
+}
+
+// Pipeline returns operations of request for image of given size.
+// Identity request results in empty pipeline.
+func (req *IIIFRequest) Pipeline(width int, height int) (Pipeline, error) {
+	var pipeline Pipeline
+
+	rect, err := req.regionRect(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if rect.Dx() != width || rect.Dy() != height {
+		pipeline = append(pipeline, &CropOp{rect})
+	}
+
+	scaledWidth, scaledHeight, err := req.scaledSize(rect.Dx(), rect.Dy())
+	if err != nil {
+		return nil, err
+	}
+	if scaledWidth != rect.Dx() || scaledHeight != rect.Dy() {
+		pipeline = append(pipeline, &ScaleOp{scaledWidth, scaledHeight})
+	}
+
+	if req.Rotation != 0 {
+		pipeline = append(pipeline, &RotateOp{req.Rotation})
+	}
+	if req.Gray {
+		pipeline = append(pipeline, &GrayscaleOp{})
+	}
+	return pipeline, nil
+}
+
+// regionRect returns region within image bounds
+func (req *IIIFRequest) regionRect(width int, height int) (image.Rectangle, error) {
+	xywh := req.RegionXYWH
+	switch req.Region {
+	case "full":
+		return image.Rect(0, 0, width, height), nil
+	case "square":
+		side := minInt(width, height)
+		return image.Rect(0, 0, side, side).Add(image.Pt((width-side)/2, (height-side)/2)), nil
+	case "pct":
+		xywh = [4]float64{xywh[0] * float64(width) / 100, xywh[1] * float64(height) / 100, xywh[2] * float64(width) / 100, xywh[3] * float64(height) / 100}
+	}
+
+	x, y := int(math.Round(xywh[0])), int(math.Round(xywh[1]))
+	rect := image.Rect(x, y, x+maxInt(1, int(math.Round(xywh[2]))), y+maxInt(1, int(math.Round(xywh[3]))))
+	rect = rect.Intersect(image.Rect(0, 0, width, height))
+	if rect.Empty() {
+		return rect, errors.New("Region is out of image")
+	}
+	return rect, nil
+}
+
+// scaledSize returns size of scaled region, it's limited by MaxResizeSize
+func (req *IIIFRequest) scaledSize(width int, height int) (int, int, error) {
+	scaled := func(value int, scale float64) int {
+		return maxInt(1, int(math.Round(float64(value)*scale)))
+	}
+
+	var scaledWidth, scaledHeight int
+	switch req.Size {
+	case "max":
+		scaledWidth, scaledHeight = fitDimensions(width, height, []int{MaxResizeSize, MaxResizeSize}, req.Upscale)
+		return scaledWidth, scaledHeight, nil
+	case "pct":
+		scaledWidth, scaledHeight = scaled(width, req.Percent/100), scaled(height, req.Percent/100)
+	case "w":
+		scaledWidth, scaledHeight = req.Width, scaled(height, float64(req.Width)/float64(width))
+	case "h":
+		scaledWidth, scaledHeight = scaled(width, float64(req.Height)/float64(height)), req.Height
+	case "wh":
+		scaledWidth, scaledHeight = req.Width, req.Height
+	case "confined":
+		scale := math.Min(float64(req.Width)/float64(width), float64(req.Height)/float64(height))
+		scaledWidth, scaledHeight = scaled(width, scale), scaled(height, scale)
+	}
+
+	if !req.Upscale && (scaledWidth > width || scaledHeight > height) {
+		return 0, 0, errors.New("Size exceeds region, use ^ to upscale")
+	}
+	if err := validateMaxDimensions([]int{scaledWidth, scaledHeight}); err != nil {
+		return 0, 0, err
+	}
+	return scaledWidth, scaledHeight, nil
+}
+
+// IIIFInfo represents IIIF image information (info.json).
+type IIIFInfo struct {
+	Context        string   `json:"@context"`
+	ID             string   `json:"id"`
+	Type           string   `json:"type"`
+	Protocol       string   `json:"protocol"`
+	Profile        string   `json:"profile"`
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	MaxWidth       int      `json:"maxWidth"`
+	MaxHeight      int      `json:"maxHeight"`
+	ExtraFormats   []string `json:"extraFormats,omitempty"`
+	ExtraQualities []string `json:"extraQualities,omitempty"`
+	ExtraFeatures  []string `json:"extraFeatures,omitempty"`
+}
+
+// NewIIIFInfo returns image information, images of buckets without transforms are served at level 0.
+func NewIIIFInfo(id string, width int, height int, transforms bool) *IIIFInfo {
+	info := &IIIFInfo{
+		Context:   IIIFContext,
+		ID:        id,
+		Type:      "ImageService3",
+		Protocol:  IIIFProtocol,
+		Profile:   IIIFLevel0,
+		Width:     width,
+		Height:    height,
+		MaxWidth:  MaxResizeSize,
+		MaxHeight: MaxResizeSize,
+	}
+	if transforms {
+		info.Profile = IIIFLevel2
+		info.ExtraFormats, info.ExtraQualities, info.ExtraFeatures = iiifExtraFormats, iiifExtraQualities, iiifExtraFeatures
+	}
+	return info
+}
+
+// allowsIIIFTransforms reports whether bucket allows arbitrary transforms
+func allowsIIIFTransforms(policy *BucketPolicy) bool {
+	return *policy.ResizeOnDownload && (len(policy.Presets) == 0 || len(policy.Operations) > 0)
+}
+
+// iiifID returns base URI of image service
+func iiifID(r *http.Request, ctx *AppContext) string {
+	vars := mux.Vars(r)
+	return publicURL(r, ctx) + IIIFPrefix + vars["bucket"] + ":" + url.PathEscape(vars["object"])
+}
+
+// getIIIFObject reads object of IIIF request from storage & checks its type & dimensions
+func getIIIFObject(r *http.Request, ctx *AppContext) ([]byte, string, error) {
+	vars := mux.Vars(r)
+	bucketName, objName := vars["bucket"], "/"+vars["object"]
+
+	_, span := startSpan(r.Context(), "storage.get", storageAttributes(bucketName, objName)...)
+	start := time.Now()
+	obj, err := ctx.Storage.GetObject(bucketName, objName, minio.GetObjectOptions{})
+	var data []byte
+	if err == nil {
+		// GOTCHA: Minio fetches object lazily, so reading is a part of storage operation
+		buf := bytes.NewBuffer(nil)
+		_, err = io.Copy(buf, obj)
+		data = buf.Bytes()
+	}
+	observeStorage(StorageOpGet, start, err)
+	endSpan(span, err)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fileType := detectContentType(r.Context(), data)
+	if fileType != MIMEImageJPEG && fileType != MIMEImageGIF && fileType != MIMEImagePNG {
+		return nil, "", errIIIFFileType
+	}
+	if err = CheckImageLimits(data, imageLimits(ctx.Config)); err != nil {
+		return nil, "", err
+	}
+	return data, fileType, nil
+}
+
+var errIIIFFileType = errors.New("File type isn't supported")
+
+// renderIIIFObjectError responds with error of getIIIFObject
+func renderIIIFObjectError(w http.ResponseWriter, err error) {
+	switch {
+	case err == errIIIFFileType:
+		renderJSONError(w, err, "INVALID_FILE_TYPE", http.StatusBadRequest)
+	case errors.Is(err, ErrImageTooLarge):
+		renderImageLimitsError(w, err)
+	default:
+		renderJSONError(w, err, "CANT_PROCESS_FILE_ON_STORAGE", http.StatusNotFound)
+	}
+}
+
+// IIIFInfoHandler is a wrapper to provide appContext to IIIF info handler.
+type IIIFInfoHandler struct {
+	ctx *AppContext
+}
+
+// IIIFInfoController responds with IIIF image information
+func (h *IIIFInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /iiif/3/{identifier}/info.json iiifInfo
+	// ---
+	// summary: IIIF image information
+	// description: IIIF Image API 3.0 image information. Identifier is "{bucket}:{object}" with URL-encoded slashes in object.
+	// produces:
+	//   - application/json
+	//   - application/ld+json
+	// parameters:
+	//   - in: path
+	//     name: identifier
+	//     type: string
+	//     required: true
+	//     description: Bucket & object names separated by colon.
+	// responses:
+	//   '200':
+	//     description: OK. Returns image information.
+	//   '400':
+	//     description: Bad request (INVALID_FILE_TYPE, IMAGE_TOO_LARGE).
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND, CANT_PROCESS_FILE_ON_STORAGE).
+	//   '500':
+	//     description: Internal error (CANT_READ_FILE).
+	var policy = BucketPolicyFromRequest(r)
+
+	data, fileType, err := getIIIFObject(r, h.ctx)
+	if err != nil {
+		renderIIIFObjectError(w, err)
+		return
+	}
+
+	// Report dimensions of auto-rotated image
+	data, err = NormalizeImage(data, fileType, NormalizeOptions{AutoRotate: true})
+	var config image.Config
+	if err == nil {
+		config, _, err = image.DecodeConfig(bytes.NewReader(data))
+	}
+	if err != nil {
+		renderJSONError(w, err, "CANT_READ_FILE", http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := json.Marshal(NewIIIFInfo(iiifID(r, h.ctx), config.Width, config.Height, allowsIIIFTransforms(policy)))
+	contentType := MIMEApplicationJSON
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		contentType = MIMEApplicationLDJSON
+	}
+	w.Header().Set("Content-Type", contentType)
+	if policy.CacheControl != "" {
+		w.Header().Set("Cache-Control", policy.CacheControl)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// IIIFImageHandler is a wrapper to provide appContext to IIIF image handler.
+type IIIFImageHandler struct {
+	ctx *AppContext
+}
+
+// IIIFImageController responds with IIIF image
+func (h *IIIFImageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /iiif/3/{identifier}/{region}/{size}/{rotation}/{quality}.{format} iiifImage
+	// ---
+	// summary: IIIF image
+	// description: IIIF Image API 3.0 image request, level 2 compliant. Transforms are applied due to bucket policy.
+	// produces:
+	//   - image/jpeg
+	//   - image/png
+	//   - image/webp
+	// parameters:
+	//   - in: path
+	//     name: identifier
+	//     type: string
+	//     required: true
+	//     description: Bucket & object names separated by colon.
+	//   - in: path
+	//     name: region
+	//     type: string
+	//     required: true
+	//     description: full, square, x,y,w,h or pct:x,y,w,h.
+	//   - in: path
+	//     name: size
+	//     type: string
+	//     required: true
+	//     description: max, w,, ,h, pct:n, w,h or !w,h, optionally prefixed by ^ to upscale.
+	//   - in: path
+	//     name: rotation
+	//     type: string
+	//     required: true
+	//     description: Multiple of 90 degrees clockwise.
+	//   - in: path
+	//     name: quality
+	//     type: string
+	//     required: true
+	//     enum: [default, color, gray]
+	//   - in: path
+	//     name: format
+	//     type: string
+	//     required: true
+	//     enum: [jpg, png, webp]
+	// responses:
+	//   '200':
+	//     description: OK. Returns transformed image.
+	//   '400':
+	//     description: Bad request (IIIF_REQUEST_IS_INVALID, RESIZE_NOT_ALLOWED, OPERATIONS_NOT_ALLOWED, WATERMARK_IS_INVALID, INVALID_FILE_TYPE, IMAGE_TOO_LARGE).
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND, CANT_PROCESS_FILE_ON_STORAGE).
+	//   '429':
+	//     description: Too many requests (RATE_LIMIT_EXCEEDED).
+	//   '500':
+	//     description: Internal error (CANT_READ_FILE, CANT_TRANSFORM_FILE, CANT_WATERMARK_FILE, CANT_RESPOND_FILE).
+	//   '501':
+	//     description: Not implemented (IIIF_FEATURE_IS_NOT_IMPLEMENTED).
+	var ctx = h.ctx.ForRequest(r)
+	var policy = BucketPolicyFromRequest(r)
+	var vars = mux.Vars(r)
+
+	req, err := ParseIIIFRequest(vars["region"], vars["size"], vars["rotation"], vars["quality"], vars["format"])
+	if err != nil {
+		renderIIIFRequestError(w, err)
+		return
+	}
+
+	// Mandatory watermark of bucket is applied to IIIF images too
+	ctx.Options, err = policy.ResolveOptions(ctx.Options, ctx.Presets())
+	if err != nil {
+		renderJSONError(w, err, "RESIZE_NOT_ALLOWED", http.StatusBadRequest)
+		return
+	}
+	ctx.Watermark, err = ctx.WatermarkByName(ctx.Options.Watermark)
+	if err != nil {
+		renderJSONError(w, err, "WATERMARK_IS_INVALID", http.StatusBadRequest)
+		return
+	}
+
+	data, fileType, err := getIIIFObject(r, ctx)
+	if err != nil {
+		renderIIIFObjectError(w, err)
+		return
+	}
+
+	img, err := decodeStill(data, fileType)
+	if err != nil {
+		renderJSONError(w, err, "CANT_READ_FILE", http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Pipeline, err = req.Pipeline(img.Bounds().Dx(), img.Bounds().Dy())
+	if err != nil {
+		renderIIIFRequestError(w, err)
+		return
+	}
+	if len(ctx.Pipeline) > 0 {
+		if !allowsIIIFTransforms(policy) {
+			renderJSONError(w, errors.New("Transforms aren't allowed in this bucket"), "RESIZE_NOT_ALLOWED", http.StatusBadRequest)
+			return
+		}
+		if err = policy.AllowsPipeline(ctx.Pipeline); err != nil {
+			renderJSONError(w, err, "OPERATIONS_NOT_ALLOWED", http.StatusBadRequest)
+			return
+		}
+		if allowed, wait := ctx.RateLimiter.Allow(r, RateClassTransform); !allowed {
+			renderRateLimited(w, wait)
+			return
+		}
+	}
+
+	_, span := startSpan(r.Context(), "iiif.transform", attribute.String("image.operations", ctx.Pipeline.String()))
+	start := time.Now()
+	img, err = ctx.Pipeline.Apply(img)
+	observeResize(ResizerNative, start, err != nil)
+	endSpan(span, err)
+	if err != nil {
+		renderJSONError(w, err, "CANT_TRANSFORM_FILE", http.StatusInternalServerError)
+		return
+	}
+
+	apply, err := watermarkFunc(ctx)
+	if err != nil {
+		renderJSONError(w, err, "CANT_WATERMARK_FILE", http.StatusInternalServerError)
+		return
+	}
+	if apply != nil {
+		apply(img)
+	}
+
+	result, err := encodeStill(img, req.MIMEType, ResizeJpegQuality)
+	if err != nil {
+		renderJSONError(w, err, "CANT_TRANSFORM_FILE", http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with data
+	w.Header().Set("Content-Type", req.MIMEType)
+	w.Header().Set("Link", `<`+IIIFProtocol+`/3/`+NewIIIFInfo("", 0, 0, allowsIIIFTransforms(policy)).Profile+`.json>;rel="profile"`)
+	if policy.CacheControl != "" {
+		w.Header().Set("Cache-Control", policy.CacheControl)
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(result); err != nil {
+		renderError(w, err, "CANT_RESPOND_FILE", http.StatusInternalServerError)
+		return
+	}
+}
+
+// renderIIIFRequestError responds with 501 for unsupported features & 400 for invalid requests
+func renderIIIFRequestError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrIIIFNotImplemented) {
+		renderJSONError(w, err, "IIIF_FEATURE_IS_NOT_IMPLEMENTED", http.StatusNotImplemented)
+		return
+	}
+	renderJSONError(w, err, "IIIF_REQUEST_IS_INVALID", http.StatusBadRequest)
+}
+
+// IIIFRedirectController redirects base URI of image to its information
+func IIIFRedirectController(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, r.URL.EscapedPath()+"/info.json", http.StatusSeeOther)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// Example requests of IIIF Image API 3.0 spec for 300x200 image
+func TestParseIIIFRequest(t *testing.T) {
+	cases := []struct {
+		region   string
+		size     string
+		rotation string
+		quality  string
+		format   string
+		pipeline string
+		err      error
+	}{
+		// Region
+		{"full", "max", "0", "default", "jpg", "", nil},
+		{"square", "max", "0", "default", "jpg", "crop:50,0,200,200", nil},
+		{"125,15,120,140", "max", "0", "default", "jpg", "crop:125,15,120,140", nil},
+		{"pct:41.6,7.5,40,70", "max", "0", "default", "jpg", "crop:125,15,120,140", nil},
+		{"125,15,200,200", "max", "0", "default", "jpg", "crop:125,15,175,185", nil},
+		{"pct:41.6,7.5,66.6,100", "max", "0", "default", "jpg", "crop:125,15,175,185", nil},
+		{"300,200,10,10", "max", "0", "default", "jpg", "", errors.New("out of image")},
+		{"0,0,0,10", "max", "0", "default", "jpg", "", errors.New("invalid")},
+		{"0,0,10", "max", "0", "default", "jpg", "", errors.New("invalid")},
+		{"0.5,0,10,10", "max", "0", "default", "jpg", "", errors.New("invalid")},
+		// Size
+		{"full", "150,", "0", "default", "jpg", "resize:150x100:exact", nil},
+		{"full", ",150", "0", "default", "jpg", "resize:225x150:exact", nil},
+		{"full", ",250", "0", "default", "jpg", "", errors.New("upscale")},
+		{"full", ",100", "0", "default", "jpg", "resize:150x100:exact", nil},
+		{"full", "pct:50", "0", "default", "jpg", "resize:150x100:exact", nil},
+		{"full", "225,100", "0", "default", "jpg", "resize:225x100:exact", nil},
+		{"full", "!225,100", "0", "default", "jpg", "resize:150x100:exact", nil},
+		{"full", "^max", "0", "default", "jpg", "resize:3000x2000:exact", nil},
+		{"full", "^360,", "0", "default", "jpg", "resize:360x240:exact", nil},
+		{"full", "^,240", "0", "default", "jpg", "resize:360x240:exact", nil},
+		{"full", "^pct:120", "0", "default", "jpg", "resize:360x240:exact", nil},
+		{"full", "^360,360", "0", "default", "jpg", "resize:360x360:exact", nil},
+		{"full", "^!360,360", "0", "default", "jpg", "resize:360x240:exact", nil},
+		{"full", "360,", "0", "default", "jpg", "", errors.New("upscale")},
+		{"full", "pct:120", "0", "default", "jpg", "", errors.New("invalid")},
+		{"full", "^4000,", "0", "default", "jpg", "", errors.New("abnormal")},
+		{"full", "!225,", "0", "default", "jpg", "", errors.New("invalid")},
+		{"full", ",", "0", "default", "jpg", "", errors.New("invalid")},
+		{"full", "0,", "0", "default", "jpg", "", errors.New("invalid")},
+		{"full", "full", "0", "default", "jpg", "", errors.New("invalid")},
+		// Rotation
+		{"full", "max", "90", "default", "jpg", "rotate:90", nil},
+		{"full", "max", "180", "default", "jpg", "rotate:180", nil},
+		{"full", "max", "360", "default", "jpg", "", nil},
+		{"full", "max", "22.5", "default", "jpg", "", ErrIIIFNotImplemented},
+		{"full", "max", "!0", "default", "jpg", "", ErrIIIFNotImplemented},
+		{"full", "max", "-90", "default", "jpg", "", errors.New("invalid")},
+		// Quality & format
+		{"full", "max", "0", "color", "png", "", nil},
+		{"full", "max", "0", "gray", "webp", "grayscale", nil},
+		{"full", "max", "0", "bitonal", "jpg", "", ErrIIIFNotImplemented},
+		{"full", "max", "0", "sepia", "jpg", "", errors.New("invalid")},
+		{"full", "max", "0", "default", "tif", "", ErrIIIFNotImplemented},
+		// Canonical order
+		{"square", "100,", "90", "gray", "jpg", "crop:50,0,200,200|resize:100x100:exact|rotate:90|grayscale", nil},
+	}
+
+	for _, c := range cases {
+		req, err := ParseIIIFRequest(c.region, c.size, c.rotation, c.quality, c.format)
+		var pipeline Pipeline
+		if err == nil {
+			pipeline, err = req.Pipeline(300, 200)
+		}
+
+		name := c.region + "/" + c.size + "/" + c.rotation + "/" + c.quality + "." + c.format
+		if c.err == nil {
+			assert.Nil(t, err, name)
+			assert.Equal(t, c.pipeline, pipeline.String(), name)
+			continue
+		}
+		if assert.NotNil(t, err, name) {
+			assert.Equal(t, c.err == ErrIIIFNotImplemented, errors.Is(err, ErrIIIFNotImplemented), name)
+		}
+	}
+}
+
+func TestIIIFPipelineApply(t *testing.T) {
+	req, err := ParseIIIFRequest("pct:50,0,50,100", "^!60,60", "90", "gray", "png")
+	assert.Nil(t, err)
+	pipeline, err := req.Pipeline(40, 20)
+	assert.Nil(t, err)
+
+	img, err := pipeline.Apply(testQuadrants())
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(60, 60), img.Bounds().Size())
+	c := img.NRGBAAt(30, 30)
+	assert.True(t, c.R == c.G && c.G == c.B)
+}
+
+func TestNewIIIFInfo(t *testing.T) {
+	body, err := json.Marshal(NewIIIFInfo("https://example.org/iiif/3/scans:a%2Fb.jpg", 300, 200, true))
+	assert.Nil(t, err)
+
+	info := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(body, &info))
+	assert.Equal(t, IIIFContext, info["@context"])
+	assert.Equal(t, "https://example.org/iiif/3/scans:a%2Fb.jpg", info["id"])
+	assert.Equal(t, "ImageService3", info["type"])
+	assert.Equal(t, IIIFProtocol, info["protocol"])
+	assert.Equal(t, IIIFLevel2, info["profile"])
+	assert.Equal(t, 300.0, info["width"])
+	assert.Equal(t, 200.0, info["height"])
+	assert.Equal(t, []interface{}{"webp"}, info["extraFormats"])
+
+	info = map[string]interface{}{}
+	body, _ = json.Marshal(NewIIIFInfo("https://example.org/iiif/3/scans:a.jpg", 300, 200, false))
+	assert.Nil(t, json.Unmarshal(body, &info))
+	assert.Equal(t, IIIFLevel0, info["profile"])
+	assert.Nil(t, info["extraFeatures"])
+}
+
+func TestIIIFRoutes(t *testing.T) {
+	cases := []struct {
+		url   string
+		route string
+		vars  map[string]string
+	}{
+		{"/iiif/3/scans:a.jpg/info.json", "iiif.info", map[string]string{"bucket": "scans", "object": "a.jpg"}},
+		{"/iiif/3/scans:dir%2Fa.jpg/info.json", "iiif.info", map[string]string{"bucket": "scans", "object": "dir/a.jpg"}},
+		{"/iiif/3/scans:dir%2Fa.jpg/pct:41.6,7.5,40,70/!225,100/90/gray.png", "iiif.image", map[string]string{
+			"bucket": "scans", "object": "dir/a.jpg", "region": "pct:41.6,7.5,40,70", "size": "!225,100", "rotation": "90", "quality": "gray", "format": "png",
+		}},
+		{"/iiif/3/scans:a.jpg", "iiif.base", map[string]string{"bucket": "scans", "object": "a.jpg"}},
+		{"/scans/a.jpg", "download", map[string]string{"bucket": "scans"}},
+	}
+
+	for _, c := range cases {
+		var route string
+		var vars map[string]string
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			route, vars = routeName(r), mux.Vars(r)
+		}
+		router := mux.NewRouter()
+		router.HandleFunc(iiifInfoRoute, handler).Methods("GET").Name("iiif.info")
+		router.HandleFunc(iiifImageRoute, handler).Methods("GET").Name("iiif.image")
+		router.HandleFunc(iiifIdentifierRoute, handler).Methods("GET").Name("iiif.base")
+		router.PathPrefix("/{bucket}/").HandlerFunc(handler).Methods("GET").Name("download")
+
+		req, err := http.NewRequest("GET", c.url, nil)
+		assert.Nil(t, err)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, c.route, route, c.url)
+		assert.Equal(t, c.vars, vars, c.url)
+	}
+}
+
+func TestIIIFRedirectController(t *testing.T) {
+	req, err := http.NewRequest("GET", "/iiif/3/scans:dir%2Fa.jpg", nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	IIIFRedirectController(rr, req)
+
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	assert.Equal(t, "/iiif/3/scans:dir%2Fa.jpg/info.json", rr.Header().Get("Location"))
+}
+
+func TestIIIFImageOptionsErrors(t *testing.T) {
+	appCtx := &AppContext{Config: &Config{IIIFEnabled: true, ResizeOnDownload: true}, Buckets: loadTestBucketsConfig(t)}
+	router := InitRouter(appCtx)
+
+	cases := []struct {
+		query string
+		code  string
+	}{
+		{"preset=unknown", "RESIZE_NOT_ALLOWED"},
+		{"watermark=unknown", "WATERMARK_IS_INVALID"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/iiif/3/docs:a.jpg/full/max/0/default.jpg?"+c.query, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, c.query)
+		er := ErrorResponse{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &er))
+		assert.Equal(t, c.code, er.Error, c.query)
+	}
+}
+
+func TestIIIFSignedQuery(t *testing.T) {
+	appCtx := &AppContext{Config: &Config{IIIFEnabled: true, URLSignatureQuery: true}, Buckets: loadTestBucketsConfig(t), URLSigner: testURLSigner(t)}
+	appCtx.Buckets.Buckets["docs"].Public = true
+
+	// IIIF URLs can't be signed, so they aren't routed
+	rr := httptest.NewRecorder()
+	InitRouter(appCtx).ServeHTTP(rr, httptest.NewRequest("GET", "/iiif/3/docs:a.jpg/full/max/0/default.jpg?watermark=unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
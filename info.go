@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go"
+)
+
+// InfoSuffix is a suffix of object path to get its information
+const InfoSuffix = "/info"
+
+// InfoResponse represents information of stored image
+// swagger:model infoResponse
+type InfoResponse struct {
+	File         string       `json:"file"`
+	Size         int64        `json:"size"`
+	ContentType  string       `json:"contentType"`
+	LastModified time.Time    `json:"lastModified"`
+	Placeholder  *Placeholder `json:"placeholder,omitempty"`
+	Hashes       *ImageHashes `json:"hashes,omitempty"`
+}
+
+// InfoHandler is a wrapper to provide appContext to info handler.
+type InfoHandler struct {
+	ctx *AppContext
+}
+
+// InfoController responds with information of stored image
+func (h *InfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /{bucket}/{object}/info info
+	// ---
+	// summary: Info
+	// description: Get information of stored image with placeholders & perceptual hashes computed on upload.
+	// produces:
+	//   - application/json
+	// parameters:
+	//   - in: path
+	//     name: bucket
+	//     type: string
+	//     required: true
+	//     description: Bucket name in storage.
+	//   - in: path
+	//     name: object
+	//     type: string
+	//     required: true
+	//     description: Object name in storage.
+	// responses:
+	//   '200':
+	//     description: OK. Returns image information.
+	//     schema:
+	//       $ref: '#/definitions/infoResponse'
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND, CANT_PROCESS_FILE_ON_STORAGE).
+	vars := mux.Vars(r)
+	bucketName, objName := vars["bucket"], "/"+vars["object"]
+
+	_, span := startSpan(r.Context(), "storage.stat", storageAttributes(bucketName, objName)...)
+	start := time.Now()
+	info, err := h.ctx.Storage.StatObject(bucketName, objName, minio.StatObjectOptions{})
+	observeStorage(StorageOpStat, start, err)
+	endSpan(span, err)
+	if err != nil {
+		renderJSONError(w, err, "CANT_PROCESS_FILE_ON_STORAGE", http.StatusNotFound)
+		return
+	}
+
+	body, _ := json.Marshal(InfoResponse{
+		File:         vars["object"],
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+		Placeholder:  PlaceholderFromMetadata(info.Metadata),
+		Hashes:       HashesFromMetadata(info.Metadata),
+	})
+	w.Header().Set("Content-Type", MIMEApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
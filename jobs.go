@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go"
+)
+
+// Job types
+const (
+	JobVariant = "variant" // Generate variant of uploaded image by preset & format
+	JobAnalyze = "analyze" // Compute placeholders & hashes of uploaded image
+)
+
+// Job statuses
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// VariantPrefix is an object prefix of variants generated in background
+const VariantPrefix = ".variants/"
+
+// jobRetryDelay is multiplied by attempts number to delay retry of failed job
+const jobRetryDelay = time.Second
+
+// Job represents background processing of uploaded image.
+// swagger:model job
+type Job struct {
+	ID       string                 `json:"id"`
+	Type     string                 `json:"type"`
+	Bucket   string                 `json:"bucket"`
+	File     string                 `json:"file"`
+	Variant  *Variant               `json:"variant,omitempty"`
+	Status   string                 `json:"status"`
+	Attempts int                    `json:"attempts"`
+	Error    string                 `json:"error,omitempty"`
+	Result   map[string]interface{} `json:"result,omitempty"`
+	Created  time.Time              `json:"created"`
+	Updated  time.Time              `json:"updated"`
+}
+
+// JobRunner processes job & returns its result.
+type JobRunner func(ctx context.Context, job *Job) (map[string]interface{}, error)
+
+// JobQueue runs jobs by bounded number of workers with retries.
+// Jobs are persisted as files of directory to survive restarts, they're kept in memory only without it.
+// Finished jobs are kept for status queries till retention period expires.
+type JobQueue struct {
+	dir         string
+	run         JobRunner
+	timeout     time.Duration
+	maxAttempts int
+	retention   time.Duration
+	retryDelay  time.Duration
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	pending []string
+	wake    chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewJobQueue returns queue with jobs restored from directory, interrupted jobs are queued again.
+func NewJobQueue(dir string, run JobRunner, timeout time.Duration, maxAttempts int, retention time.Duration) (*JobQueue, error) {
+	q := &JobQueue{
+		dir:         dir,
+		run:         run,
+		timeout:     timeout,
+		maxAttempts: maxAttempts,
+		retention:   retention,
+		retryDelay:  jobRetryDelay,
+		jobs:        map[string]*Job{},
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	if dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		job := &Job{}
+		if err = json.Unmarshal(data, job); err != nil {
+			return nil, fmt.Errorf("Job %s is malformed: %w", file, err)
+		}
+		q.jobs[job.ID] = job
+	}
+
+	// Restored jobs are queued in order of creation
+	restored := make([]*Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		if job.Status == JobQueued || job.Status == JobRunning {
+			job.Status = JobQueued
+			restored = append(restored, job)
+		}
+	}
+	sort.Slice(restored, func(i, j int) bool { return restored[i].Created.Before(restored[j].Created) })
+	for _, job := range restored {
+		q.pending = append(q.pending, job.ID)
+	}
+	return q, nil
+}
+
+// Enqueue persists & queues job of given type for uploaded file & returns its copy.
+func (q *JobQueue) Enqueue(jobType string, bucket string, file string, variant *Variant) (*Job, error) {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:      generateID().String(),
+		Type:    jobType,
+		Bucket:  bucket,
+		File:    file,
+		Variant: variant,
+		Status:  JobQueued,
+		Created: now,
+		Updated: now,
+	}
+	if err := q.persist(job); err != nil {
+		return nil, err
+	}
+
+	// Queued job is returned as copy, it's updated by workers
+	queued := *job
+	q.mu.Lock()
+	q.jobs[job.ID] = job
+	q.pending = append(q.pending, job.ID)
+	q.mu.Unlock()
+	observeJob(jobType, JobQueued)
+
+	q.notify()
+	return &queued, nil
+}
+
+// Get returns copy of job by ID.
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Pending returns number of queued jobs.
+func (q *JobQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Start starts processing jobs by given number of workers, so concurrency toward resizer is bounded by it.
+func (q *JobQueue) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	if q.retention > 0 {
+		q.wg.Add(1)
+		go q.expire()
+	}
+}
+
+// Close stops workers & waits for running jobs, queued ones stay persisted.
+func (q *JobQueue) Close() {
+	close(q.stop)
+	q.wg.Wait()
+}
+
+// notify wakes one of workers up
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work runs queued jobs till queue is closed
+func (q *JobQueue) work() {
+	defer q.wg.Done()
+	for {
+		job := q.next()
+		if job == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.stop:
+				return
+			}
+		}
+		q.process(job)
+
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+	}
+}
+
+// next marks the first queued job as running & returns its copy or nil if queue is empty
+func (q *JobQueue) next() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.pending) > 0 {
+		job, ok := q.jobs[q.pending[0]]
+		q.pending = q.pending[1:]
+		if !ok || job.Status != JobQueued {
+			continue
+		}
+		// Other workers are woken up for the rest of jobs
+		if len(q.pending) > 0 {
+			q.notify()
+		}
+		job.Status = JobRunning
+		job.Attempts++
+		job.Updated = time.Now().UTC()
+		running := *job
+		return &running
+	}
+	return nil
+}
+
+// process runs job with timeout & records its result
+func (q *JobQueue) process(job *Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+	start := time.Now()
+	result, err := q.run(ctx, job)
+	cancel()
+	jobDuration.WithLabelValues(job.Type).Observe(time.Since(start).Seconds())
+
+	q.mu.Lock()
+	stored, ok := q.jobs[job.ID]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	stored.Updated = time.Now().UTC()
+	retry := false
+	switch {
+	case err == nil:
+		stored.Status, stored.Result, stored.Error = JobDone, result, ""
+	case stored.Attempts < q.maxAttempts:
+		stored.Status, stored.Error, retry = JobQueued, err.Error(), true
+	default:
+		stored.Status, stored.Error = JobFailed, err.Error()
+		log.Printf("JOB_FAILED %s %s of %s/%s after %d attempts: %v\n", stored.ID, stored.Type, stored.Bucket, stored.File, stored.Attempts, err)
+	}
+	persisted := *stored
+	q.mu.Unlock()
+
+	observeJob(job.Type, persisted.Status)
+	if err := q.persist(&persisted); err != nil {
+		log.Println("CANT_PERSIST_JOB", err)
+	}
+	if retry {
+		time.AfterFunc(time.Duration(persisted.Attempts)*q.retryDelay, func() { q.requeue(job.ID) })
+	}
+}
+
+// requeue queues job delayed for retry
+func (q *JobQueue) requeue(id string) {
+	q.mu.Lock()
+	q.pending = append(q.pending, id)
+	q.mu.Unlock()
+	q.notify()
+}
+
+// expire removes finished jobs older than retention period
+func (q *JobQueue) expire() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.retention / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.removeExpired(time.Now().Add(-q.retention))
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// removeExpired removes jobs finished before given time
+func (q *JobQueue) removeExpired(before time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, job := range q.jobs {
+		if (job.Status == JobDone || job.Status == JobFailed) && job.Updated.Before(before) {
+			delete(q.jobs, id)
+			if q.dir == "" {
+				continue
+			}
+			if err := os.Remove(q.path(job)); err != nil {
+				log.Println("CANT_REMOVE_JOB", err)
+			}
+		}
+	}
+}
+
+// persist writes job to directory atomically
+func (q *JobQueue) persist(job *Job) error {
+	if q.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(job) + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(job))
+}
+
+func (q *JobQueue) path(job *Job) string {
+	return filepath.Join(q.dir, job.ID+".json")
+}
+
+// initJobQueue returns job queue due to config or nil if no bucket has background processing
+func initJobQueue(ctx *AppContext) (*JobQueue, error) {
+	if ctx.Buckets == nil {
+		return nil, nil
+	}
+	configured := false
+	for _, policy := range ctx.Buckets.Buckets {
+		configured = configured || len(policy.Variants) > 0 || policy.AsyncAnalysis
+	}
+	if !configured {
+		return nil, nil
+	}
+
+	cfg := ctx.Config
+	queue, err := NewJobQueue(cfg.JobQueueDir, ctx.runJob, cfg.JobTimeout, cfg.JobMaxAttempts, cfg.JobRetention)
+	if err != nil {
+		return nil, err
+	}
+	queue.Start(cfg.JobWorkers)
+	return queue, nil
+}
+
+// enqueueJobs queues background processing of uploaded file due to bucket policy & returns job IDs
+func enqueueJobs(ctx *AppContext, bucketName string, file string, policy *BucketPolicy) []string {
+	if ctx.Jobs == nil {
+		return nil
+	}
+
+	var ids []string
+	enqueue := func(jobType string, variant *Variant) {
+		job, err := ctx.Jobs.Enqueue(jobType, bucketName, file, variant)
+		if err != nil {
+			log.Println("CANT_ENQUEUE_JOB", err)
+			return
+		}
+		ids = append(ids, job.ID)
+	}
+	if policy.AsyncAnalysis {
+		enqueue(JobAnalyze, nil)
+	}
+	for i := range policy.Variants {
+		enqueue(JobVariant, &policy.Variants[i])
+	}
+	return ids
+}
+
+// runJob processes job of uploaded image
+func (ctx *AppContext) runJob(reqCtx context.Context, job *Job) (map[string]interface{}, error) {
+	policy, ok := ctx.BucketPolicy(job.Bucket)
+	if !ok {
+		return nil, errors.New("Bucket isn't found")
+	}
+
+	// Object deleted after upload doesn't need processing
+	data, info, err := readObject(reqCtx, ctx, job.Bucket, job.File)
+	if objectChanged(err) {
+		return map[string]interface{}{"skipped": "Object is deleted"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch job.Type {
+	case JobAnalyze:
+		return ctx.analyzeObject(reqCtx, job, data, info)
+	case JobVariant:
+		return ctx.generateVariant(reqCtx, job, policy, data, info)
+	}
+	return nil, errors.New("Unknown job type " + job.Type)
+}
+
+// analyzeObject stores placeholders & hashes as object metadata & indexes object for similarity search
+func (ctx *AppContext) analyzeObject(reqCtx context.Context, job *Job, data []byte, info minio.ObjectInfo) (map[string]interface{}, error) {
+	analysis, err := analyzeImage(reqCtx, ctx.Config, data, info.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	// Metadata is replaced by server-side copy, so object deleted or overwritten meanwhile isn't restored
+	if analyzed := analysis.Metadata(); len(analyzed) > 0 {
+		metadata := userMetadata(info.Metadata)
+		for key, value := range analyzed {
+			metadata[key] = value
+		}
+		err = copyMetadata(reqCtx, ctx, job.Bucket, job.File, info, metadata)
+		if objectChanged(err) {
+			return map[string]interface{}{"skipped": "Object is deleted or overwritten"}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if analysis.Hashes != nil && ctx.SimilarityIndex != nil {
+		hash, _ := ParseHash(analysis.Hashes.PHash)
+		if err = ctx.SimilarityIndex.Add(job.Bucket, job.File, hash); err != nil {
+			log.Println("CANT_INDEX_IMAGE", err)
+		}
+	}
+	return map[string]interface{}{"placeholder": analysis.Placeholder, "hashes": analysis.Hashes}, nil
+}
+
+// generateVariant transforms object by variant preset & format & stores it under variant prefix
+func (ctx *AppContext) generateVariant(reqCtx context.Context, job *Job, policy *BucketPolicy, data []byte, info minio.ObjectInfo) (map[string]interface{}, error) {
+	if job.Variant == nil {
+		return nil, errors.New("Variant isn't specified")
+	}
+
+	// Variant is transformed the same way as download requested by its options
+	vctx := *ctx
+	opts := job.Variant.Options()
+	resolved, err := policy.ResolveOptions(&opts, ctx.Presets())
+	if err != nil {
+		return nil, err
+	}
+	vctx.Options = resolved
+	if vctx.Dimensions, err = PrepareDimensions(resolved.Resize); err != nil {
+		return nil, err
+	}
+	if vctx.Watermark, err = ctx.WatermarkByName(resolved.Watermark); err != nil {
+		return nil, err
+	}
+	vctx.Pipeline = nil
+
+	fileType := detectContentType(reqCtx, data)
+	result, err := ResizeImage(reqCtx, &vctx, bytes.NewReader(data), fileType)
+	if err != nil {
+		return nil, err
+	}
+	if len(vctx.Dimensions) > 0 && policy.Normalize.Enabled() {
+		if result, err = normalizeImage(reqCtx, result, fileType, policy.Normalize); err != nil {
+			return nil, err
+		}
+	}
+	if vctx.Watermark != nil && fileType != MIMEImageGIF {
+		if result, err = watermarkImage(reqCtx, &vctx, result, fileType); err != nil {
+			return nil, err
+		}
+	}
+	variant, err := ioutil.ReadAll(result)
+	if err != nil {
+		return nil, err
+	}
+
+	objName := job.Variant.ObjectName(job.File)
+	contentType := ResultType(fileType, resolved)
+	if err = writeObject(reqCtx, ctx, job.Bucket, objName, variant, contentType, nil); err != nil {
+		return nil, err
+	}
+
+	emitEvent(ctx, EventVariantGenerated, job.Bucket, job.File, map[string]interface{}{
+		"variant":     job.Variant.Name(),
+		"object":      objName,
+		"contentType": contentType,
+	})
+	return map[string]interface{}{"object": objName, "contentType": contentType, "size": len(variant)}, nil
+}
+
+// readObject returns object data & info
+func readObject(reqCtx context.Context, ctx *AppContext, bucketName string, objName string) ([]byte, minio.ObjectInfo, error) {
+	_, span := startSpan(reqCtx, "storage.get", storageAttributes(bucketName, objName)...)
+	start := time.Now()
+	obj, err := ctx.Storage.GetObject(bucketName, objName, minio.GetObjectOptions{})
+	var info minio.ObjectInfo
+	var data []byte
+	if err == nil {
+		defer obj.Close()
+		if info, err = obj.Stat(); err == nil {
+			data, err = ioutil.ReadAll(obj)
+		}
+	}
+	observeStorage(StorageOpGet, start, err)
+	endSpan(span, err)
+	return data, info, err
+}
+
+// copyMetadata replaces user metadata of object by server-side copy if object isn't changed since it was read
+func copyMetadata(reqCtx context.Context, ctx *AppContext, bucketName string, objName string, info minio.ObjectInfo, metadata map[string]string) error {
+	_, span := startSpan(reqCtx, "storage.copy", storageAttributes(bucketName, objName)...)
+	start := time.Now()
+	src := minio.NewSourceInfo(bucketName, objName, nil)
+	err := src.SetMatchETagCond(info.ETag)
+	if err == nil {
+		// Content type is replaced with metadata
+		src.Headers.Set("Content-Type", info.ContentType)
+		var dst minio.DestinationInfo
+		if dst, err = minio.NewDestinationInfo(bucketName, objName, nil, metadata); err == nil {
+			err = ctx.Storage.CopyObject(dst, src)
+		}
+	}
+	observeStorage(StorageOpCopy, start, err)
+	endSpan(span, err)
+	return err
+}
+
+// objectChanged reports whether storage operation failed because object is deleted or its ETag doesn't match
+func objectChanged(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "PreconditionFailed"
+}
+
+// writeObject puts object with content type & user metadata
+func writeObject(reqCtx context.Context, ctx *AppContext, bucketName string, objName string, data []byte, contentType string, metadata map[string]string) error {
+	_, span := startSpan(reqCtx, "storage.put", storageAttributes(bucketName, objName)...)
+	start := time.Now()
+	_, err := ctx.Storage.PutObject(bucketName, objName, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: metadata,
+	})
+	observeStorage(StorageOpPut, start, err)
+	endSpan(span, err)
+	if err == nil {
+		ctx.invalidateCache(bucketName, objName)
+	}
+	return err
+}
+
+// userMetadata returns user metadata of object without "X-Amz-Meta-" prefix
+func userMetadata(metadata http.Header) map[string]string {
+	result := map[string]string{}
+	for key := range metadata {
+		if strings.HasPrefix(key, "X-Amz-Meta-") {
+			result[strings.TrimPrefix(key, "X-Amz-Meta-")] = metadata.Get(key)
+		}
+	}
+	return result
+}
+
+// serveVariant responds with variant generated in background if request options match it exactly.
+// Reports false if there's no such variant yet, so image is transformed on-the-fly.
+func serveVariant(w http.ResponseWriter, r *http.Request, ctx *AppContext, policy *BucketPolicy, bucketName string, objName string, key string) bool {
+	variant, ok := policy.VariantFor(OptionsFromRequest(r))
+	if !ok {
+		return false
+	}
+
+	generation, endFetch := ctx.beginFetch(bucketName, objName)
+	defer endFetch()
+	data, info, err := readObject(r.Context(), ctx, bucketName, variant.ObjectName(objName))
+	if err != nil {
+		return false
+	}
+	ctx.cacheImage(bucketName, objName, key, generation, info.ContentType, data)
+	if policy.CacheControl != "" {
+		w.Header().Set("Cache-Control", policy.CacheControl)
+	}
+	w.Header().Set("Content-Type", info.ContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return true
+}
+
+// JobsHandler is a wrapper to provide appContext to jobs handler.
+type JobsHandler struct {
+	ctx *AppContext
+}
+
+// JobsController responds with status of background job
+func (h *JobsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /jobs/{id} jobs
+	// ---
+	// summary: Job
+	// description: Get status of background processing of uploaded image, job IDs are returned on upload.
+	// produces:
+	//   - application/json
+	// parameters:
+	//   - in: path
+	//     name: id
+	//     type: string
+	//     required: true
+	//     description: Job ID.
+	// responses:
+	//   '200':
+	//     description: OK. Returns job.
+	//     schema:
+	//       $ref: '#/definitions/job'
+	//   '401':
+	//     description: Unauthorized for job of private bucket (UNAUTHORIZED).
+	//   '403':
+	//     description: Client isn't permitted to read file of job (FORBIDDEN).
+	//   '404':
+	//     description: Not found (JOB_NOT_FOUND).
+	//   '500':
+	//     description: Internal error (CANT_MARSHAL_DATA).
+	var job Job
+	ok := false
+	if h.ctx.Jobs != nil {
+		job, ok = h.ctx.Jobs.Get(mux.Vars(r)["id"])
+	}
+	if !ok {
+		renderJSONError(w, errors.New("Job isn't found"), "JOB_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if code, status, err := h.authorize(r, job); err != nil {
+		renderJSONError(w, err, code, status)
+		return
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		renderJSONError(w, err, "CANT_MARSHAL_DATA", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", MIMEApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// authorize checks that client may read file of job as download does, returns error code & status otherwise
+func (h *JobsHandler) authorize(r *http.Request, job Job) (string, int, error) {
+	if h.ctx.KeyStore == nil && h.ctx.JWTVerifier == nil {
+		return "", 0, nil
+	}
+	principal := PrincipalFromRequest(r)
+	if principal == nil {
+		if policy, ok := h.ctx.BucketPolicy(job.Bucket); ok && policy.Public {
+			return "", 0, nil
+		}
+		return "UNAUTHORIZED", http.StatusUnauthorized, errors.New("API key or bearer token is required")
+	}
+	if !principal.Can(job.Bucket, OpReadPrivate) || !principal.CanAccessObject(job.File) {
+		return "FORBIDDEN", http.StatusForbidden, errors.New("Client isn't permitted to access this job")
+	}
+	return "", 0, nil
+}
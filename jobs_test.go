@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariant(t *testing.T) {
+	cases := []struct {
+		variant Variant
+		name    string
+	}{
+		{Variant{Preset: "thumb"}, "thumb"},
+		{Variant{Format: FormatWebP}, "webp"},
+		{Variant{Preset: "thumb", Format: FormatWebP}, "thumb.webp"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.name, c.variant.Name())
+		assert.Equal(t, ".variants/"+c.name+"/users/1/a.jpg", c.variant.ObjectName("/users/1/a.jpg"))
+	}
+
+	policy := &BucketPolicy{Variants: []Variant{cases[0].variant, cases[2].variant}}
+	variant, ok := policy.VariantFor(&Options{Preset: "thumb", Format: FormatWebP})
+	assert.True(t, ok)
+	assert.Equal(t, "thumb.webp", variant.Name())
+	_, ok = policy.VariantFor(&Options{Preset: "thumb", Quality: 50})
+	assert.False(t, ok)
+	_, ok = policy.VariantFor(&Options{})
+	assert.False(t, ok)
+}
+
+// testJobRunner fails the first given number of attempts of every job
+type testJobRunner struct {
+	mu       sync.Mutex
+	failures int
+	attempts map[string]int
+}
+
+func (tr *testJobRunner) run(ctx context.Context, job *Job) (map[string]interface{}, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.attempts[job.ID]++
+	if tr.attempts[job.ID] <= tr.failures {
+		return nil, errors.New("Resizer is unavailable")
+	}
+	return map[string]interface{}{"file": job.File}, nil
+}
+
+func TestJobQueue(t *testing.T) {
+	runner := &testJobRunner{failures: 1, attempts: map[string]int{}}
+	queue, err := NewJobQueue("", runner.run, time.Second, 2, time.Hour)
+	assert.Nil(t, err)
+	queue.retryDelay = time.Millisecond
+	queue.Start(2)
+	defer queue.Close()
+
+	variant := &Variant{Preset: "thumb"}
+	var ids []string
+	for _, file := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		job, err := queue.Enqueue(JobVariant, "docs", file, variant)
+		assert.Nil(t, err)
+		assert.Equal(t, JobQueued, job.Status)
+		ids = append(ids, job.ID)
+	}
+
+	// Jobs are done after retry
+	for i, id := range ids {
+		assert.Eventually(t, func() bool {
+			job, _ := queue.Get(id)
+			return job.Status == JobDone
+		}, 5*time.Second, 5*time.Millisecond)
+		job, ok := queue.Get(id)
+		assert.True(t, ok)
+		assert.Equal(t, 2, job.Attempts)
+		assert.Equal(t, []string{"a.jpg", "b.jpg", "c.jpg"}[i], job.Result["file"])
+		assert.Equal(t, variant, job.Variant)
+	}
+
+	// Job fails after max attempts
+	runner.mu.Lock()
+	runner.failures = 2
+	runner.mu.Unlock()
+	job, err := queue.Enqueue(JobAnalyze, "docs", "d.jpg", nil)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		job, _ := queue.Get(job.ID)
+		return job.Status == JobFailed
+	}, 5*time.Second, 5*time.Millisecond)
+	failed, _ := queue.Get(job.ID)
+	assert.Equal(t, "Resizer is unavailable", failed.Error)
+
+	_, ok := queue.Get("unknown")
+	assert.False(t, ok)
+}
+
+func TestJobQueuePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	runner := &testJobRunner{attempts: map[string]int{}}
+	queue, err := NewJobQueue(dir, runner.run, time.Second, 3, time.Hour)
+	assert.Nil(t, err)
+	first, err := queue.Enqueue(JobAnalyze, "docs", "a.jpg", nil)
+	assert.Nil(t, err)
+	second, err := queue.Enqueue(JobVariant, "docs", "a.jpg", &Variant{Preset: "thumb"})
+	assert.Nil(t, err)
+
+	// Queued jobs are restored in order of creation
+	restored, err := NewJobQueue(dir, runner.run, time.Second, 3, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{first.ID, second.ID}, restored.pending)
+	job, ok := restored.Get(second.ID)
+	assert.True(t, ok)
+	assert.Equal(t, "thumb", job.Variant.Preset)
+
+	// Finished jobs are kept till retention period expires
+	restored.Start(1)
+	assert.Eventually(t, func() bool {
+		job, _ := restored.Get(second.ID)
+		return job.Status == JobDone
+	}, 5*time.Second, 5*time.Millisecond)
+	restored.Close()
+	reloaded, err := NewJobQueue(dir, runner.run, time.Second, 3, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, reloaded.Pending())
+	job, _ = reloaded.Get(first.ID)
+	assert.Equal(t, JobDone, job.Status)
+
+	reloaded.removeExpired(time.Now().Add(time.Minute))
+	_, ok = reloaded.Get(first.ID)
+	assert.False(t, ok)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Empty(t, files)
+
+	// Malformed job isn't loaded
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "malformed.json"), []byte("{"), 0600))
+	_, err = NewJobQueue(dir, runner.run, time.Second, 3, time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestObjectChanged(t *testing.T) {
+	assert.True(t, objectChanged(minio.ErrorResponse{Code: "NoSuchKey"}))
+	assert.True(t, objectChanged(minio.ErrorResponse{Code: "PreconditionFailed"}))
+	assert.False(t, objectChanged(minio.ErrorResponse{Code: "AccessDenied"}))
+	assert.False(t, objectChanged(errors.New("Connection refused")))
+	assert.False(t, objectChanged(nil))
+}
+
+func TestJobsHandler(t *testing.T) {
+	runner := &testJobRunner{attempts: map[string]int{}}
+	queue, err := NewJobQueue("", runner.run, time.Second, 3, time.Hour)
+	assert.Nil(t, err)
+	job, err := queue.Enqueue(JobVariant, "docs", "a.jpg", &Variant{Preset: "thumb"})
+	assert.Nil(t, err)
+
+	appCtx := &AppContext{Config: &Config{}, Buckets: loadTestBucketsConfig(t), Jobs: queue}
+	router := InitRouter(appCtx)
+
+	req, err := http.NewRequest("GET", "/jobs/"+job.ID, nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	received := Job{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &received))
+	assert.Equal(t, job.ID, received.ID)
+	assert.Equal(t, JobQueued, received.Status)
+
+	req, _ = http.NewRequest("GET", "/jobs/unknown", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Job of private bucket requires permission to read its file
+	appCtx.KeyStore = NewStaticKeyStore(testKeys)
+	router = InitRouter(appCtx)
+	for key, status := range map[string]int{"": http.StatusUnauthorized, "upload-key": http.StatusForbidden, "admin-key": http.StatusOK} {
+		req, _ = http.NewRequest("GET", "/jobs/"+job.ID, nil)
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, status, rr.Code, key)
+	}
+	appCtx.Buckets.Buckets["docs"].Public = true
+	req, _ = http.NewRequest("GET", "/jobs/"+job.ID, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Jobs aren't found if background processing is disabled
+	appCtx.Jobs = nil
+	req, _ = http.NewRequest("GET", "/jobs/"+job.ID, nil)
+	rr = httptest.NewRecorder()
+	InitRouter(appCtx).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// BearerPrefix is a prefix of Authorization header with JWT
+const BearerPrefix = "Bearer "
+
+// JWTVerifier validates JWT & derives principal from its claims.
+type JWTVerifier struct {
+	hmacSecret     []byte
+	rsaKeys        map[string]*rsa.PublicKey
+	audience       string
+	issuer         string
+	bucketClaim    string
+	prefixTemplate string
+	operations     []string
+}
+
+// JWKS represents JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK represents JSON Web Key. Only RSA keys are supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// initJWTVerifier returns JWT verifier due to config or nil if JWT authentication is disabled
+func initJWTVerifier(cfg *Config) (*JWTVerifier, error) {
+	if cfg.JWTSecret == "" && cfg.JWTPublicKeyFile == "" && cfg.JWTJWKSFile == "" {
+		return nil, nil
+	}
+
+	jv := &JWTVerifier{
+		hmacSecret:     []byte(cfg.JWTSecret),
+		rsaKeys:        map[string]*rsa.PublicKey{},
+		audience:       cfg.JWTAudience,
+		issuer:         cfg.JWTIssuer,
+		bucketClaim:    cfg.JWTBucketClaim,
+		prefixTemplate: cfg.JWTPrefixTemplate,
+		operations:     cfg.JWTOperations,
+	}
+
+	if cfg.JWTPublicKeyFile != "" {
+		data, err := ioutil.ReadFile(cfg.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		jv.rsaKeys[""] = key
+	}
+
+	if cfg.JWTJWKSFile != "" {
+		keys, err := LoadJWKSFile(cfg.JWTJWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		for kid, key := range keys {
+			jv.rsaKeys[kid] = key
+		}
+	}
+
+	return jv, nil
+}
+
+// LoadJWKSFile returns RSA public keys by key IDs from local JWKS file.
+func LoadJWKSFile(path string) (map[string]*rsa.PublicKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	jwks := JWKS{}
+	if err := json.NewDecoder(file).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := jwk.rsaPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JWK %s: %v", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (jwk *JWK) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("RSA exponent is too big")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// Verify validates token signature, expiry & audience and returns principal derived from claims.
+func (jv *JWTVerifier) Verify(tokenString string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.Parser{ValidMethods: []string{"HS256", "RS256"}}
+	if _, err := parser.ParseWithClaims(tokenString, claims, jv.key); err != nil {
+		return nil, err
+	}
+
+	// Tokens without expiry aren't accepted
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("Token has no expiry or is expired")
+	}
+	if jv.audience != "" && !claims.VerifyAudience(jv.audience, true) {
+		return nil, errors.New("Token audience is invalid")
+	}
+	if jv.issuer != "" && !claims.VerifyIssuer(jv.issuer, true) {
+		return nil, errors.New("Token issuer is invalid")
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" || strings.Contains(sub, "/") || strings.Contains(sub, "..") {
+		return nil, errors.New("Token subject is invalid")
+	}
+
+	return &Principal{
+		Name:       sub,
+		Buckets:    claimStrings(claims[jv.bucketClaim]),
+		Operations: jv.operations,
+		Prefix:     strings.ReplaceAll(jv.prefixTemplate, "{sub}", sub),
+	}, nil
+}
+
+// key returns verification key due to token signing method
+func (jv *JWTVerifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case "HS256":
+		if len(jv.hmacSecret) == 0 {
+			return nil, errors.New("HS256 tokens aren't accepted")
+		}
+		return jv.hmacSecret, nil
+	case "RS256":
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := jv.rsaKeys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("Unknown key ID %q", kid)
+	}
+	return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+}
+
+// claimStrings returns claim value as slice of strings, claim may be a string or an array
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var result []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const testJWTSecret = "secret"
+
+func signHS256(claims jwt.MapClaims) string {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	return token
+}
+
+func testJWTConfig() *Config {
+	return &Config{
+		JWTSecret:         testJWTSecret,
+		JWTAudience:       "img2sto",
+		JWTBucketClaim:    "bucket",
+		JWTPrefixTemplate: "users/{sub}/",
+		JWTOperations:     []string{OpUpload, OpReadPrivate},
+	}
+}
+
+func TestJWTVerifierHS256(t *testing.T) {
+	jv, err := initJWTVerifier(testJWTConfig())
+	assert.Nil(t, err)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	cases := []struct {
+		claims jwt.MapClaims
+		valid  bool
+	}{
+		{jwt.MapClaims{"sub": "42", "aud": "img2sto", "exp": exp, "bucket": "avatars"}, true},
+		{jwt.MapClaims{"sub": "42", "aud": []string{"other", "img2sto"}, "exp": exp, "bucket": "avatars"}, true},
+		{jwt.MapClaims{"sub": "42", "aud": "img2sto", "exp": time.Now().Add(-time.Hour).Unix()}, false},
+		{jwt.MapClaims{"sub": "42", "aud": "img2sto"}, false},
+		{jwt.MapClaims{"sub": "42", "aud": "other", "exp": exp}, false},
+		{jwt.MapClaims{"sub": "../42", "aud": "img2sto", "exp": exp}, false},
+	}
+
+	for _, c := range cases {
+		principal, err := jv.Verify(signHS256(c.claims))
+		assert.Equal(t, c.valid, err == nil, c.claims)
+		if c.valid {
+			assert.Equal(t, "users/42/", principal.Prefix)
+			assert.Equal(t, []string{"avatars"}, principal.Buckets)
+		}
+	}
+
+	// Unsigned tokens are rejected
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "42", "aud": "img2sto", "exp": exp}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	_, err = jv.Verify(unsigned)
+	assert.NotNil(t, err)
+}
+
+func TestJWTVerifierRS256WithJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	jwks := JWKS{Keys: []JWK{{
+		Kty: "RSA",
+		Kid: "key-1",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	file, err := ioutil.TempFile("", "jwks")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	assert.Nil(t, json.NewEncoder(file).Encode(jwks))
+	file.Close()
+
+	cfg := testJWTConfig()
+	cfg.JWTSecret = ""
+	cfg.JWTJWKSFile = file.Name()
+	jv, err := initJWTVerifier(cfg)
+	assert.Nil(t, err)
+
+	claims := jwt.MapClaims{"sub": "42", "aud": "img2sto", "exp": time.Now().Add(time.Hour).Unix(), "bucket": "avatars"}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(key)
+	assert.Nil(t, err)
+
+	principal, err := jv.Verify(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, "42", principal.Name)
+
+	// HS256 tokens aren't accepted without secret
+	_, err = jv.Verify(signHS256(claims))
+	assert.NotNil(t, err)
+}
+
+func TestAuthMWWithJWT(t *testing.T) {
+	jv, err := initJWTVerifier(testJWTConfig())
+	assert.Nil(t, err)
+	token := signHS256(jwt.MapClaims{"sub": "42", "aud": "img2sto", "exp": time.Now().Add(time.Hour).Unix(), "bucket": "avatars"})
+
+	cases := []struct {
+		method   string
+		url      string
+		expected int
+	}{
+		{"POST", "/avatars", http.StatusOK},
+		{"POST", "/docs", http.StatusForbidden},
+		{"GET", "/avatars/users/42/a.jpg", http.StatusOK},
+		{"GET", "/avatars/users/43/a.jpg", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		appCtx := &AppContext{Config: &Config{}, JWTVerifier: jv}
+		ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		router := mux.NewRouter()
+		router.PathPrefix("/{bucket}").Handler(ok).Methods("POST").Name("upload")
+		router.PathPrefix("/{bucket}/").Handler(ok).Methods("GET").Name("download")
+		amw := &AuthMW{appCtx}
+		router.Use(amw.Middleware)
+
+		req, err := http.NewRequest(c.method, c.url, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", BearerPrefix+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expected, rr.Code, c)
+	}
+}
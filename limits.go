@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // Register GIF format for image.DecodeConfig
+	_ "image/jpeg" // Register JPEG format for image.DecodeConfig
+	_ "image/png"  // Register PNG format for image.DecodeConfig
+)
+
+// ErrImageTooLarge is returned for images exceeding configured limits
+var ErrImageTooLarge = errors.New("Image is too large")
+
+// ImageLimits represents limits of decoded image, zero values mean no limit.
+type ImageLimits struct {
+	MaxWidth      int
+	MaxHeight     int
+	MaxMegapixels float64
+	MaxGIFFrames  int
+}
+
+// imageLimits returns image limits from config
+func imageLimits(cfg *Config) ImageLimits {
+	return ImageLimits{
+		MaxWidth:      cfg.MaxImageWidth,
+		MaxHeight:     cfg.MaxImageHeight,
+		MaxMegapixels: cfg.MaxImageMegapixels,
+		MaxGIFFrames:  cfg.MaxGIFFrames,
+	}
+}
+
+// CheckImageLimits parses image header only & checks declared dimensions against limits
+// to prevent decompression bombs from exhausting resizer.
+func CheckImageLimits(data []byte, limits ImageLimits) error {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if limits.MaxWidth > 0 && config.Width > limits.MaxWidth {
+		return fmt.Errorf("%w: width %d exceeds %d", ErrImageTooLarge, config.Width, limits.MaxWidth)
+	}
+	if limits.MaxHeight > 0 && config.Height > limits.MaxHeight {
+		return fmt.Errorf("%w: height %d exceeds %d", ErrImageTooLarge, config.Height, limits.MaxHeight)
+	}
+	megapixels := float64(config.Width) * float64(config.Height) / 1e6
+	if limits.MaxMegapixels > 0 && megapixels > limits.MaxMegapixels {
+		return fmt.Errorf("%w: %.1f megapixels exceeds %.1f", ErrImageTooLarge, megapixels, limits.MaxMegapixels)
+	}
+
+	if format == "gif" && limits.MaxGIFFrames > 0 {
+		frames, err := countGIFFrames(data, limits.MaxGIFFrames+1)
+		if err != nil {
+			return err
+		}
+		if frames > limits.MaxGIFFrames {
+			return fmt.Errorf("%w: GIF has more than %d frames", ErrImageTooLarge, limits.MaxGIFFrames)
+		}
+	}
+
+	return nil
+}
+
+// countGIFFrames counts image descriptors walking through GIF blocks without decoding frames.
+// Stops counting at max.
+func countGIFFrames(data []byte, max int) (int, error) {
+	frames, _, err := walkGIF(data, max)
+	return frames, err
+}
+
+// walkGIF walks through GIF blocks till trailer or max frames (if max > 0)
+// & returns number of frames & offset after the last walked block.
+func walkGIF(data []byte, max int) (int, int, error) {
+	errMalformed := errors.New("GIF is malformed")
+
+	// Header (6) & logical screen descriptor (7)
+	if len(data) < 13 {
+		return 0, 0, errMalformed
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (uint(flags&0x07) + 1)
+	}
+
+	frames := 0
+	for pos < len(data) && (max <= 0 || frames < max) {
+		switch data[pos] {
+		case 0x21: // Extension: introducer, label, sub-blocks
+			pos += 2
+		case 0x2C: // Image descriptor (10) with optional local color table, LZW code size & sub-blocks
+			if pos+10 > len(data) {
+				return frames, pos, errMalformed
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (uint(flags&0x07) + 1)
+			}
+			pos++
+			frames++
+		case 0x3B: // Trailer
+			return frames, pos + 1, nil
+		default:
+			return frames, pos, errMalformed
+		}
+
+		// Skip sub-blocks till terminator
+		for {
+			if pos >= len(data) {
+				return frames, pos, errMalformed
+			}
+			size := int(data[pos])
+			pos += size + 1
+			if size == 0 {
+				break
+			}
+		}
+	}
+
+	// Data ended without trailer
+	if max <= 0 || frames < max {
+		return frames, pos, errMalformed
+	}
+	return frames, pos, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeTestPNG(width int, height int) []byte {
+	buf := bytes.NewBuffer(nil)
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	return buf.Bytes()
+}
+
+func encodeTestGIF(frames int) []byte {
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), palette.Plan9))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := bytes.NewBuffer(nil)
+	gif.EncodeAll(buf, anim)
+	return buf.Bytes()
+}
+
+func TestCheckImageLimits(t *testing.T) {
+	cases := []struct {
+		data     []byte
+		limits   ImageLimits
+		tooLarge bool
+	}{
+		{encodeTestPNG(100, 50), ImageLimits{MaxWidth: 100, MaxHeight: 100}, false},
+		{encodeTestPNG(101, 50), ImageLimits{MaxWidth: 100}, true},
+		{encodeTestPNG(50, 101), ImageLimits{MaxHeight: 100}, true},
+		{encodeTestPNG(1000, 1001), ImageLimits{MaxMegapixels: 1}, true},
+		{encodeTestPNG(1000, 1000), ImageLimits{MaxMegapixels: 1}, false},
+		{encodeTestGIF(3), ImageLimits{MaxGIFFrames: 3}, false},
+		{encodeTestGIF(4), ImageLimits{MaxGIFFrames: 3}, true},
+	}
+
+	for _, c := range cases {
+		err := CheckImageLimits(c.data, c.limits)
+		assert.Equal(t, c.tooLarge, errors.Is(err, ErrImageTooLarge), err)
+		if !c.tooLarge {
+			assert.Nil(t, err)
+		}
+	}
+
+	// Not an image
+	err := CheckImageLimits([]byte("not an image"), ImageLimits{})
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrImageTooLarge))
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	data, err := ioutil.ReadFile("./fixtures/a.gif")
+	assert.Nil(t, err)
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	frames, err := countGIFFrames(data, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, len(anim.Image), frames)
+
+	frames, err = countGIFFrames(data[:20], 1000)
+	assert.NotNil(t, err)
+}
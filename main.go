@@ -13,6 +13,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -32,13 +34,30 @@ const (
 	MIMEImageJPEG       = "image/jpeg"
 	MIMEImageGIF        = "image/gif"
 	MIMEImagePNG        = "image/png"
+	MIMEImageWebP       = "image/webp"
 )
 
 type AppContext struct {
-	Storage    *minio.Client
-	Config     *Config
-	Options    *Options
-	Dimensions []int
+	Storage     *minio.Client
+	Resizer     *Resizer
+	Readiness   *Readiness
+	KeyStore    KeyStore
+	JWTVerifier *JWTVerifier
+	Buckets     *BucketsConfig
+	RateLimiter *RateLimiter
+	URLSigner   *URLSigner
+	Config      *Config
+	Options     *Options
+	Dimensions  []int
+	Watermark   *Watermark
+	Pipeline    Pipeline
+
+	SimilarityIndex *SimilarityIndex
+	Scanner         Scanner
+	Outbox          *Outbox
+	Jobs            *JobQueue
+	Coalescer       *Coalescer
+	Cache           *ImageCache
 }
 
 type Config struct {
@@ -50,11 +69,104 @@ type Config struct {
 	Port             string `env:"PORT" envDefault:":8080"`
 	ResizeOnUpload   bool   `env:"RESIZE_ON_UPLOAD"`
 	ResizeOnDownload bool   `env:"RESIZE_ON_DOWNLOAD"`
+
+	ResizerTimeout         time.Duration `env:"RESIZER_TIMEOUT" envDefault:"3s"`
+	ResizerConcurrency     int           `env:"RESIZER_CONCURRENCY" envDefault:"16"`
+	ResizerQueueTimeout    time.Duration `env:"RESIZER_QUEUE_TIMEOUT" envDefault:"1s"`
+	ResizerBreakerFailures int           `env:"RESIZER_BREAKER_FAILURES" envDefault:"5"`
+	ResizerBreakerCooldown time.Duration `env:"RESIZER_BREAKER_COOLDOWN" envDefault:"30s"`
+	ResizeFallback         bool          `env:"RESIZE_FALLBACK" envDefault:"true"` // Serve original if resizer is unavailable
+	DownloadCoalescing     bool          `env:"DOWNLOAD_COALESCING" envDefault:"true"`
+
+	CacheMemorySize int64         `env:"CACHE_MEMORY_SIZE"` // Bytes, in-memory cache is disabled by default
+	CacheDir        string        `env:"CACHE_DIR"`
+	CacheDiskSize   int64         `env:"CACHE_DISK_SIZE" envDefault:"1073741824"`
+	CacheTTL        time.Duration `env:"CACHE_TTL" envDefault:"10m"`
+
+	BucketsConfigFile string `env:"BUCKETS_CONFIG_FILE"`
+
+	MaxImageWidth      int     `env:"MAX_IMAGE_WIDTH" envDefault:"10000"`
+	MaxImageHeight     int     `env:"MAX_IMAGE_HEIGHT" envDefault:"10000"`
+	MaxImageMegapixels float64 `env:"MAX_IMAGE_MEGAPIXELS" envDefault:"50"`
+	MaxGIFFrames       int     `env:"MAX_GIF_FRAMES" envDefault:"500"`
+	UploadFullDecode   bool    `env:"UPLOAD_FULL_DECODE" envDefault:"false"`
+
+	ScanClamdAddress     string        `env:"SCAN_CLAMD_ADDRESS"` // host:port or unix:/path/to/clamd.sock
+	ScanWebhookURL       string        `env:"SCAN_WEBHOOK_URL"`
+	ScanTimeout          time.Duration `env:"SCAN_TIMEOUT" envDefault:"30s"`
+	ScanFailOpen         bool          `env:"SCAN_FAIL_OPEN" envDefault:"false"`
+	ScanQuarantineBucket string        `env:"SCAN_QUARANTINE_BUCKET"`
+
+	ModerationWebhookURL string        `env:"MODERATION_WEBHOOK_URL"`
+	ModerationSecret     string        `env:"MODERATION_SECRET"`
+	ModerationTimeout    time.Duration `env:"MODERATION_TIMEOUT" envDefault:"10s"`
+
+	WebhookOutboxDir   string        `env:"WEBHOOK_OUTBOX_DIR"`
+	WebhookTimeout     time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"10s"`
+	WebhookMaxAttempts int           `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"10"`
+	WebhookBackoff     time.Duration `env:"WEBHOOK_BACKOFF" envDefault:"1s"`
+	WebhookWorkers     int           `env:"WEBHOOK_WORKERS" envDefault:"4"`
+
+	JobQueueDir    string        `env:"JOB_QUEUE_DIR"`
+	JobWorkers     int           `env:"JOB_WORKERS" envDefault:"2"`
+	JobTimeout     time.Duration `env:"JOB_TIMEOUT" envDefault:"1m"`
+	JobMaxAttempts int           `env:"JOB_MAX_ATTEMPTS" envDefault:"3"`
+	JobRetention   time.Duration `env:"JOB_RETENTION" envDefault:"24h"`
+
+	PlaceholdersEnabled bool   `env:"PLACEHOLDERS_ENABLED" envDefault:"true"`
+	SimilarityEnabled   bool   `env:"SIMILARITY_ENABLED" envDefault:"true"`
+	SimilarityIndexFile string `env:"SIMILARITY_INDEX_FILE"`
+
+	AuthKeysFile      string `env:"AUTH_KEYS_FILE"`
+	AuthKeysBucket    string `env:"AUTH_KEYS_BUCKET"`
+	AuthKeysObject    string `env:"AUTH_KEYS_OBJECT" envDefault:"keys.json"`
+	AuthAnonymousRead bool   `env:"AUTH_ANONYMOUS_READ" envDefault:"true"`
+
+	JWTSecret         string   `env:"JWT_SECRET"`
+	JWTPublicKeyFile  string   `env:"JWT_PUBLIC_KEY_FILE"`
+	JWTJWKSFile       string   `env:"JWT_JWKS_FILE"`
+	JWTAudience       string   `env:"JWT_AUDIENCE"`
+	JWTIssuer         string   `env:"JWT_ISSUER"`
+	JWTBucketClaim    string   `env:"JWT_BUCKET_CLAIM" envDefault:"bucket"`
+	JWTPrefixTemplate string   `env:"JWT_PREFIX_TEMPLATE" envDefault:"users/{sub}/"`
+	JWTOperations     []string `env:"JWT_OPERATIONS" envSeparator:"," envDefault:"upload"`
+
+	RateLimitUploadRate     float64  `env:"RATE_LIMIT_UPLOAD_RATE"`
+	RateLimitUploadBurst    int      `env:"RATE_LIMIT_UPLOAD_BURST" envDefault:"10"`
+	RateLimitDownloadRate   float64  `env:"RATE_LIMIT_DOWNLOAD_RATE"`
+	RateLimitDownloadBurst  int      `env:"RATE_LIMIT_DOWNLOAD_BURST" envDefault:"100"`
+	RateLimitTransformRate  float64  `env:"RATE_LIMIT_TRANSFORM_RATE"`
+	RateLimitTransformBurst int      `env:"RATE_LIMIT_TRANSFORM_BURST" envDefault:"20"`
+	TrustedProxies          []string `env:"TRUSTED_PROXIES" envSeparator:","`
+
+	TracingEnabled     bool    `env:"TRACING_ENABLED"`
+	TracingEndpoint    string  `env:"TRACING_ENDPOINT" envDefault:"127.0.0.1:4318"`
+	TracingInsecure    bool    `env:"TRACING_INSECURE"`
+	TracingSampleRatio float64 `env:"TRACING_SAMPLE_RATIO" envDefault:"1"`
+
+	ReadinessBuckets         []string      `env:"READINESS_BUCKETS" envSeparator:","`
+	ReadinessResizerCritical bool          `env:"READINESS_RESIZER_CRITICAL" envDefault:"true"`
+	ReadinessTimeout         time.Duration `env:"READINESS_TIMEOUT" envDefault:"2s"`
+	ReadinessCacheTTL        time.Duration `env:"READINESS_CACHE_TTL" envDefault:"5s"`
+
+	URLSignatureKey   string `env:"URL_SIGNATURE_KEY"`
+	URLSignatureSalt  string `env:"URL_SIGNATURE_SALT"`
+	URLSignatureQuery bool   `env:"URL_SIGNATURE_QUERY" envDefault:"false"`
+
+	IIIFEnabled bool   `env:"IIIF_ENABLED" envDefault:"false"`
+	PublicURL   string `env:"PUBLIC_URL"` // Base URL of service behind proxy, f.ex. https://img.example.com
 }
 
 type Options struct {
-	Enlarge bool
-	Resize  string
+	Enlarge   bool
+	Resize    string
+	Preset    string
+	Still     bool
+	Format    string
+	Watermark string
+	Op        string
+	Quality   int
+	DPR       int
 }
 
 func main() {
@@ -72,15 +184,89 @@ func CreateContext() *AppContext {
 	log.Println("Config:", cfg)
 
 	// Init app context
+	storage := initStorage(&cfg)
+	keyStore, err := initKeyStore(&cfg, storage)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	jwtVerifier, err := initJWTVerifier(&cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	buckets, err := initBucketsConfig(&cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rateLimiter, err := initRateLimiter(&cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	urlSigner, err := initURLSigner(&cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	similarityIndex, err := initSimilarityIndex(&cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	outbox, err := initOutbox(&cfg, buckets)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cache, err := initImageCache(&cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	ctx := AppContext{
-		Storage: initStorage(&cfg),
-		Config:  &cfg,
-		Options: &Options{},
+		Storage:     storage,
+		Resizer:     NewResizer(&cfg),
+		Readiness:   NewReadiness(readinessChecks(&cfg, storage), cfg.ReadinessTimeout, cfg.ReadinessCacheTTL),
+		KeyStore:    keyStore,
+		JWTVerifier: jwtVerifier,
+		Buckets:     buckets,
+		RateLimiter: rateLimiter,
+		URLSigner:   urlSigner,
+		Config:      &cfg,
+		Options:     &Options{},
+
+		SimilarityIndex: similarityIndex,
+		Scanner:         initScanner(&cfg),
+		Outbox:          outbox,
+		Cache:           cache,
+	}
+	if cfg.DownloadCoalescing {
+		ctx.Coalescer = NewCoalescer()
+	}
+	if cfg.IIIFEnabled && ctx.RequiresQuerySignature() {
+		log.Println("IIIF is disabled, its URLs can't be signed with URL_SIGNATURE_QUERY")
+	}
+	// Jobs are run by app context, so queue is created after it
+	ctx.Jobs, err = initJobQueue(&ctx)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
 	return &ctx
 }
 
+// ForRequest returns copy of app context with options of given request.
+func (ctx *AppContext) ForRequest(r *http.Request) *AppContext {
+	reqCtx := *ctx
+	reqCtx.Options = OptionsFromRequest(r)
+	reqCtx.Dimensions = nil
+	reqCtx.Watermark = nil
+	reqCtx.Pipeline = nil
+	return &reqCtx
+}
+
+// Presets returns configured resize presets.
+func (ctx *AppContext) Presets() map[string]Preset {
+	if ctx.Buckets == nil {
+		return nil
+	}
+	return ctx.Buckets.Presets
+}
+
 func initStorage(cfg *Config) *minio.Client {
 	client, err := minio.New(cfg.StorageURL, cfg.StorageAccessKey, cfg.StorageSecretKey, cfg.StorageSSL)
 	if err != nil {
@@ -96,6 +282,28 @@ func initServer(appCtx *AppContext) {
 		WriteTimeout: ServerTimeout,
 	}
 
+	// Export traces if enabled
+	if appCtx.Config.TracingEnabled {
+		shutdownTracing, err := initTracing(appCtx.Config)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		server.RegisterOnShutdown(func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+
+	// Deliver pending webhooks till shutdown, undelivered ones stay in outbox
+	if appCtx.Outbox != nil {
+		server.RegisterOnShutdown(appCtx.Outbox.Close)
+	}
+	// Wait for running jobs, queued ones stay in queue directory
+	if appCtx.Jobs != nil {
+		server.RegisterOnShutdown(appCtx.Jobs.Close)
+	}
+
 	// Apply router to server
 	server.Handler = InitRouter(appCtx)
 	// Serve gracefully
@@ -107,23 +315,52 @@ func InitRouter(appCtx *AppContext) http.Handler {
 	router := mux.NewRouter()
 
 	// Register routes
-	router.HandleFunc("/health", HealthController).Methods("GET")
-	router.PathPrefix("/").Handler(&UploadHandler{appCtx}).Methods("POST")
-	router.PathPrefix("/").Handler(&DownloadHandler{appCtx}).Methods("GET")
+	router.HandleFunc("/health", HealthController).Methods("GET").Name("health")
+	router.HandleFunc("/livez", LivenessController).Methods("GET").Name("livez")
+	router.Handle("/readyz", &ReadinessHandler{appCtx}).Methods("GET").Name("readyz")
+	router.Handle("/metrics", MetricsController()).Methods("GET").Name("metrics")
+	// IIIF viewers construct URLs, so they can't be signed & IIIF isn't served if signed query is required
+	if appCtx.Config.IIIFEnabled && !appCtx.RequiresQuerySignature() {
+		router.Handle(iiifInfoRoute, &IIIFInfoHandler{appCtx}).Methods("GET").Name("iiif.info")
+		router.Handle(iiifImageRoute, &IIIFImageHandler{appCtx}).Methods("GET").Name("iiif.image")
+		router.HandleFunc(iiifIdentifierRoute, IIIFRedirectController).Methods("GET").Name("iiif.base")
+	}
+	router.Handle("/jobs/{id}", &JobsHandler{appCtx}).Methods("GET").Name("jobs")
+	router.Handle("/moderation/callback", &ModerationCallbackHandler{appCtx}).Methods("POST").Name("moderation.callback")
+	router.Handle("/{bucket}/similar", &SimilarHandler{appCtx}).Methods("GET").Name("similar")
+	router.Handle("/{bucket}/moderation", &ModerationHandler{appCtx}).Methods("GET", "POST").Name("moderation")
+	router.Handle("/{bucket}/{object:.+}"+InfoSuffix, &InfoHandler{appCtx}).Methods("GET").Name("info")
+	router.Handle("/{bucket}/{object:.+}"+SrcsetSuffix, &SrcsetHandler{appCtx}).Methods("GET").Name("srcset")
+	router.Handle("/{bucket}/{object:.+}", &DeleteHandler{appCtx}).Methods("DELETE").Name("delete")
+	router.PathPrefix("/{bucket}").Handler(&UploadHandler{appCtx}).Methods("POST", "OPTIONS").Name("upload")
+	router.PathPrefix("/{bucket}/").Handler(&DownloadHandler{appCtx}).Methods("GET").Name("download")
 
 	// Apply middlewares
+	router.Use(TracingMW)
+	router.Use(MetricsMW)
+	// GOTCHA: CORS must precede auth to respond on preflight requests
+	router.Use(CorsMW)
+	bmw := &BucketMW{appCtx}
+	router.Use(bmw.Middleware)
+	amw := &AuthMW{appCtx}
+	router.Use(amw.Middleware)
+	smw := &SignatureMW{appCtx}
+	router.Use(smw.Middleware)
+	rmw := &RateLimitMW{appCtx}
+	router.Use(rmw.Middleware)
 	omw := &OptionsMW{appCtx}
 	router.Use(omw.Middleware)
-	router.Use(CorsMW)
 	router.Use(LoggingMW)
 
-	return router
+	// Path mode URLs are rewritten before routing
+	ptmw := &PathTransformMW{appCtx}
+	return ptmw.Middleware(router)
 }
 
 // graceShutdown implements server graceful shutdown
 func graceShutdown(server *http.Server) {
 	// Subscribe to SIGINT signals
-	stopChan := make(chan os.Signal)
+	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt)
 
 	go func() {
@@ -152,6 +389,24 @@ func graceShutdown(server *http.Server) {
 
 // renderError implements common app error handling
 func renderError(w http.ResponseWriter, err error, message string, statusCode int) {
+	if err == nil {
+		err = errors.New(message)
+	}
 	log.Println(message, err)
 	http.Error(w, err.Error(), statusCode)
 }
+
+// ErrorResponse represents error response
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// renderJSONError implements app error handling for JSON API clients
+func renderJSONError(w http.ResponseWriter, err error, code string, statusCode int) {
+	log.Println(code, err)
+	body, _ := json.Marshal(ErrorResponse{code, err.Error()})
+	w.Header().Set("Content-Type", MIMEApplicationJSON)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "img2sto"
+
+// Resizer names used as metric labels
+const (
+	ResizerImaginary = "imaginary"
+	ResizerNative    = "native"
+)
+
+// Storage operation names used as metric labels
+const (
+	StorageOpGet    = "get"
+	StorageOpPut    = "put"
+	StorageOpStat   = "stat"
+	StorageOpRemove = "remove"
+	StorageOpCopy   = "copy"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "status"})
+
+	httpRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests currently being served.",
+	})
+
+	uploadSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_size_bytes",
+		Help:      "Size of uploaded files in bytes.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8), // 1kb .. 16mb
+	})
+
+	resizeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "resize_duration_seconds",
+		Help:      "Image resizing latency by resizer.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"resizer"})
+
+	resizeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "resize_failures_total",
+		Help:      "Total number of failed resizes by resizer.",
+	}, []string{"resizer"})
+
+	resizeInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "resize_in_flight",
+		Help:      "Number of resizes currently being made by Imaginary.",
+	})
+
+	resizeFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "resize_fallbacks_total",
+		Help:      "Total number of originals served because resizer was unavailable.",
+	})
+
+	resizerCircuitState = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "resizer_circuit_state",
+		Help:      "State of resizer circuit breaker (0 closed, 1 half-open, 2 open).",
+	})
+
+	coalescedDownloads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "coalesced_downloads_total",
+		Help:      "Total number of downloads served by result of identical in-flight download.",
+	})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Storage operation latency by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_errors_total",
+		Help:      "Total number of failed storage operations by operation.",
+	}, []string{"operation"})
+
+	scanDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "scan_duration_seconds",
+		Help:      "Upload scanning latency by scanner.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"scanner"})
+
+	scanResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "scan_results_total",
+		Help:      "Total number of upload scans by scanner and result (clean, infected or error).",
+	}, []string{"scanner", "result"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Total number of webhook delivery attempts by result (delivered, retried, failed or dropped).",
+	}, []string{"result"})
+
+	jobResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_total",
+		Help:      "Total number of background jobs by type and status (queued, done, failed or queued again for retry).",
+	}, []string{"type", "status"})
+
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_duration_seconds",
+		Help:      "Background job latency by type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_lookups_total",
+		Help:      "Total number of cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	cacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_size_bytes",
+		Help:      "Size of cached images by cache level (memory or disk).",
+	}, []string{"level"})
+)
+
+// MetricsController exposes metrics in Prometheus exposition format
+func MetricsController() http.Handler {
+	// swagger:operation GET /metrics metrics
+	// ---
+	// summary: Metrics
+	// description: Returns app metrics in Prometheus exposition format.
+	// produces:
+	//   - text/plain
+	// responses:
+	//   '200':
+	//     description: OK. Returns metrics.
+	return promhttp.Handler()
+}
+
+// statusRecorder captures response status code for metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// MetricsMW provides request metrics middleware.
+func MetricsMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r)
+
+		route := routeName(r)
+		status := strconv.Itoa(sr.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeName returns name of matched route to keep metric labels cardinality low
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+		return route.GetName()
+	}
+	return "unknown"
+}
+
+// observeResize records resize latency & failures for given resizer
+func observeResize(resizer string, start time.Time, failed bool) {
+	resizeDuration.WithLabelValues(resizer).Observe(time.Since(start).Seconds())
+	if failed {
+		resizeFailures.WithLabelValues(resizer).Inc()
+	}
+}
+
+// observeStorage records storage operation latency & errors
+func observeStorage(operation string, start time.Time, err error) {
+	storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// observeScan records scanning latency & result of given scanner
+func observeScan(scanner string, result string, start time.Time) {
+	scanDuration.WithLabelValues(scanner).Observe(time.Since(start).Seconds())
+	scanResults.WithLabelValues(scanner, result).Inc()
+}
+
+// observeWebhook records webhook delivery attempt result
+func observeWebhook(result string) {
+	webhookDeliveries.WithLabelValues(result).Inc()
+}
+
+// observeJob records background job status change
+func observeJob(jobType string, status string) {
+	jobResults.WithLabelValues(jobType, status).Inc()
+}
+
+// observeCoalesced records download served by result of identical in-flight one
+func observeCoalesced() {
+	coalescedDownloads.Inc()
+}
+
+// observeCache records cache lookup result
+func observeCache(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsController(t *testing.T) {
+	router := InitRouter(&AppContext{Config: &Config{}, Options: &Options{}})
+
+	req, err := http.NewRequest("GET", "/health", nil)
+	assert.Nil(t, err)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	body, err := ioutil.ReadAll(rr.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, string(body), `img2sto_http_requests_total{method="GET",route="health",status="200"}`)
+	assert.Contains(t, string(body), "img2sto_http_requests_in_flight")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
 
@@ -13,22 +14,42 @@ type OptionsMW struct {
 	ctx *AppContext
 }
 
+type optionsKey struct{}
+
 // Middleware for OptionsMW prepares options from query params.
+// Options are request-scoped, see OptionsFromRequest.
 func (omw *OptionsMW) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := startSpan(r.Context(), "options.parse")
+		opts := &Options{}
 		decoder := schema.NewDecoder()
-		err := decoder.Decode(omw.ctx.Options, r.URL.Query())
+		decoder.IgnoreUnknownKeys(true)
+		err := decoder.Decode(opts, r.URL.Query())
+		endSpan(span, err)
 		if err != nil {
 			renderError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
+			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), optionsKey{}, opts)))
 	})
 }
 
+// OptionsFromRequest returns options prepared by OptionsMW.
+func OptionsFromRequest(r *http.Request) *Options {
+	if opts, ok := r.Context().Value(optionsKey{}).(*Options); ok {
+		return opts
+	}
+	return &Options{}
+}
+
 // CorsMW provides Cross-Origin Resource Sharing middleware.
+// Auth headers are allowed for direct uploads from browser.
 func CorsMW(next http.Handler) http.Handler {
-	return handlers.CORS()(next)
+	return handlers.CORS(
+		handlers.AllowedHeaders([]string{"Authorization", APIKeyHeader}),
+		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "DELETE"}),
+	)(next)
 }
 
 // LoggingMW provides logging middleware.
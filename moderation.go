@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go"
+)
+
+// Object prefixes of uploads held for moderation, they aren't readable in moderated buckets
+const (
+	ModerationPrefix         = ".moderation/"
+	ModerationPendingPrefix  = ModerationPrefix + "pending/"
+	ModerationRejectedPrefix = ModerationPrefix + "rejected/"
+)
+
+// Moderation statuses
+const (
+	ModerationPending  = "pending"
+	ModerationApproved = "approved"
+	ModerationRejected = "rejected"
+)
+
+// Object metadata keys of moderation
+const (
+	MetadataModerationStatus = "Moderation-Status"
+	MetadataModerationReason = "Moderation-Reason"
+)
+
+// ModerationSignatureHeader is a header with HMAC-SHA256 of body for moderation webhook & callback
+const ModerationSignatureHeader = "X-Moderation-Signature"
+
+// MaxModerationList limits number of listed pending uploads
+const MaxModerationList = 1000
+
+// ErrNotPending is returned for decisions on objects which aren't pending moderation
+var ErrNotPending = errors.New("Object isn't pending moderation")
+
+// ModerationEvent is posted to moderation webhook for pending upload
+type ModerationEvent struct {
+	Bucket      string `json:"bucket"`
+	File        string `json:"file"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"` // Image in base64
+	Callback    string `json:"callback"`
+}
+
+// ModerationDecision represents approval or rejection of pending upload
+// swagger:model moderationDecision
+type ModerationDecision struct {
+	Bucket string `json:"bucket,omitempty"` // Required for callback only
+	File   string `json:"file"`
+	Status string `json:"status"` // approved or rejected
+	Reason string `json:"reason,omitempty"`
+}
+
+// validate checks decision status & file name
+func (d *ModerationDecision) validate() error {
+	if d.Status != ModerationApproved && d.Status != ModerationRejected {
+		return errors.New("Status must be approved or rejected")
+	}
+	if d.File == "" || strings.HasPrefix(strings.TrimLeft(d.File, "/"), ModerationPrefix) {
+		return errors.New("File is invalid")
+	}
+	return nil
+}
+
+// PendingUpload represents upload waiting for moderation
+type PendingUpload struct {
+	File         string    `json:"file"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// ModerationListResponse represents pending uploads of bucket
+// swagger:model moderationListResponse
+type ModerationListResponse struct {
+	Pending []PendingUpload `json:"pending"`
+}
+
+// isModerationObject reports whether object is held for moderation
+func isModerationObject(objName string) bool {
+	return strings.HasPrefix(strings.TrimLeft(objName, "/"), ModerationPrefix)
+}
+
+// signModeration returns signature of moderation webhook or callback body
+func signModeration(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyModeration posts pending upload to moderation webhook in background.
+// Failed notifications are logged only, pending uploads stay listed by admin endpoint.
+func notifyModeration(ctx *AppContext, event ModerationEvent) {
+	if ctx.Config.ModerationWebhookURL == "" {
+		return
+	}
+	go func() {
+		if err := sendModerationEvent(ctx.Config, event); err != nil {
+			log.Println("CANT_NOTIFY_MODERATION", err)
+		}
+	}()
+}
+
+// sendModerationEvent posts signed event to moderation webhook
+func sendModerationEvent(cfg *Config, event ModerationEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", cfg.ModerationWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", MIMEApplicationJSON)
+	req.Header.Set(ModerationSignatureHeader, signModeration(cfg.ModerationSecret, body))
+
+	client := http.Client{Timeout: cfg.ModerationTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Moderation webhook responded unsuccessfully with status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// moderationMetadata returns user metadata of object with given moderation status
+func moderationMetadata(metadata http.Header, status string, reason string) map[string]string {
+	result := userMetadata(metadata)
+	result[MetadataModerationStatus] = status
+	delete(result, MetadataModerationReason)
+	if reason != "" {
+		result[MetadataModerationReason] = reason
+	}
+	return result
+}
+
+// applyModeration moves pending object to its public name if approved or to rejected prefix otherwise.
+// Objects are copied through service to keep content type & metadata.
+func applyModeration(reqCtx context.Context, ctx *AppContext, bucketName string, decision *ModerationDecision) error {
+	file := strings.TrimLeft(decision.File, "/")
+	src := ModerationPendingPrefix + file
+	dst := file
+	if decision.Status == ModerationRejected {
+		dst = ModerationRejectedPrefix + file
+	}
+
+	_, span := startSpan(reqCtx, "storage.get", storageAttributes(bucketName, src)...)
+	start := time.Now()
+	obj, err := ctx.Storage.GetObject(bucketName, src, minio.GetObjectOptions{})
+	var info minio.ObjectInfo
+	var data []byte
+	if err == nil {
+		defer obj.Close()
+		if info, err = obj.Stat(); err == nil {
+			data, err = ioutil.ReadAll(obj)
+		}
+	}
+	observeStorage(StorageOpGet, start, err)
+	endSpan(span, err)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotPending
+	}
+	if err != nil {
+		return err
+	}
+
+	_, span = startSpan(reqCtx, "storage.put", storageAttributes(bucketName, dst)...)
+	start = time.Now()
+	_, err = ctx.Storage.PutObject(bucketName, dst, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  info.ContentType,
+		UserMetadata: moderationMetadata(info.Metadata, decision.Status, decision.Reason),
+	})
+	observeStorage(StorageOpPut, start, err)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	ctx.invalidateCache(bucketName, dst)
+
+	_, span = startSpan(reqCtx, "storage.remove", storageAttributes(bucketName, src)...)
+	start = time.Now()
+	err = ctx.Storage.RemoveObject(bucketName, src)
+	observeStorage(StorageOpRemove, start, err)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	ctx.invalidateCache(bucketName, src)
+
+	// Approved upload is indexed & processed in background like unmoderated one
+	if decision.Status == ModerationApproved {
+		indexApproved(ctx, bucketName, file, info.Metadata)
+		if policy, ok := ctx.BucketPolicy(bucketName); ok {
+			enqueueJobs(ctx, bucketName, file, policy)
+		}
+	} else {
+		emitEvent(ctx, EventUploadRejected, bucketName, file, map[string]interface{}{
+			"code":   "MODERATION_REJECTED",
+			"reason": decision.Reason,
+		})
+	}
+	return nil
+}
+
+// indexApproved indexes approved upload for similarity search by hash stored on upload
+func indexApproved(ctx *AppContext, bucketName string, file string, metadata http.Header) {
+	// Hashes are missing if analysis is asynchronous, then analysis job indexes upload
+	hashes := HashesFromMetadata(metadata)
+	if hashes == nil || ctx.SimilarityIndex == nil {
+		return
+	}
+	hash, _ := ParseHash(hashes.PHash)
+	if err := ctx.SimilarityIndex.Add(bucketName, file, hash); err != nil {
+		log.Println("CANT_INDEX_IMAGE", err)
+	}
+}
+
+// renderModerationError responds with error of applying moderation decision
+func renderModerationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotPending) {
+		renderJSONError(w, err, "OBJECT_ISNT_PENDING", http.StatusNotFound)
+		return
+	}
+	renderJSONError(w, err, "CANT_MODERATE_FILE", http.StatusInternalServerError)
+}
+
+// ModerationCallbackHandler is a wrapper to provide appContext to moderation callback handler.
+type ModerationCallbackHandler struct {
+	ctx *AppContext
+}
+
+// ModerationCallbackController applies decision of moderation service signed by shared secret
+func (h *ModerationCallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation POST /moderation/callback moderationCallback
+	// ---
+	// summary: Moderation callback
+	// description: Approve or reject pending upload by moderation service. Body is signed by MODERATION_SECRET.
+	// consumes:
+	//   - application/json
+	// produces:
+	//   - application/json
+	// parameters:
+	//   - in: header
+	//     name: X-Moderation-Signature
+	//     type: string
+	//     required: true
+	//     description: HMAC-SHA256 of body in hex prefixed by "sha256=".
+	//   - in: body
+	//     name: decision
+	//     required: true
+	//     schema:
+	//       $ref: '#/definitions/moderationDecision'
+	// responses:
+	//   '204':
+	//     description: Decision is applied.
+	//   '400':
+	//     description: Bad request (MODERATION_PARAMS_ARE_INVALID).
+	//   '403':
+	//     description: Forbidden (SIGNATURE_IS_INVALID).
+	//   '404':
+	//     description: Not found (MODERATION_IS_DISABLED, BUCKET_NOT_FOUND, OBJECT_ISNT_PENDING).
+	//   '500':
+	//     description: Internal error (CANT_MODERATE_FILE).
+	secret := h.ctx.Config.ModerationSecret
+	if secret == "" {
+		renderJSONError(w, errors.New("Moderation callback is disabled"), "MODERATION_IS_DISABLED", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		renderJSONError(w, err, "MODERATION_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get(ModerationSignatureHeader)), []byte(signModeration(secret, body))) {
+		renderJSONError(w, errors.New("Moderation signature is invalid"), "SIGNATURE_IS_INVALID", http.StatusForbidden)
+		return
+	}
+
+	decision := &ModerationDecision{}
+	if err = json.Unmarshal(body, decision); err == nil {
+		err = decision.validate()
+	}
+	if err != nil {
+		renderJSONError(w, err, "MODERATION_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+	if policy, ok := h.ctx.BucketPolicy(decision.Bucket); !ok || !policy.Moderation {
+		renderJSONError(w, errors.New("Bucket isn't found"), "BUCKET_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+
+	if err = applyModeration(r.Context(), h.ctx, decision.Bucket, decision); err != nil {
+		renderModerationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ModerationHandler is a wrapper to provide appContext to moderation admin handler.
+type ModerationHandler struct {
+	ctx *AppContext
+}
+
+// ModerationController lists pending uploads or applies decision of moderator
+func (h *ModerationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /{bucket}/moderation moderationList
+	// ---
+	// summary: Pending uploads
+	// description: List uploads pending moderation, client must have moderate operation.
+	// produces:
+	//   - application/json
+	// parameters:
+	//   - in: path
+	//     name: bucket
+	//     type: string
+	//     required: true
+	//     description: Bucket name in storage.
+	// responses:
+	//   '200':
+	//     description: OK. Returns pending uploads.
+	//     schema:
+	//       $ref: '#/definitions/moderationListResponse'
+	//   '403':
+	//     description: Forbidden (FORBIDDEN).
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND, MODERATION_IS_DISABLED).
+	//   '500':
+	//     description: Internal error (CANT_LIST_FILES).
+
+	// swagger:operation POST /{bucket}/moderation moderate
+	// ---
+	// summary: Moderate
+	// description: Approve or reject pending upload, client must have moderate operation.
+	// consumes:
+	//   - application/json
+	// produces:
+	//   - application/json
+	// parameters:
+	//   - in: path
+	//     name: bucket
+	//     type: string
+	//     required: true
+	//     description: Bucket name in storage.
+	//   - in: body
+	//     name: decision
+	//     required: true
+	//     schema:
+	//       $ref: '#/definitions/moderationDecision'
+	// responses:
+	//   '204':
+	//     description: Decision is applied.
+	//   '400':
+	//     description: Bad request (MODERATION_PARAMS_ARE_INVALID).
+	//   '403':
+	//     description: Forbidden (FORBIDDEN).
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND, MODERATION_IS_DISABLED, OBJECT_ISNT_PENDING).
+	//   '500':
+	//     description: Internal error (CANT_MODERATE_FILE).
+	bucketName := mux.Vars(r)["bucket"]
+	if policy := BucketPolicyFromRequest(r); policy == nil || !policy.Moderation {
+		renderJSONError(w, errors.New("Bucket isn't moderated"), "MODERATION_IS_DISABLED", http.StatusNotFound)
+		return
+	}
+	// Moderation isn't open to anonymous clients even if authentication is disabled
+	principal := PrincipalFromRequest(r)
+	if principal == nil {
+		renderJSONError(w, errors.New("Moderation requires authenticated client"), "FORBIDDEN", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "GET" {
+		h.list(w, bucketName, principal)
+		return
+	}
+
+	decision := &ModerationDecision{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(decision)
+	if err == nil {
+		err = decision.validate()
+	}
+	if err != nil {
+		renderJSONError(w, err, "MODERATION_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+	if !principal.CanAccessObject(decision.File) {
+		renderJSONError(w, errors.New("Client isn't permitted to access this object"), "FORBIDDEN", http.StatusForbidden)
+		return
+	}
+
+	if err = applyModeration(r.Context(), h.ctx, bucketName, decision); err != nil {
+		renderModerationError(w, err)
+		return
+	}
+	log.Printf("Moderated: %s/%s %s by %s\n", bucketName, decision.File, decision.Status, principal.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// list responds with pending uploads accessible for principal
+func (h *ModerationHandler) list(w http.ResponseWriter, bucketName string, principal *Principal) {
+	done := make(chan struct{})
+	defer close(done)
+
+	pending := []PendingUpload{}
+	for obj := range h.ctx.Storage.ListObjectsV2(bucketName, ModerationPendingPrefix+principal.Prefix, true, done) {
+		if obj.Err != nil {
+			renderJSONError(w, obj.Err, "CANT_LIST_FILES", http.StatusInternalServerError)
+			return
+		}
+		pending = append(pending, PendingUpload{
+			File:         strings.TrimPrefix(obj.Key, ModerationPendingPrefix),
+			Size:         obj.Size,
+			LastModified: obj.LastModified,
+		})
+		if len(pending) == MaxModerationList {
+			break
+		}
+	}
+
+	body, _ := json.Marshal(ModerationListResponse{Pending: pending})
+	w.Header().Set("Content-Type", MIMEApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModerationDecisionValidate(t *testing.T) {
+	cases := []struct {
+		decision ModerationDecision
+		valid    bool
+	}{
+		{ModerationDecision{File: "a.jpg", Status: ModerationApproved}, true},
+		{ModerationDecision{File: "users/1/a.jpg", Status: ModerationRejected, Reason: "nudity"}, true},
+		{ModerationDecision{File: "a.jpg", Status: ModerationPending}, false},
+		{ModerationDecision{File: "", Status: ModerationApproved}, false},
+		{ModerationDecision{File: "/.moderation/rejected/a.jpg", Status: ModerationApproved}, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.valid, c.decision.validate() == nil, c.decision)
+	}
+
+	assert.True(t, isModerationObject(".moderation/pending/a.jpg"))
+	assert.True(t, isModerationObject("/.moderation/rejected/a.jpg"))
+	assert.False(t, isModerationObject("a.jpg"))
+}
+
+func TestModerationMetadata(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Amz-Meta-Blurhash", "LEHV6nWB2yk8pyo0adR*.7kCMdnj")
+	header.Set("X-Amz-Meta-Moderation-Status", ModerationPending)
+	header.Set("X-Amz-Meta-Moderation-Reason", "spam")
+	header.Set("Content-Type", MIMEImagePNG)
+
+	assert.Equal(t, map[string]string{
+		MetadataBlurHash:         "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		MetadataModerationStatus: ModerationApproved,
+	}, moderationMetadata(header, ModerationApproved, ""))
+	assert.Equal(t, "nudity", moderationMetadata(header, ModerationRejected, "nudity")[MetadataModerationReason])
+}
+
+func TestIndexApproved(t *testing.T) {
+	index, err := NewSimilarityIndex("")
+	assert.Nil(t, err)
+	appCtx := &AppContext{SimilarityIndex: index}
+	header := http.Header{}
+	for key, value := range (&ImageHashes{AHash: "00", DHash: "00", PHash: "00000000000000ff"}).Metadata() {
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+
+	// Approved upload is indexed by stored hash
+	indexApproved(appCtx, "docs", "a.jpg", header)
+	hash, ok := index.Hash("docs", "a.jpg")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0xff), hash)
+
+	indexApproved(appCtx, "docs", "b.jpg", http.Header{})
+	_, ok = index.Hash("docs", "b.jpg")
+	assert.False(t, ok)
+}
+
+func TestSendModerationEvent(t *testing.T) {
+	var received ModerationEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(ModerationSignatureHeader) != signModeration("secret", body) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	event := ModerationEvent{Bucket: "docs", File: "a.png", ContentType: MIMEImagePNG, Data: []byte{1, 2, 3}, Callback: "https://img.example.com/moderation/callback"}
+	cfg := &Config{ModerationWebhookURL: server.URL, ModerationSecret: "secret", ModerationTimeout: time.Second}
+	assert.Nil(t, sendModerationEvent(cfg, event))
+	assert.Equal(t, event, received)
+
+	cfg.ModerationSecret = "another"
+	assert.NotNil(t, sendModerationEvent(cfg, event))
+}
+
+func TestModerationCallbackHandler(t *testing.T) {
+	cases := []struct {
+		decision  string
+		signature string
+		expected  int
+	}{
+		{`{"bucket": "docs", "file": "a.jpg", "status": "approved"}`, "another", http.StatusForbidden},
+		{`{"bucket": "docs", "file": "a.jpg", "status": "approved"}`, "", http.StatusForbidden},
+		{`{"bucket": "docs", "file": "a.jpg", "status": "pending"}`, "secret", http.StatusBadRequest},
+		{`{"bucket": "docs", "file": "a.jpg"`, "secret", http.StatusBadRequest},
+		{`{"bucket": "avatars", "file": "a.jpg", "status": "approved"}`, "secret", http.StatusNotFound},
+		{`{"bucket": "unknown", "file": "a.jpg", "status": "approved"}`, "secret", http.StatusNotFound},
+	}
+
+	buckets := loadTestBucketsConfig(t)
+	buckets.Buckets["docs"].Moderation = true
+	appCtx := &AppContext{Config: &Config{ModerationSecret: "secret"}, Buckets: buckets}
+	router := InitRouter(appCtx)
+
+	for _, c := range cases {
+		req, err := http.NewRequest("POST", "/moderation/callback", bytes.NewBufferString(c.decision))
+		assert.Nil(t, err)
+		if c.signature != "" {
+			req.Header.Set(ModerationSignatureHeader, signModeration(c.signature, []byte(c.decision)))
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, c.expected, rr.Code, c.decision)
+	}
+
+	// Callback is disabled without secret
+	appCtx.Config.ModerationSecret = ""
+	req, _ := http.NewRequest("POST", "/moderation/callback", bytes.NewBufferString(cases[0].decision))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestModerationHandler(t *testing.T) {
+	cases := []struct {
+		method   string
+		url      string
+		expected int
+	}{
+		// Pending uploads aren't readable
+		{"GET", "/docs/.moderation/pending/a.jpg", http.StatusNotFound},
+		{"GET", "/docs/.moderation/pending/a.jpg/info", http.StatusNotFound},
+		{"GET", "/docs/similar?object=.moderation/pending/a.jpg", http.StatusNotFound},
+		// Moderation requires authenticated client
+		{"GET", "/docs/moderation", http.StatusForbidden},
+		{"POST", "/docs/moderation", http.StatusForbidden},
+		{"GET", "/photos/moderation", http.StatusNotFound},
+	}
+
+	buckets := loadTestBucketsConfig(t)
+	buckets.Buckets["docs"].Moderation = true
+	router := InitRouter(&AppContext{Config: &Config{AuthAnonymousRead: true}, Buckets: buckets})
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.url, bytes.NewBufferString(`{"file": "a.jpg", "status": "approved"}`))
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, c.expected, rr.Code, c.url)
+	}
+}
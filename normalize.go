@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+// EXIF tags
+const (
+	exifTagOrientation = 0x0112
+	exifTagCopyright   = 0x8298
+)
+
+// JPEG markers
+const (
+	jpegMarkerSOI   = 0xD8
+	jpegMarkerSOS   = 0xDA
+	jpegMarkerAPP0  = 0xE0
+	jpegMarkerAPP1  = 0xE1
+	jpegMarkerAPP2  = 0xE2
+	jpegMarkerAPP14 = 0xEE
+	jpegMarkerAPP15 = 0xEF
+	jpegMarkerCOM   = 0xFE
+)
+
+var (
+	exifHeader       = []byte("Exif\x00\x00")
+	iccHeader        = []byte("ICC_PROFILE\x00")
+	pngSignature     = []byte("\x89PNG\r\n\x1a\n")
+	errMalformedJPEG = errors.New("JPEG is malformed")
+	errMalformedPNG  = errors.New("PNG is malformed")
+)
+
+// NormalizeOptions represents image normalization policy.
+type NormalizeOptions struct {
+	AutoRotate     bool `json:"autoRotate"`
+	StripMetadata  bool `json:"stripMetadata"`
+	KeepCopyright  bool `json:"keepCopyright"`
+	KeepICCProfile bool `json:"keepICCProfile"`
+}
+
+// Enabled reports whether any normalization is required.
+func (o NormalizeOptions) Enabled() bool {
+	return o.AutoRotate || o.StripMetadata
+}
+
+// NormalizeImage rotates image due to EXIF orientation & strips EXIF/XMP/IPTC metadata.
+// Only JPEG & PNG are normalized, other images are returned as is.
+func NormalizeImage(data []byte, mimeType string, opts NormalizeOptions) ([]byte, error) {
+	if !opts.Enabled() {
+		return data, nil
+	}
+
+	// Orientation is patched in place, so don't touch input
+	data = append([]byte{}, data...)
+
+	switch mimeType {
+	case MIMEImageJPEG:
+		return normalizeJPEG(data, opts)
+	case MIMEImagePNG:
+		return normalizePNG(data, opts)
+	}
+	return data, nil
+}
+
+// jpegSegment represents JPEG marker segment with its payload (without length).
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+func (s jpegSegment) isMetadata() bool {
+	return (s.marker >= jpegMarkerAPP0 && s.marker <= jpegMarkerAPP15) || s.marker == jpegMarkerCOM
+}
+
+func (s jpegSegment) isExif() bool {
+	return s.marker == jpegMarkerAPP1 && bytes.HasPrefix(s.payload, exifHeader)
+}
+
+func (s jpegSegment) isICC() bool {
+	return s.marker == jpegMarkerAPP2 && bytes.HasPrefix(s.payload, iccHeader)
+}
+
+// splitJPEG returns JPEG segments preceding scan & the rest of data starting from SOS segment.
+func splitJPEG(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegMarkerSOI {
+		return nil, nil, errMalformedJPEG
+	}
+
+	var segments []jpegSegment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, nil, errMalformedJPEG
+		}
+		marker := data[pos+1]
+		// Skip fill bytes
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == jpegMarkerSOS {
+			return segments, data[pos:], nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, nil, errMalformedJPEG
+		}
+		segments = append(segments, jpegSegment{marker, data[pos+4 : pos+2+length]})
+		pos += 2 + length
+	}
+
+	return nil, nil, errMalformedJPEG
+}
+
+// joinJPEG assembles JPEG from segments & scan data
+func joinJPEG(segments []jpegSegment, scan []byte) []byte {
+	buf := bytes.NewBuffer([]byte{0xFF, jpegMarkerSOI})
+	for _, s := range segments {
+		buf.Write([]byte{0xFF, s.marker})
+		binary.Write(buf, binary.BigEndian, uint16(len(s.payload)+2))
+		buf.Write(s.payload)
+	}
+	buf.Write(scan)
+	return buf.Bytes()
+}
+
+func normalizeJPEG(data []byte, opts NormalizeOptions) ([]byte, error) {
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata, header []jpegSegment
+	var exif *tiffData
+	for _, s := range segments {
+		if s.isMetadata() {
+			metadata = append(metadata, s)
+		} else {
+			header = append(header, s)
+		}
+		if s.isExif() && exif == nil {
+			exif, _ = parseTIFF(s.payload[len(exifHeader):])
+		}
+	}
+
+	// Rotate pixels & take new header & scan from re-encoded image
+	if orientation := exif.orientation(); opts.AutoRotate && orientation > 1 {
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(nil)
+		if err = jpeg.Encode(buf, applyOrientation(img, orientation), &jpeg.Options{Quality: ResizeJpegQuality}); err != nil {
+			return nil, err
+		}
+		if header, scan, err = splitJPEG(buf.Bytes()); err != nil {
+			return nil, err
+		}
+		exif.setOrientation(1)
+	}
+
+	// Filter metadata segments
+	var kept []jpegSegment
+	for _, s := range metadata {
+		switch {
+		case !opts.StripMetadata:
+			kept = append(kept, s)
+		case s.marker == jpegMarkerAPP0 && bytes.HasPrefix(s.payload, []byte("JFIF\x00")):
+			kept = append(kept, s)
+		case s.isICC() && opts.KeepICCProfile:
+			kept = append(kept, s)
+		case s.marker == jpegMarkerAPP14:
+			// Adobe segment defines color transform & isn't a metadata
+			kept = append(kept, s)
+		}
+	}
+	if copyright := exif.copyright(); opts.StripMetadata && opts.KeepCopyright && copyright != "" {
+		kept = append(kept, jpegSegment{jpegMarkerAPP1, append(append([]byte{}, exifHeader...), copyrightTIFF(copyright)...)})
+	}
+
+	return joinJPEG(append(kept, header...), scan), nil
+}
+
+// pngChunk represents PNG chunk without length & CRC.
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+func splitPNG(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errMalformedPNG
+	}
+
+	var chunks []pngChunk
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			return nil, errMalformedPNG
+		}
+		chunk := pngChunk{string(data[pos+4 : pos+8]), data[pos+8 : pos+8+length]}
+		chunks = append(chunks, chunk)
+		pos += 12 + length
+		if chunk.kind == "IEND" {
+			return chunks, nil
+		}
+	}
+
+	return nil, errMalformedPNG
+}
+
+func joinPNG(chunks []pngChunk) []byte {
+	buf := bytes.NewBuffer(append([]byte{}, pngSignature...))
+	for _, c := range chunks {
+		binary.Write(buf, binary.BigEndian, uint32(len(c.data)))
+		crc := crc32.NewIEEE()
+		crc.Write([]byte(c.kind))
+		crc.Write(c.data)
+		buf.WriteString(c.kind)
+		buf.Write(c.data)
+		binary.Write(buf, binary.BigEndian, crc.Sum32())
+	}
+	return buf.Bytes()
+}
+
+// isPNGImageChunk reports whether chunk depends on pixels format & must be taken from re-encoded image
+func isPNGImageChunk(kind string) bool {
+	switch kind {
+	case "IHDR", "PLTE", "tRNS", "IDAT", "IEND", "bKGD", "hIST", "sBIT", "sPLT":
+		return true
+	}
+	return false
+}
+
+func normalizePNG(data []byte, opts NormalizeOptions) ([]byte, error) {
+	chunks, err := splitPNG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var exif *tiffData
+	for _, c := range chunks {
+		if c.kind == "eXIf" {
+			exif, _ = parseTIFF(c.data)
+		}
+	}
+
+	// Rotate pixels & take image chunks from re-encoded image
+	if orientation := exif.orientation(); opts.AutoRotate && orientation > 1 {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(nil)
+		if err = png.Encode(buf, applyOrientation(img, orientation)); err != nil {
+			return nil, err
+		}
+		rotated, err := splitPNG(buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		exif.setOrientation(1)
+
+		// Ancillary chunks go after IHDR
+		var merged []pngChunk
+		for _, c := range rotated {
+			if c.kind == "IEND" {
+				continue
+			}
+			merged = append(merged, c)
+			if c.kind == "IHDR" {
+				for _, a := range chunks {
+					if !isPNGImageChunk(a.kind) {
+						merged = append(merged, a)
+					}
+				}
+			}
+		}
+		chunks = append(merged, pngChunk{"IEND", nil})
+	}
+
+	if !opts.StripMetadata {
+		return joinPNG(chunks), nil
+	}
+
+	var kept []pngChunk
+	for _, c := range chunks {
+		switch c.kind {
+		case "eXIf", "zTXt":
+			continue
+		case "iCCP":
+			if !opts.KeepICCProfile {
+				continue
+			}
+		case "tEXt", "iTXt":
+			if !opts.KeepCopyright || !bytes.HasPrefix(c.data, []byte("Copyright\x00")) {
+				continue
+			}
+		}
+		kept = append(kept, c)
+	}
+
+	return joinPNG(kept), nil
+}
+
+// tiffData represents TIFF structure of EXIF with parsed IFD0 entries offsets.
+type tiffData struct {
+	data    []byte
+	order   binary.ByteOrder
+	entries map[uint16]int
+}
+
+// parseTIFF parses IFD0 of EXIF TIFF structure
+func parseTIFF(data []byte) (*tiffData, error) {
+	if len(data) < 8 {
+		return nil, errors.New("EXIF is malformed")
+	}
+
+	td := &tiffData{data: data, entries: map[uint16]int{}}
+	switch string(data[:2]) {
+	case "II":
+		td.order = binary.LittleEndian
+	case "MM":
+		td.order = binary.BigEndian
+	default:
+		return nil, errors.New("EXIF byte order is unknown")
+	}
+
+	offset := int(td.order.Uint32(data[4:]))
+	if offset+2 > len(data) {
+		return nil, errors.New("EXIF is malformed")
+	}
+	count := int(td.order.Uint16(data[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(data) {
+			break
+		}
+		td.entries[td.order.Uint16(data[entry:])] = entry
+	}
+
+	return td, nil
+}
+
+// orientation returns EXIF orientation or 0 if it isn't presented
+func (td *tiffData) orientation() int {
+	if td == nil {
+		return 0
+	}
+	entry, ok := td.entries[exifTagOrientation]
+	if !ok {
+		return 0
+	}
+	orientation := int(td.order.Uint16(td.data[entry+8:]))
+	if orientation > 8 {
+		return 0
+	}
+	return orientation
+}
+
+// setOrientation patches orientation value in place
+func (td *tiffData) setOrientation(orientation int) {
+	if entry, ok := td.entries[exifTagOrientation]; ok {
+		td.order.PutUint16(td.data[entry+8:], uint16(orientation))
+	}
+}
+
+// copyright returns EXIF copyright or empty string if it isn't presented
+func (td *tiffData) copyright() string {
+	if td == nil {
+		return ""
+	}
+	entry, ok := td.entries[exifTagCopyright]
+	if !ok {
+		return ""
+	}
+
+	count := int(td.order.Uint32(td.data[entry+4:]))
+	start := entry + 8
+	if count > 4 {
+		start = int(td.order.Uint32(td.data[entry+8:]))
+	}
+	if count == 0 || start+count > len(td.data) {
+		return ""
+	}
+	return string(bytes.TrimRight(td.data[start:start+count], "\x00"))
+}
+
+// copyrightTIFF returns minimal EXIF TIFF structure with copyright tag only
+func copyrightTIFF(copyright string) []byte {
+	value := append([]byte(copyright), 0)
+	buf := bytes.NewBuffer([]byte("MM\x00\x2A"))
+	binary.Write(buf, binary.BigEndian, uint32(8)) // IFD0 offset
+	binary.Write(buf, binary.BigEndian, uint16(1)) // Entries count
+	binary.Write(buf, binary.BigEndian, uint16(exifTagCopyright))
+	binary.Write(buf, binary.BigEndian, uint16(2)) // ASCII type
+	binary.Write(buf, binary.BigEndian, uint32(len(value)))
+	if len(value) <= 4 {
+		buf.Write(append(value, make([]byte, 4-len(value))...))
+		binary.Write(buf, binary.BigEndian, uint32(0)) // Next IFD offset
+		return buf.Bytes()
+	}
+	binary.Write(buf, binary.BigEndian, uint32(26)) // Value offset right after IFD0
+	binary.Write(buf, binary.BigEndian, uint32(0))  // Next IFD offset
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// applyOrientation transforms image due to EXIF orientation, so it's displayed upright
+func applyOrientation(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5-8 swap width & height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.Set(x, y, color.NRGBAModel.Convert(src.At(b.Min.X+sx, b.Min.Y+sy)))
+		}
+	}
+
+	return dst
+}
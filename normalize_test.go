@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testExif returns EXIF APP1 payload with orientation & copyright tags
+func testExif(orientation int, copyright string) []byte {
+	value := append([]byte(copyright), 0)
+	buf := bytes.NewBuffer(append([]byte{}, exifHeader...))
+	buf.WriteString("II\x2A\x00")
+	binary.Write(buf, binary.LittleEndian, uint32(8))
+	binary.Write(buf, binary.LittleEndian, uint16(2))
+	binary.Write(buf, binary.LittleEndian, []uint16{exifTagOrientation, 3})
+	binary.Write(buf, binary.LittleEndian, []uint32{1, uint32(orientation)})
+	binary.Write(buf, binary.LittleEndian, []uint16{exifTagCopyright, 2})
+	binary.Write(buf, binary.LittleEndian, []uint32{uint32(len(value)), 38})
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// testJPEG returns JPEG of given size with EXIF & XMP segments
+func testJPEG(width int, height int, exif []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil)
+	segments, scan, _ := splitJPEG(buf.Bytes())
+	metadata := []jpegSegment{
+		{jpegMarkerAPP1, exif},
+		{jpegMarkerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")},
+	}
+	return joinJPEG(append(metadata, segments...), scan)
+}
+
+func TestNormalizeJPEG(t *testing.T) {
+	data := testJPEG(40, 20, testExif(6, "ACME"))
+
+	// Rotate & strip all but copyright
+	result, err := NormalizeImage(data, MIMEImageJPEG, NormalizeOptions{AutoRotate: true, StripMetadata: true, KeepCopyright: true})
+	assert.Nil(t, err)
+	config, err := jpeg.DecodeConfig(bytes.NewReader(result))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, config.Width)
+	assert.Equal(t, 40, config.Height)
+	assert.NotContains(t, string(result), "xmpmeta")
+
+	segments, _, err := splitJPEG(result)
+	assert.Nil(t, err)
+	exif, err := parseTIFF(segments[0].payload[len(exifHeader):])
+	assert.Nil(t, err)
+	assert.Equal(t, "ACME", exif.copyright())
+	assert.Equal(t, 0, exif.orientation())
+
+	// Rotate & keep metadata with reset orientation
+	result, err = NormalizeImage(data, MIMEImageJPEG, NormalizeOptions{AutoRotate: true})
+	assert.Nil(t, err)
+	assert.Contains(t, string(result), "xmpmeta")
+	segments, _, err = splitJPEG(result)
+	assert.Nil(t, err)
+	exif, err = parseTIFF(segments[0].payload[len(exifHeader):])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, exif.orientation())
+
+	// Input isn't modified
+	assert.Equal(t, testJPEG(40, 20, testExif(6, "ACME")), data)
+}
+
+func TestNormalizePNG(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 4, 2)))
+	chunks, err := splitPNG(buf.Bytes())
+	assert.Nil(t, err)
+	chunks = append([]pngChunk{chunks[0],
+		{"tEXt", []byte("Copyright\x00ACME")},
+		{"tEXt", []byte("Comment\x00GPS 0,0")},
+		{"eXIf", testExif(8, "ACME")[len(exifHeader):]},
+	}, chunks[1:]...)
+
+	result, err := NormalizeImage(joinPNG(chunks), MIMEImagePNG, NormalizeOptions{AutoRotate: true, StripMetadata: true, KeepCopyright: true})
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(result))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 2, 4), img.Bounds())
+	assert.Contains(t, string(result), "Copyright")
+	assert.NotContains(t, string(result), "GPS")
+	assert.NotContains(t, string(result), "eXIf")
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 2x1 image: red, blue
+	red := color.NRGBA{255, 0, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	cases := []struct {
+		orientation int
+		bounds      image.Rectangle
+		first       color.NRGBA
+	}{
+		{1, image.Rect(0, 0, 2, 1), red},
+		{2, image.Rect(0, 0, 2, 1), blue},
+		{3, image.Rect(0, 0, 2, 1), blue},
+		{6, image.Rect(0, 0, 1, 2), red},
+		{8, image.Rect(0, 0, 1, 2), blue},
+	}
+
+	for _, c := range cases {
+		dst := applyOrientation(src, c.orientation)
+		assert.Equal(t, c.bounds, dst.Bounds(), c.orientation)
+		assert.Equal(t, c.first, dst.At(0, 0), c.orientation)
+	}
+}
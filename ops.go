@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Pipeline limits
+const (
+	MaxOperations           = 10
+	MaxBlurSigma            = 20
+	DefaultOperationsBudget = 10
+)
+
+// Operation names
+const (
+	OpCrop      = "crop"
+	OpResize    = "resize"
+	OpRotate    = "rotate"
+	OpBlur      = "blur"
+	OpGrayscale = "grayscale"
+)
+
+// Costs of operations to limit pipelines per bucket
+var operationCosts = map[string]int{
+	OpCrop:      1,
+	OpResize:    2,
+	OpRotate:    2,
+	OpBlur:      4,
+	OpGrayscale: 1,
+}
+
+// Operation represents single image transform of pipeline.
+type Operation interface {
+	// Name returns operation name.
+	Name() string
+	// String returns canonical form of operation.
+	String() string
+	// Apply transforms image & returns result with zero origin.
+	Apply(img *image.NRGBA) (*image.NRGBA, error)
+}
+
+// Pipeline represents ordered chain of operations.
+type Pipeline []Operation
+
+// ParsePipeline parses operations chain, f.ex. "crop:0,0,800,600|resize:400|rotate:90|blur:3|grayscale".
+// Pipeline is normalized: no-op operations are dropped & consecutive rotations are merged.
+// Enlarge makes resize operations enlarge images.
+func ParsePipeline(input string, enlarge bool) (Pipeline, error) {
+	if input == "" {
+		return nil, nil
+	}
+
+	var pipeline Pipeline
+	for _, item := range strings.Split(input, "|") {
+		op, err := parseOperation(strings.TrimSpace(item), enlarge)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = pipeline.append(op)
+	}
+
+	if len(pipeline) > MaxOperations {
+		return nil, fmt.Errorf("Pipeline exceeds %d operations", MaxOperations)
+	}
+	return pipeline, nil
+}
+
+func parseOperation(item string, enlarge bool) (Operation, error) {
+	parts := strings.Split(item, ":")
+	name := strings.ToLower(parts[0])
+	args := parts[1:]
+
+	invalid := func() (Operation, error) {
+		return nil, errors.New("Operation " + item + " is invalid")
+	}
+
+	switch name {
+	case OpCrop:
+		if len(args) != 1 {
+			return invalid()
+		}
+		values, err := parseInts(args[0], 4)
+		if err != nil || values[0] < 0 || values[1] < 0 || values[2] <= 0 || values[3] <= 0 {
+			return invalid()
+		}
+		return &CropOp{image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3])}, nil
+	case OpResize:
+		if len(args) == 0 {
+			return invalid()
+		}
+		dimensions, err := PrepareDimensions(args[0])
+		if err != nil || len(dimensions) == 0 {
+			return invalid()
+		}
+		if err := validateMaxDimensions(dimensions); err != nil {
+			return nil, err
+		}
+		op := &ResizeOp{Width: dimensions[0], Enlarge: enlarge}
+		if len(dimensions) == 2 {
+			op.Height = dimensions[1]
+		}
+		for _, flag := range args[1:] {
+			switch flag {
+			case "enlarge":
+				op.Enlarge = true
+			case "fill":
+				op.Fill = true
+			default:
+				return invalid()
+			}
+		}
+		if op.Fill && op.Height == 0 {
+			return invalid()
+		}
+		return op, nil
+	case OpRotate:
+		if len(args) != 1 {
+			return invalid()
+		}
+		angle, err := strconv.Atoi(args[0])
+		if err != nil || angle%90 != 0 {
+			return invalid()
+		}
+		return &RotateOp{(angle%360 + 360) % 360}, nil
+	case OpBlur:
+		if len(args) != 1 {
+			return invalid()
+		}
+		sigma, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || sigma <= 0 || sigma > MaxBlurSigma {
+			return invalid()
+		}
+		return &BlurOp{sigma}, nil
+	case OpGrayscale:
+		if len(args) != 0 {
+			return invalid()
+		}
+		return &GrayscaleOp{}, nil
+	}
+
+	return nil, errors.New("Unknown operation " + name)
+}
+
+func parseInts(input string, count int) ([]int, error) {
+	parts := strings.Split(input, ",")
+	if len(parts) != count {
+		return nil, errors.New("Wrong number of arguments")
+	}
+	values := make([]int, count)
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// append appends operation normalizing pipeline
+func (p Pipeline) append(op Operation) Pipeline {
+	if len(p) > 0 {
+		last := p[len(p)-1]
+		switch op := op.(type) {
+		case *RotateOp:
+			if lastRotate, ok := last.(*RotateOp); ok {
+				lastRotate.Angle = (lastRotate.Angle + op.Angle) % 360
+				if lastRotate.Angle == 0 {
+					return p[:len(p)-1]
+				}
+				return p
+			}
+		case *GrayscaleOp:
+			if _, ok := last.(*GrayscaleOp); ok {
+				return p
+			}
+		}
+	}
+	if rotate, ok := op.(*RotateOp); ok && rotate.Angle == 0 {
+		return p
+	}
+	return append(p, op)
+}
+
+// String returns canonical form of pipeline, it's suitable as a cache key.
+func (p Pipeline) String() string {
+	items := make([]string, len(p))
+	for i, op := range p {
+		items[i] = op.String()
+	}
+	return strings.Join(items, "|")
+}
+
+// Cost returns total cost of operations.
+func (p Pipeline) Cost() int {
+	cost := 0
+	for _, op := range p {
+		cost += operationCosts[op.Name()]
+	}
+	return cost
+}
+
+// Apply applies operations one by one.
+func (p Pipeline) Apply(img *image.NRGBA) (*image.NRGBA, error) {
+	var err error
+	for _, op := range p {
+		if img, err = op.Apply(img); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// CropOp crops rectangle, it's clipped by image bounds.
+type CropOp struct {
+	Rect image.Rectangle
+}
+
+// Name returns operation name.
+func (op *CropOp) Name() string { return OpCrop }
+
+// String returns canonical form of operation.
+func (op *CropOp) String() string {
+	return fmt.Sprintf("crop:%d,%d,%d,%d", op.Rect.Min.X, op.Rect.Min.Y, op.Rect.Dx(), op.Rect.Dy())
+}
+
+// Apply crops image.
+func (op *CropOp) Apply(img *image.NRGBA) (*image.NRGBA, error) {
+	rect := op.Rect.Add(img.Bounds().Min).Intersect(img.Bounds())
+	if rect.Empty() {
+		return nil, errors.New("Crop area is out of image")
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst, nil
+}
+
+// ResizeOp fits image into width & optional height keeping aspect ratio.
+// Fill mode covers both dimensions & crops the rest around center.
+type ResizeOp struct {
+	Width   int
+	Height  int
+	Fill    bool
+	Enlarge bool
+}
+
+// Name returns operation name.
+func (op *ResizeOp) Name() string { return OpResize }
+
+// String returns canonical form of operation.
+func (op *ResizeOp) String() string {
+	s := "resize:" + strconv.Itoa(op.Width)
+	if op.Height > 0 {
+		s += "x" + strconv.Itoa(op.Height)
+	}
+	if op.Fill {
+		s += ":fill"
+	}
+	if op.Enlarge {
+		s += ":enlarge"
+	}
+	return s
+}
+
+// Apply resizes image.
+func (op *ResizeOp) Apply(img *image.NRGBA) (*image.NRGBA, error) {
+	if op.Fill {
+		return op.fill(img)
+	}
+
+	dimensions := []int{op.Width}
+	if op.Height > 0 {
+		dimensions = append(dimensions, op.Height)
+	}
+	bounds := img.Bounds()
+	width, height := fitDimensions(bounds.Dx(), bounds.Dy(), dimensions, op.Enlarge)
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img, nil
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, xdraw.Src, nil)
+	return dst, nil
+}
+
+// fill scales image to cover requested size & crops it around center
+func (op *ResizeOp) fill(img *image.NRGBA) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	scale := math.Max(float64(op.Width)/float64(bounds.Dx()), float64(op.Height)/float64(bounds.Dy()))
+	width, height := op.Width, op.Height
+	if scale > 1 && !op.Enlarge {
+		// Crop only, image isn't enlarged
+		scale = 1
+		width, height = minInt(width, bounds.Dx()), minInt(height, bounds.Dy())
+	}
+
+	scaledWidth := maxInt(width, int(math.Round(float64(bounds.Dx())*scale)))
+	scaledHeight := maxInt(height, int(math.Round(float64(bounds.Dy())*scale)))
+	scaled := img
+	if scaledWidth != bounds.Dx() || scaledHeight != bounds.Dy() {
+		scaled = image.NewNRGBA(image.Rect(0, 0, scaledWidth, scaledHeight))
+		xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, xdraw.Src, nil)
+	}
+
+	crop := &CropOp{image.Rect(0, 0, width, height).Add(image.Pt((scaledWidth-width)/2, (scaledHeight-height)/2))}
+	return crop.Apply(scaled)
+}
+
+// ScaleOp scales image to exact size ignoring aspect ratio.
+// It isn't available in query pipelines, but it's limited as resizing.
+type ScaleOp struct {
+	Width  int
+	Height int
+}
+
+// Name returns operation name.
+func (op *ScaleOp) Name() string { return OpResize }
+
+// String returns canonical form of operation.
+func (op *ScaleOp) String() string {
+	return "resize:" + strconv.Itoa(op.Width) + "x" + strconv.Itoa(op.Height) + ":exact"
+}
+
+// Apply scales image.
+func (op *ScaleOp) Apply(img *image.NRGBA) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	if op.Width == bounds.Dx() && op.Height == bounds.Dy() {
+		return img, nil
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, op.Width, op.Height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, xdraw.Src, nil)
+	return dst, nil
+}
+
+// RotateOp rotates image clockwise by multiple of 90 degrees.
+type RotateOp struct {
+	Angle int
+}
+
+// Name returns operation name.
+func (op *RotateOp) Name() string { return OpRotate }
+
+// String returns canonical form of operation.
+func (op *RotateOp) String() string { return "rotate:" + strconv.Itoa(op.Angle) }
+
+// Apply rotates image reusing EXIF orientation transforms.
+func (op *RotateOp) Apply(img *image.NRGBA) (*image.NRGBA, error) {
+	orientations := map[int]int{0: 1, 90: 6, 180: 3, 270: 8}
+	return applyOrientation(img, orientations[op.Angle]).(*image.NRGBA), nil
+}
+
+// BlurOp applies gaussian blur.
+type BlurOp struct {
+	Sigma float64
+}
+
+// Name returns operation name.
+func (op *BlurOp) Name() string { return OpBlur }
+
+// String returns canonical form of operation.
+func (op *BlurOp) String() string { return "blur:" + strconv.FormatFloat(op.Sigma, 'f', -1, 64) }
+
+// Apply blurs image with separable gaussian kernel, edges are clamped.
+func (op *BlurOp) Apply(img *image.NRGBA) (*image.NRGBA, error) {
+	radius := int(math.Ceil(3 * op.Sigma))
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * op.Sigma * op.Sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	tmp := image.NewNRGBA(src.Bounds())
+	dst := image.NewNRGBA(src.Bounds())
+	blurPass(src, tmp, kernel, 1, 0)
+	blurPass(tmp, dst, kernel, 0, 1)
+	return dst, nil
+}
+
+// blurPass convolves premultiplied pixels with kernel along given direction
+func blurPass(src *image.NRGBA, dst *image.NRGBA, kernel []float64, dx int, dy int) {
+	radius := len(kernel) / 2
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a float64
+			for k, weight := range kernel {
+				sx := clampInt(x+(k-radius)*dx, 0, width-1)
+				sy := clampInt(y+(k-radius)*dy, 0, height-1)
+				i := src.PixOffset(sx, sy)
+				alpha := float64(src.Pix[i+3]) * weight
+				r += float64(src.Pix[i]) * alpha
+				g += float64(src.Pix[i+1]) * alpha
+				b += float64(src.Pix[i+2]) * alpha
+				a += alpha
+			}
+			i := dst.PixOffset(x, y)
+			if a > 0 {
+				dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = uint8(r/a+0.5), uint8(g/a+0.5), uint8(b/a+0.5)
+			}
+			dst.Pix[i+3] = uint8(a + 0.5)
+		}
+	}
+}
+
+// GrayscaleOp converts image to grayscale keeping transparency.
+type GrayscaleOp struct{}
+
+// Name returns operation name.
+func (op *GrayscaleOp) Name() string { return OpGrayscale }
+
+// String returns canonical form of operation.
+func (op *GrayscaleOp) String() string { return OpGrayscale }
+
+// Apply converts image to grayscale.
+func (op *GrayscaleOp) Apply(img *image.NRGBA) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := img.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			gray := color.GrayModel.Convert(color.RGBA{c.R, c.G, c.B, 0xff}).(color.Gray).Y
+			dst.SetNRGBA(x, y, color.NRGBA{gray, gray, gray, c.A})
+		}
+	}
+	return dst, nil
+}
+
+func clampInt(value int, min int, max int) int {
+	return minInt(maxInt(value, min), max)
+}
+
+// AllowsPipeline validates pipeline against bucket allowlist & cost budget.
+func (p *BucketPolicy) AllowsPipeline(pipeline Pipeline) error {
+	for _, op := range pipeline {
+		if len(p.Operations) > 0 && !contains(p.Operations, op.Name(), "") {
+			return errors.New("Operation " + op.Name() + " isn't allowed in this bucket")
+		}
+	}
+
+	budget := p.OperationsBudget
+	if budget == 0 {
+		budget = DefaultOperationsBudget
+	}
+	if cost := pipeline.Cost(); cost > budget {
+		return fmt.Errorf("Pipeline cost %d exceeds budget %d", cost, budget)
+	}
+	return nil
+}
+
+// applyPipeline applies request operations to JPEG or PNG image in one pass.
+// GIFs are transformed frame by frame on resizing, see ResizeGIF.
+func applyPipeline(reqCtx context.Context, ctx *AppContext, input io.Reader, mimeType string) (io.Reader, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startSpan(reqCtx, "image.pipeline", attribute.String("image.operations", ctx.Pipeline.String()))
+	start := time.Now()
+	data, err = TransformStill(data, mimeType, jpegQuality(ctx.Options), ctx.Pipeline.Apply)
+	observeResize(ResizerNative, start, err != nil)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// TransformStill decodes JPEG or PNG image, transforms it & encodes it back.
+// EXIF orientation is applied beforehand, because metadata doesn't survive re-encoding.
+func TransformStill(data []byte, mimeType string, quality int, transform func(*image.NRGBA) (*image.NRGBA, error)) ([]byte, error) {
+	if mimeType != MIMEImageJPEG && mimeType != MIMEImagePNG {
+		return nil, fmt.Errorf("Transforms aren't supported for %s", mimeType)
+	}
+
+	img, err := decodeStill(data, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	if img, err = transform(img); err != nil {
+		return nil, err
+	}
+	return encodeStill(img, mimeType, quality)
+}
+
+// decodeStill decodes auto-rotated image, GIFs are decoded by the first frame
+func decodeStill(data []byte, mimeType string) (*image.NRGBA, error) {
+	data, err := NormalizeImage(data, mimeType, NormalizeOptions{AutoRotate: true})
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	return img, nil
+}
+
+// encodeStill encodes image as JPEG, PNG or lossless WebP
+func encodeStill(img *image.NRGBA, mimeType string, quality int) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	var err error
+	switch mimeType {
+	case MIMEImageJPEG:
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	case MIMEImagePNG:
+		err = png.Encode(buf, img)
+	case MIMEImageWebP:
+		return EncodeWebP(img), nil
+	default:
+		err = fmt.Errorf("Encoding isn't supported for %s", mimeType)
+	}
+	return buf.Bytes(), err
+}
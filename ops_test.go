@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePipeline(t *testing.T) {
+	cases := []struct {
+		input     string
+		enlarge   bool
+		canonical string
+		valid     bool
+	}{
+		{"", false, "", true},
+		{"crop:0,0,800,600|resize:400|rotate:90|blur:3|grayscale", false, "crop:0,0,800,600|resize:400|rotate:90|blur:3|grayscale", true},
+		{" Resize:400x300 | GRAYSCALE|grayscale", false, "resize:400x300|grayscale", true},
+		{"resize:400", true, "resize:400:enlarge", true},
+		{"resize:400:enlarge", false, "resize:400:enlarge", true},
+		{"resize:400x300:enlarge:fill", false, "resize:400x300:fill:enlarge", true},
+		{"resize:400:fill", false, "", false},
+		{"resize:400:crop", false, "", false},
+		{"rotate:90|rotate:180", false, "rotate:270", true},
+		{"rotate:-90|rotate:450", false, "", true},
+		{"rotate:0|blur:1.50", false, "blur:1.5", true},
+		{"crop:0,0,800", false, "", false},
+		{"crop:-1,0,800,600", false, "", false},
+		{"resize:5000", false, "", false},
+		{"resize", false, "", false},
+		{"rotate:45", false, "", false},
+		{"blur:0", false, "", false},
+		{"blur:21", false, "", false},
+		{"grayscale:1", false, "", false},
+		{"sharpen:1", false, "", false},
+		{"grayscale|blur:1|grayscale|blur:1|grayscale|blur:1|grayscale|blur:1|grayscale|blur:1|grayscale", false, "", false},
+	}
+
+	for _, c := range cases {
+		pipeline, err := ParsePipeline(c.input, c.enlarge)
+		assert.Equal(t, c.valid, err == nil, c.input)
+		if c.valid {
+			assert.Equal(t, c.canonical, pipeline.String(), c.input)
+
+			// Canonical form is stable
+			reparsed, err := ParsePipeline(c.canonical, false)
+			assert.Nil(t, err)
+			assert.Equal(t, c.canonical, reparsed.String())
+		}
+	}
+}
+
+func TestAllowsPipeline(t *testing.T) {
+	pipeline, _ := ParsePipeline("crop:0,0,10,10|resize:5|blur:2", false)
+	cases := []struct {
+		policy BucketPolicy
+		valid  bool
+	}{
+		{BucketPolicy{}, true},
+		{BucketPolicy{Operations: []string{OpCrop, OpResize, OpBlur}}, true},
+		{BucketPolicy{Operations: []string{OpCrop, OpResize}}, false},
+		{BucketPolicy{OperationsBudget: 7}, true},
+		{BucketPolicy{OperationsBudget: 6}, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.valid, c.policy.AllowsPipeline(pipeline) == nil, c.policy)
+	}
+}
+
+// testQuadrants returns 40x20 image with red, green, blue & white quadrants
+func testQuadrants() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	colors := []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+	for i, c := range colors {
+		rect := image.Rect(i%2*20, i/2*10, i%2*20+20, i/2*10+10)
+		draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	return img
+}
+
+func TestPipelineApply(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	green := color.NRGBA{0, 255, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+
+	cases := []struct {
+		input  string
+		size   image.Point
+		pixel  image.Point
+		expect color.NRGBA
+	}{
+		{"crop:20,0,20,10", image.Pt(20, 10), image.Pt(5, 5), green},
+		{"crop:30,15,100,100", image.Pt(10, 5), image.Pt(0, 0), color.NRGBA{255, 255, 255, 255}},
+		{"resize:20", image.Pt(20, 10), image.Pt(2, 2), red},
+		{"resize:80", image.Pt(40, 20), image.Pt(0, 0), red},
+		{"resize:80:enlarge", image.Pt(80, 40), image.Pt(70, 5), green},
+		{"resize:10x10:fill", image.Pt(10, 10), image.Pt(1, 1), red},
+		{"resize:20x20:fill", image.Pt(20, 20), image.Pt(15, 2), green},
+		{"resize:80x80:fill", image.Pt(40, 20), image.Pt(0, 0), red},
+		{"resize:80x80:fill:enlarge", image.Pt(80, 80), image.Pt(79, 0), green},
+		{"rotate:90", image.Pt(20, 40), image.Pt(2, 2), blue},
+		{"rotate:180", image.Pt(40, 20), image.Pt(2, 2), color.NRGBA{255, 255, 255, 255}},
+		{"rotate:270", image.Pt(20, 40), image.Pt(2, 2), green},
+		{"grayscale", image.Pt(40, 20), image.Pt(2, 2), color.NRGBA{76, 76, 76, 255}},
+		{"blur:1", image.Pt(40, 20), image.Pt(2, 2), red},
+		{"crop:0,0,20,20|rotate:90|grayscale", image.Pt(20, 20), image.Pt(15, 15), color.NRGBA{76, 76, 76, 255}},
+	}
+
+	for _, c := range cases {
+		pipeline, err := ParsePipeline(c.input, false)
+		assert.Nil(t, err)
+		img, err := pipeline.Apply(testQuadrants())
+		if !assert.Nil(t, err, c.input) {
+			continue
+		}
+		assert.Equal(t, image.Rectangle{Max: c.size}, img.Bounds(), c.input)
+		assert.Equal(t, c.expect, img.NRGBAAt(c.pixel.X, c.pixel.Y), c.input)
+	}
+
+	// Blur mixes colors on edges
+	pipeline, _ := ParsePipeline("blur:3", false)
+	img, _ := pipeline.Apply(testQuadrants())
+	edge := img.NRGBAAt(19, 2)
+	assert.True(t, edge.R > 0 && edge.G > 0, edge)
+
+	// Crop out of image
+	pipeline, _ = ParsePipeline("crop:100,100,10,10", false)
+	_, err := pipeline.Apply(testQuadrants())
+	assert.NotNil(t, err)
+}
+
+func TestTransformStill(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	png.Encode(buf, testQuadrants())
+	pipeline, _ := ParsePipeline("crop:20,10,20,10|resize:10", false)
+
+	data, err := TransformStill(buf.Bytes(), MIMEImagePNG, ResizeJpegQuality, pipeline.Apply)
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 10, 5), img.Bounds())
+}
+
+func TestResizeGIFWithPipeline(t *testing.T) {
+	pipeline, _ := ParsePipeline("rotate:90|grayscale", false)
+	result, err := ResizeGIF(testAnimatedGIF(), GIFOptions{Pipeline: pipeline})
+	assert.Nil(t, err)
+	g, err := gif.DecodeAll(bytes.NewReader(result))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, g.Config.Width)
+	assert.Equal(t, 40, g.Config.Height)
+	assert.Len(t, g.Image, 3)
+
+	r, gr, b, _ := g.Image[1].At(10, 5).RGBA()
+	assert.True(t, r == gr && gr == b)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Perceptual hash sizes
+const (
+	hashSize     = 8  // Hashes are 8x8 bits
+	pHashDCTSize = 32 // pHash is computed by DCT of 32x32 image
+)
+
+// Object metadata keys of perceptual hashes
+const (
+	MetadataAHash = "Ahash"
+	MetadataDHash = "Dhash"
+	MetadataPHash = "Phash"
+)
+
+// ImageHashes represents perceptual hashes of image in hex.
+// Hashes of resized & re-encoded copies differ by few bits, see HammingDistance.
+// swagger:model imageHashes
+type ImageHashes struct {
+	AHash string `json:"ahash"` // Average hash
+	DHash string `json:"dhash"` // Difference hash
+	PHash string `json:"phash"` // DCT hash, it's used for similarity search
+}
+
+// NewImageHashes computes perceptual hashes of image.
+func NewImageHashes(img *image.NRGBA) *ImageHashes {
+	return &ImageHashes{
+		AHash: formatHash(averageHash(img)),
+		DHash: formatHash(differenceHash(img)),
+		PHash: formatHash(perceptualHash(img)),
+	}
+}
+
+// Metadata returns hashes as object metadata.
+func (h *ImageHashes) Metadata() map[string]string {
+	return map[string]string{
+		MetadataAHash: h.AHash,
+		MetadataDHash: h.DHash,
+		MetadataPHash: h.PHash,
+	}
+}
+
+// HashesFromMetadata returns hashes from object metadata or nil if they weren't computed.
+func HashesFromMetadata(metadata http.Header) *ImageHashes {
+	get := func(key string) string {
+		return metadata.Get("X-Amz-Meta-" + key)
+	}
+	if get(MetadataPHash) == "" {
+		return nil
+	}
+	return &ImageHashes{AHash: get(MetadataAHash), DHash: get(MetadataDHash), PHash: get(MetadataPHash)}
+}
+
+// HammingDistance returns number of different bits of hashes.
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func formatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseHash parses hash in hex.
+func ParseHash(hash string) (uint64, error) {
+	return strconv.ParseUint(hash, 16, 64)
+}
+
+// grayscale scales image to given size ignoring aspect ratio & returns luma of pixels by rows
+func grayscale(img *image.NRGBA, width int, height int) []float64 {
+	scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.BiLinear.Scale(scaled, scaled.Bounds(), img, img.Bounds(), xdraw.Src, nil)
+
+	luma := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := scaled.NRGBAAt(x, y)
+			luma[y*width+x] = float64(color.GrayModel.Convert(color.RGBA{c.R, c.G, c.B, 0xff}).(color.Gray).Y)
+		}
+	}
+	return luma
+}
+
+// averageHash sets bits of pixels brighter than average
+func averageHash(img *image.NRGBA) uint64 {
+	luma := grayscale(img, hashSize, hashSize)
+	mean := 0.0
+	for _, value := range luma {
+		mean += value
+	}
+	mean /= float64(len(luma))
+
+	var hash uint64
+	for i, value := range luma {
+		if value > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// differenceHash sets bits of pixels brighter than their right neighbours
+func differenceHash(img *image.NRGBA) uint64 {
+	luma := grayscale(img, hashSize+1, hashSize)
+
+	var hash uint64
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			if luma[y*(hashSize+1)+x] > luma[y*(hashSize+1)+x+1] {
+				hash |= 1 << uint(y*hashSize+x)
+			}
+		}
+	}
+	return hash
+}
+
+// perceptualHash sets bits of low frequency DCT coefficients greater than their median
+func perceptualHash(img *image.NRGBA) uint64 {
+	luma := grayscale(img, pHashDCTSize, pHashDCTSize)
+
+	var cosines [hashSize][pHashDCTSize]float64
+	for u := 0; u < hashSize; u++ {
+		for x := 0; x < pHashDCTSize; x++ {
+			cosines[u][x] = math.Cos(float64((2*x+1)*u) * math.Pi / (2 * pHashDCTSize))
+		}
+	}
+
+	coefficients := make([]float64, 0, hashSize*hashSize)
+	for v := 0; v < hashSize; v++ {
+		for u := 0; u < hashSize; u++ {
+			sum := 0.0
+			for y := 0; y < pHashDCTSize; y++ {
+				for x := 0; x < pHashDCTSize; x++ {
+					sum += luma[y*pHashDCTSize+x] * cosines[u][x] * cosines[v][y]
+				}
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+
+	// DC coefficient is excluded from median as it represents average brightness only
+	sorted := append([]float64{}, coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, value := range coefficients {
+		if value > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
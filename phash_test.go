@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	xdraw "golang.org/x/image/draw"
+)
+
+// testScene returns image with circles on gradient, mirrored image is flipped horizontally
+func testScene(width int, height int, mirrored bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+			if mirrored {
+				fx = 1 - fx
+			}
+			c := color.NRGBA{uint8(255 * fx), uint8(255 * fy), uint8(128 + 127*math.Sin(fx*6)), 255}
+			for i := 0; i < 3; i++ {
+				cx, cy := 0.2+0.3*float64(i), 0.3+0.2*float64(i%3)
+				if math.Hypot(fx-cx, fy-cy) < 0.12 {
+					c = color.NRGBA{uint8(80 * i), 40, uint8(200 - 60*i), 255}
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func testReencode(t *testing.T, img *image.NRGBA, width int, height int, quality int) *image.NRGBA {
+	scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, img.Bounds(), xdraw.Src, nil)
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, jpeg.Encode(buf, scaled, &jpeg.Options{Quality: quality}))
+	decoded, err := decodeStill(buf.Bytes(), MIMEImageJPEG)
+	assert.Nil(t, err)
+	return decoded
+}
+
+func TestHammingDistance(t *testing.T) {
+	assert.Equal(t, 0, HammingDistance(0xff, 0xff))
+	assert.Equal(t, 8, HammingDistance(0xff, 0))
+	assert.Equal(t, 64, HammingDistance(math.MaxUint64, 0))
+}
+
+func TestImageHashes(t *testing.T) {
+	original := testScene(400, 300, false)
+	hashes := NewImageHashes(original)
+	assert.Regexp(t, "^[0-9a-f]{16}$", hashes.AHash)
+	assert.Regexp(t, "^[0-9a-f]{16}$", hashes.DHash)
+	assert.Regexp(t, "^[0-9a-f]{16}$", hashes.PHash)
+	assert.Equal(t, hashes, NewImageHashes(original))
+
+	distance := func(a *ImageHashes, b *ImageHashes) [3]int {
+		var d [3]int
+		for i, pair := range [][2]string{{a.AHash, b.AHash}, {a.DHash, b.DHash}, {a.PHash, b.PHash}} {
+			x, err := ParseHash(pair[0])
+			assert.Nil(t, err)
+			y, err := ParseHash(pair[1])
+			assert.Nil(t, err)
+			d[i] = HammingDistance(x, y)
+		}
+		return d
+	}
+
+	// Resized & re-encoded copies are near-duplicates
+	for _, copy := range []*image.NRGBA{
+		testReencode(t, original, 400, 300, 50),
+		testReencode(t, original, 160, 120, 80),
+		testReencode(t, original, 1000, 750, 30),
+		testReencode(t, original, 300, 300, 75),
+	} {
+		for _, d := range distance(hashes, NewImageHashes(copy)) {
+			assert.True(t, d <= DefaultSimilarityDistance/2, d)
+		}
+	}
+
+	// Other images aren't by pHash used for search
+	d := distance(hashes, NewImageHashes(testScene(400, 300, true)))
+	assert.True(t, d[2] > 2*DefaultSimilarityDistance, d)
+}
+
+func TestHashesMetadata(t *testing.T) {
+	hashes := NewImageHashes(testQuadrants())
+	header := http.Header{}
+	for key, value := range hashes.Metadata() {
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+	assert.Equal(t, hashes, HashesFromMetadata(header))
+	assert.Nil(t, HashesFromMetadata(http.Header{}))
+}
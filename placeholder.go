@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Placeholder defaults
+const (
+	PlaceholderPreviewSize = 16 // In px, the longest side of preview
+	PlaceholderSampleSize  = 32 // In px, the longest side of image sample for BlurHash & colors
+	BlurHashComponentsX    = 4
+	BlurHashComponentsY    = 3
+	MaxPreviewMetadata     = 1536 // S3 limits user metadata by 2KB
+)
+
+// Object metadata keys of placeholders
+const (
+	MetadataWidth         = "Width"
+	MetadataHeight        = "Height"
+	MetadataBlurHash      = "Blurhash"
+	MetadataDominantColor = "Dominant-Color"
+	MetadataAverageColor  = "Average-Color"
+	MetadataPreview       = "Preview"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Placeholder represents low-quality placeholders shown before image is loaded
+// swagger:model placeholder
+type Placeholder struct {
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	BlurHash      string `json:"blurhash"`
+	DominantColor string `json:"dominantColor"`
+	AverageColor  string `json:"averageColor"`
+	Preview       string `json:"preview,omitempty"` // Data URI of tiny PNG
+}
+
+// ComputePlaceholder returns placeholders of JPEG, PNG or GIF (by the first frame) image.
+func ComputePlaceholder(data []byte, mimeType string) (*Placeholder, error) {
+	img, err := decodeAnalyzable(data, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	return NewPlaceholder(img)
+}
+
+// NewPlaceholder returns placeholders of decoded image.
+func NewPlaceholder(img *image.NRGBA) (*Placeholder, error) {
+	bounds := img.Bounds()
+	sample := thumbnail(img, PlaceholderSampleSize)
+	preview := bytes.NewBuffer(nil)
+	if err := png.Encode(preview, thumbnail(img, PlaceholderPreviewSize)); err != nil {
+		return nil, err
+	}
+
+	return &Placeholder{
+		Width:         bounds.Dx(),
+		Height:        bounds.Dy(),
+		BlurHash:      EncodeBlurHash(sample, BlurHashComponentsX, BlurHashComponentsY),
+		DominantColor: hexColor(dominantColor(sample)),
+		AverageColor:  hexColor(averageColor(sample)),
+		Preview:       "data:" + MIMEImagePNG + ";base64," + base64.StdEncoding.EncodeToString(preview.Bytes()),
+	}, nil
+}
+
+// decodeAnalyzable decodes JPEG, PNG or GIF (the first frame) image
+func decodeAnalyzable(data []byte, mimeType string) (*image.NRGBA, error) {
+	if mimeType != MIMEImageJPEG && mimeType != MIMEImagePNG && mimeType != MIMEImageGIF {
+		return nil, fmt.Errorf("Image analysis isn't supported for %s", mimeType)
+	}
+	return decodeStill(data, mimeType)
+}
+
+// ImageAnalysis represents placeholders & perceptual hashes of uploaded image
+type ImageAnalysis struct {
+	Placeholder *Placeholder
+	Hashes      *ImageHashes
+}
+
+// Metadata returns analysis results as object metadata.
+func (a *ImageAnalysis) Metadata() map[string]string {
+	metadata := map[string]string{}
+	if a.Placeholder != nil {
+		for key, value := range a.Placeholder.Metadata() {
+			metadata[key] = value
+		}
+	}
+	if a.Hashes != nil {
+		for key, value := range a.Hashes.Metadata() {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// analyzeImage computes enabled placeholders & hashes of uploaded image decoded once,
+// failures are reported by span only
+func analyzeImage(reqCtx context.Context, cfg *Config, data []byte, mimeType string) (*ImageAnalysis, error) {
+	analysis := &ImageAnalysis{}
+	if !cfg.PlaceholdersEnabled && !cfg.SimilarityEnabled {
+		return analysis, nil
+	}
+
+	_, span := startSpan(reqCtx, "image.analyze")
+	img, err := decodeAnalyzable(data, mimeType)
+	if err == nil && cfg.PlaceholdersEnabled {
+		analysis.Placeholder, err = NewPlaceholder(img)
+	}
+	if err == nil && cfg.SimilarityEnabled {
+		analysis.Hashes = NewImageHashes(img)
+	}
+	endSpan(span, err)
+	return analysis, err
+}
+
+// Metadata returns placeholders as object metadata, too large preview is omitted.
+func (p *Placeholder) Metadata() map[string]string {
+	metadata := map[string]string{
+		MetadataWidth:         strconv.Itoa(p.Width),
+		MetadataHeight:        strconv.Itoa(p.Height),
+		MetadataBlurHash:      p.BlurHash,
+		MetadataDominantColor: p.DominantColor,
+		MetadataAverageColor:  p.AverageColor,
+	}
+	if len(p.Preview) <= MaxPreviewMetadata {
+		metadata[MetadataPreview] = p.Preview
+	}
+	return metadata
+}
+
+// PlaceholderFromMetadata returns placeholders from object metadata or nil if they weren't computed.
+func PlaceholderFromMetadata(metadata http.Header) *Placeholder {
+	get := func(key string) string {
+		return metadata.Get("X-Amz-Meta-" + key)
+	}
+	if get(MetadataBlurHash) == "" {
+		return nil
+	}
+
+	p := &Placeholder{
+		BlurHash:      get(MetadataBlurHash),
+		DominantColor: get(MetadataDominantColor),
+		AverageColor:  get(MetadataAverageColor),
+		Preview:       get(MetadataPreview),
+	}
+	p.Width, _ = strconv.Atoi(get(MetadataWidth))
+	p.Height, _ = strconv.Atoi(get(MetadataHeight))
+	return p
+}
+
+// thumbnail scales image down to fit into size
+func thumbnail(img *image.NRGBA, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	width, height := fitDimensions(bounds.Dx(), bounds.Dy(), []int{size, size}, false)
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.BiLinear.Scale(dst, dst.Bounds(), img, bounds, xdraw.Src, nil)
+	return dst
+}
+
+// EncodeBlurHash encodes image into BlurHash with given number of components.
+// See https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+func EncodeBlurHash(img *image.NRGBA, componentsX int, componentsY int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Linear RGB of pixels is computed once
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := img.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			linear[y*width+x] = [3]float64{sRGBToLinear(c.R), sRGBToLinear(c.G), sRGBToLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					for k := range factor {
+						factor[k] += basis * linear[y*width+x][k]
+					}
+				}
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	hash := encodeBase83((componentsX-1)+(componentsY-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, factor := range ac {
+			for _, value := range factor {
+				actualMax = math.Max(actualMax, math.Abs(value))
+			}
+		}
+		quantisedMax := clampInt(int(math.Floor(actualMax*166-0.5)), 0, 82)
+		maximumValue = float64(quantisedMax+1) / 166
+		hash += encodeBase83(quantisedMax, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+
+	hash += encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, factor := range ac {
+		quantised := 0
+		for _, value := range factor {
+			quantised = quantised*19 + clampInt(int(math.Floor(signPow(value/maximumValue, 0.5)*9+9.5)), 0, 18)
+		}
+		hash += encodeBase83(quantised, 2)
+	}
+	return hash
+}
+
+func encodeBase83(value int, length int) string {
+	var sb strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+	return sb.String()
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+// averageColor returns average color of visible pixels
+func averageColor(img *image.NRGBA) color.NRGBA {
+	var sum [3]int
+	count := 0
+	forVisiblePixels(img, func(c color.NRGBA) {
+		sum[0], sum[1], sum[2] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B)
+		count++
+	})
+	if count == 0 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{uint8(sum[0] / count), uint8(sum[1] / count), uint8(sum[2] / count), 0xff}
+}
+
+// dominantColor returns average color of the most populated bucket of visible pixels.
+// Buckets are formed by 4 high bits of channels.
+func dominantColor(img *image.NRGBA) color.NRGBA {
+	type bucket struct {
+		sum   [3]int
+		count int
+	}
+	buckets := map[int]*bucket{}
+	forVisiblePixels(img, func(c color.NRGBA) {
+		key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{}
+			buckets[key] = b
+		}
+		b.sum[0], b.sum[1], b.sum[2] = b.sum[0]+int(c.R), b.sum[1]+int(c.G), b.sum[2]+int(c.B)
+		b.count++
+	})
+	if len(buckets) == 0 {
+		return color.NRGBA{}
+	}
+
+	keys := make([]int, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if buckets[keys[a]].count != buckets[keys[b]].count {
+			return buckets[keys[a]].count > buckets[keys[b]].count
+		}
+		return keys[a] < keys[b]
+	})
+	b := buckets[keys[0]]
+	return color.NRGBA{uint8(b.sum[0] / b.count), uint8(b.sum[1] / b.count), uint8(b.sum[2] / b.count), 0xff}
+}
+
+// forVisiblePixels calls fn for pixels which aren't mostly transparent
+func forVisiblePixels(img *image.NRGBA, fn func(color.NRGBA)) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if c := img.NRGBAAt(x, y); c.A >= 0x80 {
+				fn(c)
+			}
+		}
+	}
+}
+
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeBase83(t *testing.T) {
+	assert.Equal(t, "0", encodeBase83(0, 1))
+	assert.Equal(t, "~", encodeBase83(82, 1))
+	assert.Equal(t, "10", encodeBase83(83, 2))
+	assert.Equal(t, "0000", encodeBase83(0, 4))
+}
+
+func TestEncodeBlurHash(t *testing.T) {
+	red := EncodeBlurHash(testQuadrants().SubImage(image.Rect(0, 0, 20, 10)).(*image.NRGBA), 4, 3)
+	// Size flag, max AC value, DC & 11 AC components
+	assert.Len(t, red, 1+1+4+11*2)
+	assert.Equal(t, "L", red[:1])
+	assert.Equal(t, encodeBase83(0xff0000, 4), red[2:6])
+
+	blurHash := EncodeBlurHash(testQuadrants().SubImage(image.Rect(0, 10, 20, 20)).(*image.NRGBA), 1, 1)
+	assert.Equal(t, "00"+encodeBase83(0x0000ff, 4), blurHash)
+
+	assert.NotEqual(t, red, EncodeBlurHash(testQuadrants(), 4, 3))
+	assert.Equal(t, EncodeBlurHash(testQuadrants(), 4, 3), EncodeBlurHash(testQuadrants(), 4, 3))
+}
+
+func TestImageColors(t *testing.T) {
+	img := testQuadrants().SubImage(image.Rect(0, 0, 4, 4)).(*image.NRGBA)
+	img.SetNRGBA(0, 0, color.NRGBA{0, 0, 255, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 250, 255})
+	img.SetNRGBA(2, 0, color.NRGBA{0, 255, 0, 0})
+
+	assert.Equal(t, "#ff0000", hexColor(dominantColor(img)))
+	assert.Equal(t, "#dd0021", hexColor(averageColor(img)))
+
+	transparent := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	assert.Equal(t, "#000000", hexColor(dominantColor(transparent)))
+	assert.Equal(t, "#000000", hexColor(averageColor(transparent)))
+}
+
+func TestComputePlaceholder(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, png.Encode(buf, testQuadrants()))
+
+	placeholder, err := ComputePlaceholder(buf.Bytes(), MIMEImagePNG)
+	assert.Nil(t, err)
+	assert.Equal(t, 40, placeholder.Width)
+	assert.Equal(t, 20, placeholder.Height)
+	assert.Len(t, placeholder.BlurHash, 28)
+	assert.Regexp(t, "^#[0-9a-f]{6}$", placeholder.DominantColor)
+	assert.Regexp(t, "^#[0-9a-f]{6}$", placeholder.AverageColor)
+
+	// Preview fits into 16px
+	assert.True(t, strings.HasPrefix(placeholder.Preview, "data:image/png;base64,"))
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(placeholder.Preview, "data:image/png;base64,"))
+	assert.Nil(t, err)
+	preview, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(16, 8), preview.Bounds().Size())
+
+	_, err = ComputePlaceholder(buf.Bytes(), "application/pdf")
+	assert.NotNil(t, err)
+	_, err = ComputePlaceholder([]byte("garbage"), MIMEImagePNG)
+	assert.NotNil(t, err)
+}
+
+func TestPlaceholderMetadata(t *testing.T) {
+	// Noise is the worst case for preview size
+	random := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	random.Read(img.Pix)
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, png.Encode(buf, img))
+
+	placeholder, err := ComputePlaceholder(buf.Bytes(), MIMEImagePNG)
+	assert.Nil(t, err)
+
+	// Metadata is stored by S3 as X-Amz-Meta-* headers limited by 2KB
+	metadata := placeholder.Metadata()
+	header := http.Header{}
+	size := 0
+	for key, value := range metadata {
+		header.Set("X-Amz-Meta-"+key, value)
+		size += len(key) + len(value)
+	}
+	assert.True(t, size < 2048, size)
+	assert.Equal(t, placeholder, PlaceholderFromMetadata(header))
+
+	// Too large preview is omitted
+	placeholder.Preview = strings.Repeat("a", MaxPreviewMetadata+1)
+	_, ok := placeholder.Metadata()[MetadataPreview]
+	assert.False(t, ok)
+
+	assert.Nil(t, PlaceholderFromMetadata(http.Header{}))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit classes
+const (
+	RateClassUpload    = "upload"
+	RateClassDownload  = "download"
+	RateClassTransform = "transform"
+)
+
+// RateLimitCleanupInterval is a period of evicting idle token buckets from memory
+const RateLimitCleanupInterval = time.Minute
+
+// RateLimit represents token bucket limit: rate of tokens per second & bucket capacity.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitStore keeps token buckets state.
+// Implement it to share state between app instances, f.ex. in Redis.
+type RateLimitStore interface {
+	// Take takes token from bucket with given key.
+	// Returns false & time to wait for next token if bucket is empty.
+	Take(key string, limit RateLimit, now time.Time) (bool, time.Duration, error)
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// MemoryRateLimitStore keeps token buckets in memory of single app instance.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	cleanedAt time.Time
+}
+
+// NewMemoryRateLimitStore returns new in-memory rate limit store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:   map[string]*tokenBucket{},
+		cleanedAt: time.Now(),
+	}
+}
+
+// Take refills bucket due to elapsed time & takes token from it.
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.cleanedAt) > RateLimitCleanupInterval {
+		s.cleanup(now)
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.updatedAt).Seconds()
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+elapsed*limit.Rate)
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false, refillDuration(1-bucket.tokens, limit.Rate), nil
+	}
+
+	bucket.tokens--
+	bucket.fullAt = now.Add(refillDuration(float64(limit.Burst)-bucket.tokens, limit.Rate))
+	return true, 0, nil
+}
+
+func refillDuration(tokens float64, rate float64) time.Duration {
+	return time.Duration(tokens / rate * float64(time.Second))
+}
+
+// cleanup evicts already refilled buckets, they're same as new ones
+func (s *MemoryRateLimitStore) cleanup(now time.Time) {
+	for key, bucket := range s.buckets {
+		if now.After(bucket.fullAt) {
+			delete(s.buckets, key)
+		}
+	}
+	s.cleanedAt = now
+}
+
+// RateLimiter limits requests per client by classes.
+type RateLimiter struct {
+	store          RateLimitStore
+	limits         map[string]RateLimit
+	trustedProxies []*net.IPNet
+}
+
+// NewRateLimiter returns new rate limiter. Classes without limits aren't limited.
+func NewRateLimiter(store RateLimitStore, limits map[string]RateLimit, trustedProxies []string) (*RateLimiter, error) {
+	rl := &RateLimiter{store: store, limits: limits}
+	for _, proxy := range trustedProxies {
+		// Single IPs are allowed as well as CIDRs
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		rl.trustedProxies = append(rl.trustedProxies, ipNet)
+	}
+	return rl, nil
+}
+
+// initRateLimiter returns rate limiter due to config or nil if rate limiting is disabled
+func initRateLimiter(cfg *Config) (*RateLimiter, error) {
+	limits := map[string]RateLimit{}
+	addLimit := func(class string, rate float64, burst int) {
+		if rate > 0 {
+			limits[class] = RateLimit{Rate: rate, Burst: burst}
+		}
+	}
+	addLimit(RateClassUpload, cfg.RateLimitUploadRate, cfg.RateLimitUploadBurst)
+	addLimit(RateClassDownload, cfg.RateLimitDownloadRate, cfg.RateLimitDownloadBurst)
+	addLimit(RateClassTransform, cfg.RateLimitTransformRate, cfg.RateLimitTransformBurst)
+
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	return NewRateLimiter(NewMemoryRateLimitStore(), limits, cfg.TrustedProxies)
+}
+
+// Allow reports whether client of request may proceed within class limit
+// & returns time to wait otherwise.
+func (rl *RateLimiter) Allow(r *http.Request, class string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+
+	limit, ok := rl.limits[class]
+	if !ok {
+		return true, 0
+	}
+
+	allowed, wait, err := rl.store.Take(class+":"+rl.ClientKey(r), limit, time.Now())
+	if err != nil {
+		// Don't block clients if shared store is unavailable
+		log.Println("Rate limit store failed:", err)
+		return true, 0
+	}
+
+	return allowed, wait
+}
+
+// ClientKey returns API key (principal) name for authenticated requests or client IP.
+func (rl *RateLimiter) ClientKey(r *http.Request) string {
+	if principal := PrincipalFromRequest(r); principal != nil {
+		return "principal:" + principal.Name
+	}
+	return "ip:" + rl.ClientIP(r)
+}
+
+// ClientIP returns client IP respecting X-Forwarded-For header from trusted proxies only.
+func (rl *RateLimiter) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !rl.isTrusted(host) {
+		return host
+	}
+
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded == "" {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+		return host
+	}
+
+	// Walk from the nearest hop & stop on first untrusted one
+	hops := strings.Split(forwarded, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !rl.isTrusted(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+func (rl *RateLimiter) isTrusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range rl.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitMW is a wrapper to provide appContext to rate limit middleware.
+type RateLimitMW struct {
+	ctx *AppContext
+}
+
+// Middleware for RateLimitMW limits uploads & downloads per client.
+// Transforms are limited separately by download handler on actual resizing.
+func (rmw *RateLimitMW) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var class string
+		switch routeName(r) {
+		case "upload", "delete":
+			class = RateClassUpload
+		case "download", "info", "srcset", "similar", "iiif.info", "iiif.image":
+			class = RateClassDownload
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowed, wait := rmw.ctx.RateLimiter.Allow(r, class); !allowed {
+			renderRateLimited(w, wait)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// renderRateLimited responds with 429 & time to wait in seconds
+func renderRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	renderJSONError(w, errors.New("Too many requests"), "RATE_LIMIT_EXCEEDED", http.StatusTooManyRequests)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Rate: 1, Burst: 2}
+	now := time.Now()
+
+	allowed, _, _ := store.Take("a", limit, now)
+	assert.True(t, allowed)
+	allowed, _, _ = store.Take("a", limit, now)
+	assert.True(t, allowed)
+	allowed, wait, _ := store.Take("a", limit, now)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	// Other keys have their own buckets
+	allowed, _, _ = store.Take("b", limit, now)
+	assert.True(t, allowed)
+
+	// Bucket is refilled with time
+	allowed, _, _ = store.Take("a", limit, now.Add(time.Second))
+	assert.True(t, allowed)
+}
+
+func TestClientIP(t *testing.T) {
+	rl, err := NewRateLimiter(NewMemoryRateLimitStore(), nil, []string{"10.0.0.0/8", "192.168.1.1"})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		{"1.2.3.4:1000", "", "", "1.2.3.4"},
+		{"1.2.3.4:1000", "5.6.7.8", "", "1.2.3.4"},
+		{"10.0.0.1:1000", "5.6.7.8", "", "5.6.7.8"},
+		{"10.0.0.1:1000", "9.9.9.9, 5.6.7.8, 192.168.1.1", "", "5.6.7.8"},
+		{"10.0.0.1:1000", "", "5.6.7.8", "5.6.7.8"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if c.realIP != "" {
+			req.Header.Set("X-Real-IP", c.realIP)
+		}
+		assert.Equal(t, c.expected, rl.ClientIP(req), c)
+	}
+}
+
+func TestRateLimitMW(t *testing.T) {
+	rl, err := NewRateLimiter(NewMemoryRateLimitStore(), map[string]RateLimit{
+		RateClassUpload: {Rate: 0.5, Burst: 1},
+	}, nil)
+	assert.Nil(t, err)
+	router := InitRouter(&AppContext{Config: &Config{}, RateLimiter: rl})
+
+	// First upload fails on validation, but it consumes a token anyway
+	req, _ := http.NewRequest("POST", "/test", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.NotEqual(t, http.StatusTooManyRequests, rr.Code)
+
+	req, _ = http.NewRequest("POST", "/test", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+// Dependency check statuses
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// DependencyCheck represents single dependency probe.
+type DependencyCheck struct {
+	Name     string
+	Critical bool
+	Check    func(ctx context.Context) error
+}
+
+// DependencyStatus represents result of single dependency probe
+// swagger:model dependencyStatus
+type DependencyStatus struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Critical bool    `json:"critical"`
+	Latency  float64 `json:"latency"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// ReadinessReport represents app readiness with per-dependency statuses
+// swagger:model readinessReport
+type ReadinessReport struct {
+	Status       string             `json:"status"`
+	CheckedAt    time.Time          `json:"checkedAt"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// Readiness probes app dependencies & caches results
+// to prevent flooding dependencies by frequent orchestrator probes.
+type Readiness struct {
+	checks  []DependencyCheck
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	report *ReadinessReport
+}
+
+// NewReadiness returns new readiness prober.
+func NewReadiness(checks []DependencyCheck, timeout time.Duration, ttl time.Duration) *Readiness {
+	return &Readiness{
+		checks:  checks,
+		timeout: timeout,
+		ttl:     ttl,
+	}
+}
+
+// Report returns cached readiness report or probes dependencies if cache is expired.
+func (rd *Readiness) Report(ctx context.Context) *ReadinessReport {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if rd.report != nil && time.Since(rd.report.CheckedAt) < rd.ttl {
+		return rd.report
+	}
+
+	rd.report = rd.probe(ctx)
+	return rd.report
+}
+
+// probe runs all dependency checks concurrently
+func (rd *Readiness) probe(ctx context.Context) *ReadinessReport {
+	report := &ReadinessReport{
+		Status:       StatusOK,
+		CheckedAt:    time.Now(),
+		Dependencies: make([]DependencyStatus, len(rd.checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, check := range rd.checks {
+		wg.Add(1)
+		go func(i int, check DependencyCheck) {
+			defer wg.Done()
+			report.Dependencies[i] = rd.runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, dep := range report.Dependencies {
+		if dep.Critical && dep.Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+
+	return report
+}
+
+// runCheck runs single check, but waits no longer than timeout
+func (rd *Readiness) runCheck(ctx context.Context, check DependencyCheck) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, rd.timeout)
+	defer cancel()
+
+	start := time.Now()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- check.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+		err = fmt.Errorf("Check timed out after %v", rd.timeout)
+	}
+
+	status := DependencyStatus{
+		Name:     check.Name,
+		Status:   StatusOK,
+		Critical: check.Critical,
+		Latency:  toFixed(time.Since(start).Seconds(), 3),
+	}
+	if err != nil {
+		status.Status = StatusFail
+		status.Error = err.Error()
+	}
+
+	return status
+}
+
+// ReadinessHandler is a wrapper to provide appContext to readiness handler
+type ReadinessHandler struct {
+	ctx *AppContext
+}
+
+// ReadinessController handles app readiness checking
+func (rh *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /readyz readiness
+	// ---
+	// summary: Readiness check
+	// description: Probes storage & resizer dependencies. Results are cached for a short time.
+	// produces:
+	//   - application/json
+	// responses:
+	//   '200':
+	//     description: OK. All critical dependencies are available.
+	//     schema:
+	//       $ref: '#/definitions/readinessReport'
+	//   '503':
+	//     description: Service unavailable. Some of critical dependencies are unavailable.
+	//     schema:
+	//       $ref: '#/definitions/readinessReport'
+	report := rh.ctx.Readiness.Report(r.Context())
+
+	statusCode := http.StatusOK
+	if report.Status != StatusOK {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	body, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", MIMEApplicationJSON)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// LivenessController handles app liveness checking
+func LivenessController(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /livez liveness
+	// ---
+	// summary: Liveness check
+	// description: Returns OK while app is able to serve requests. Doesn't probe dependencies.
+	// produces:
+	//   - application/json
+	// responses:
+	//   '200':
+	//     description: OK.
+	w.Header().Set("Content-Type", MIMEApplicationJSON)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// readinessChecks returns dependency checks for app config
+func readinessChecks(cfg *Config, storage *minio.Client) []DependencyCheck {
+	checks := []DependencyCheck{
+		{Name: "storage", Critical: true, Check: storageCheck(storage, cfg.ReadinessBuckets)},
+	}
+
+	// Resizer is required only if resizing is enabled
+	if cfg.ResizeOnUpload || cfg.ResizeOnDownload {
+		checks = append(checks, DependencyCheck{
+			Name:     "resizer",
+			Critical: cfg.ReadinessResizerCritical,
+			Check:    imaginaryCheck(cfg.ImageServiceURL),
+		})
+	}
+
+	// Clamd is required to accept uploads for fail-closed scanning
+	if cfg.ScanClamdAddress != "" {
+		checks = append(checks, DependencyCheck{
+			Name:     "clamd",
+			Critical: !cfg.ScanFailOpen,
+			Check:    NewClamdScanner(cfg.ScanClamdAddress, cfg.ReadinessTimeout).Ping,
+		})
+	}
+
+	return checks
+}
+
+// storageCheck checks existence of given buckets or lists buckets if none are given
+func storageCheck(storage *minio.Client, buckets []string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if len(buckets) == 0 {
+			_, err := storage.ListBuckets()
+			return err
+		}
+
+		for _, bucket := range buckets {
+			exists, err := storage.BucketExists(bucket)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("Bucket %s doesn't exist", bucket)
+			}
+		}
+		return nil
+	}
+}
+
+// imaginaryCheck checks Imaginary health endpoint
+func imaginaryCheck(imageServiceURL string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/health", imageServiceURL), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Image Service responded unsuccessfully with status %v", resp.StatusCode)
+		}
+		return nil
+	}
+}
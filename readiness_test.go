@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func okCheck(ctx context.Context) error {
+	return nil
+}
+
+func failCheck(ctx context.Context) error {
+	return errors.New("Dependency is down")
+}
+
+func slowCheck(ctx context.Context) error {
+	time.Sleep(time.Second)
+	return nil
+}
+
+func TestReadinessHandler(t *testing.T) {
+	cases := []struct {
+		checks   []DependencyCheck
+		expected int
+	}{
+		{[]DependencyCheck{{"storage", true, okCheck}, {"resizer", true, okCheck}}, http.StatusOK},
+		{[]DependencyCheck{{"storage", true, okCheck}, {"resizer", false, failCheck}}, http.StatusOK},
+		{[]DependencyCheck{{"storage", true, failCheck}, {"resizer", true, okCheck}}, http.StatusServiceUnavailable},
+		{[]DependencyCheck{{"storage", true, slowCheck}}, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		appCtx := &AppContext{Readiness: NewReadiness(c.checks, 50*time.Millisecond, time.Minute)}
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		handler := &ReadinessHandler{appCtx}
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expected, rr.Code)
+	}
+}
+
+func TestReadinessReportIsCached(t *testing.T) {
+	calls := 0
+	check := func(ctx context.Context) error {
+		calls++
+		return nil
+	}
+
+	rd := NewReadiness([]DependencyCheck{{"storage", true, check}}, time.Second, time.Minute)
+	first := rd.Report(context.Background())
+	second := rd.Report(context.Background())
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, first, second)
+	assert.Equal(t, StatusOK, first.Dependencies[0].Status)
+}
@@ -2,16 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
+	"math"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const MaxResizeSize = 3000 // In px, same as f.ex. Uploadcare resize
 const ResizeJpegQuality = 92
+const MaxDPR = 3
 
 // ImageInfo represents image info.
 type ImageInfo struct {
@@ -20,73 +26,105 @@ type ImageInfo struct {
 }
 
 // ResizeImage resizes image.
-func ResizeImage(ctx *AppContext, input io.Reader, mimeType string) (io.Reader, error) {
-	var reqBody io.Reader
+// Returns ErrResizerUnavailable if Imaginary is down, overloaded or its circuit is open.
+func ResizeImage(reqCtx context.Context, ctx *AppContext, input io.Reader, mimeType string) (io.Reader, error) {
+	// Validate abnormal dimensions
+	err := validateMaxDimensions(ctx.Dimensions)
+	if err != nil {
+		return nil, err
+	}
+
+	// GIF resizing isn't supported in Imaginary, so it's done natively
+	if mimeType == MIMEImageGIF {
+		return resizeGIF(reqCtx, ctx, input)
+	}
 
 	// Skip if requested dimensions aren't presented
 	if len(ctx.Dimensions) == 0 {
 		return input, nil
 	}
 
-	// GIF resizing isn't supported in Imaginary, so skip it
-	if mimeType == MIMEImageGIF {
-		return input, nil
+	// We need to keep input to reuse it in requests & return it if image isn't resized
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
 	}
 
-	// Validate abnormal dimensions
-	err := validateMaxDimensions(ctx.Dimensions)
+	// Both info & thumbnail requests are made within the same slot
+	release, err := ctx.Resizer.acquire(reqCtx)
 	if err != nil {
 		return nil, err
 	}
-
-	// We need to duplicate stream to reuse it later in requests & returns on non-200
-	buf := bytes.NewBuffer(nil)
-	teeInput := io.TeeReader(input, buf)
+	defer release()
 
 	// Prevent extra request for info if `enlarge` option isn't presented
 	if !ctx.Options.Enlarge {
 		// Check image suitability for `enlarge` option
-		isSuitable, err := checkImageForEnlarge(&ctx.Config.ImageServiceURL, &teeInput, &mimeType, ctx.Dimensions)
+		isSuitable, err := checkImageForEnlarge(reqCtx, ctx.Resizer, data, mimeType, ctx.Dimensions)
+		if errors.Is(err, ErrResizerUnavailable) {
+			return nil, err
+		}
 		if !isSuitable || err != nil {
-			return buf, nil
+			return bytes.NewReader(data), nil
 		}
-		// Assign different readers for reqBody due to condition
-		reqBody = buf
-	} else {
-		reqBody = teeInput
 	}
 
 	// Prepare URL
 	resizeURL := fmt.Sprintf(
 		"http://%s/thumbnail?quality=%d&width=%d",
-		ctx.Config.ImageServiceURL, ResizeJpegQuality, ctx.Dimensions[0],
+		ctx.Resizer.URL, jpegQuality(ctx.Options), ctx.Dimensions[0],
 	)
 	if len(ctx.Dimensions) == 2 {
 		resizeURL += fmt.Sprintf("&height=%v", ctx.Dimensions[1])
 	}
 
 	// Post request
-	resp, err := http.Post(resizeURL, mimeType, reqBody)
-	// If Image Service isn't available return input
-	if err != nil || resp.StatusCode != http.StatusOK {
-		if resp != nil {
-			log.Printf("Image Service responded unsuccessfully with status %v", resp.StatusCode)
-		}
-		return input, nil
+	spanCtx, span := startSpan(reqCtx, "imaginary.thumbnail", attribute.String("imaginary.url", resizeURL))
+	start := time.Now()
+	result, err := ctx.Resizer.post(spanCtx, resizeURL, mimeType, data)
+	observeResize(ResizerImaginary, start, err != nil)
+	endSpan(span, err)
+	// Image rejected by Image Service is returned as is
+	if errors.Is(err, errResizerRejected) {
+		log.Println(err)
+		return bytes.NewReader(data), nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Copy response body to buffer for body closing in this scope
-	result := bytes.NewBuffer(nil)
-	if _, err = io.Copy(result, resp.Body); err != nil {
-		return input, err
+	return bytes.NewReader(result), nil
+}
+
+// jpegQuality returns requested JPEG quality or default one
+func jpegQuality(opts *Options) int {
+	if opts.Quality > 0 {
+		return opts.Quality
 	}
+	return ResizeJpegQuality
+}
 
-	// Always use defer after a succesful resource allocation
-	if resp != nil {
-		defer resp.Body.Close()
+// ApplyDPR multiplies dimensions by device pixel ratio.
+// Multiplied dimensions are clamped by MaxResizeSize keeping aspect ratio.
+func ApplyDPR(dimensions []int, dpr int) ([]int, error) {
+	if dpr <= 1 || len(dimensions) == 0 {
+		return dimensions, nil
+	}
+	if err := validateMaxDimensions(dimensions); err != nil {
+		return nil, err
 	}
 
-	return result, err
+	scale := float64(dpr)
+	for _, dimension := range dimensions {
+		if dimension > 0 {
+			scale = math.Min(scale, float64(MaxResizeSize)/float64(dimension))
+		}
+	}
+	result := make([]int, len(dimensions))
+	for i, dimension := range dimensions {
+		result[i] = minInt(MaxResizeSize, int(math.Round(float64(dimension)*scale)))
+	}
+	return result, nil
 }
 
 // Prevent resizing abnormal dimensions from user
@@ -114,8 +152,8 @@ func validateMaxDimensions(input []int) error {
 
 // Check image suitability for `enlarge` option
 // Don't enlarge if original image width/height is smaller than in required resize option
-func checkImageForEnlarge(imageServiceURL *string, input *io.Reader, mimeType *string, dimensions []int) (bool, error) {
-	imageInfo, err := getImageInfo(imageServiceURL, *input, mimeType)
+func checkImageForEnlarge(reqCtx context.Context, resizer *Resizer, data []byte, mimeType string, dimensions []int) (bool, error) {
+	imageInfo, err := getImageInfo(reqCtx, resizer, data, mimeType)
 	if err != nil {
 		return false, err
 	}
@@ -138,24 +176,17 @@ func checkImageForEnlarge(imageServiceURL *string, input *io.Reader, mimeType *s
 	return true, nil
 }
 
-func getImageInfo(imageServiceURL *string, input io.Reader, mimeType *string) (*ImageInfo, error) {
-	infoURL := fmt.Sprintf("http://%s/info", *imageServiceURL)
-	resp, err := http.Post(infoURL, *mimeType, input)
+func getImageInfo(reqCtx context.Context, resizer *Resizer, data []byte, mimeType string) (*ImageInfo, error) {
+	infoURL := fmt.Sprintf("http://%s/info", resizer.URL)
+	spanCtx, span := startSpan(reqCtx, "imaginary.info", attribute.String("imaginary.url", infoURL))
+	body, err := resizer.post(spanCtx, infoURL, mimeType, data)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Image Service responded unsuccessfully with status %v", resp.StatusCode)
-	}
-
-	// Always use defer after a succesful resource allocation
-	if resp != nil {
-		defer resp.Body.Close()
-	}
-
 	imageInfo := &ImageInfo{}
-	err = json.NewDecoder(resp.Body).Decode(imageInfo)
+	err = json.Unmarshal(body, imageInfo)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states, their values are exported as metric
+const (
+	CircuitClosed   = 0
+	CircuitHalfOpen = 1
+	CircuitOpen     = 2
+)
+
+// ErrResizerUnavailable is returned if resizer is down, overloaded or circuit is open
+var ErrResizerUnavailable = errors.New("Resizer is unavailable")
+
+// errCircuitOpen is returned by breaker rejecting requests
+var errCircuitOpen = errors.New("Circuit is open")
+
+// errResizerRejected is returned for images rejected by resizer, f.ex. unsupported ones
+var errResizerRejected = errors.New("Resizer rejected image")
+
+// CircuitBreaker stops requests to failing service after consecutive failures.
+// After cooldown a single probe request is allowed (half-open state), its result closes or opens circuit again.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker returns closed breaker opening after threshold of consecutive failures.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	resizerCircuitState.Set(CircuitClosed)
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow reports error if request isn't allowed, allowed request must be completed by Success, Failure or Cancel.
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return errCircuitOpen
+		}
+		cb.setState(CircuitHalfOpen)
+		fallthrough
+	case CircuitHalfOpen:
+		if cb.probing {
+			return errCircuitOpen
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// Success closes circuit.
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+	cb.probing = false
+	cb.setState(CircuitClosed)
+}
+
+// Failure opens circuit after threshold of consecutive failures or failed probe.
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	cb.probing = false
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.threshold {
+		cb.openedAt = time.Now()
+		cb.setState(CircuitOpen)
+	}
+}
+
+// Cancel completes request without result, f.ex. cancelled by client.
+func (cb *CircuitBreaker) Cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+}
+
+// State returns circuit state.
+func (cb *CircuitBreaker) State() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+func (cb *CircuitBreaker) setState(state int) {
+	if cb.state != state {
+		log.Printf("Resizer circuit state changed from %d to %d\n", cb.state, state)
+	}
+	cb.state = state
+	resizerCircuitState.Set(float64(state))
+}
+
+// Resizer is a client of Imaginary with timeouts, bounded number of in-flight resizes & circuit breaker.
+type Resizer struct {
+	URL          string
+	client       *http.Client
+	slots        chan struct{}
+	queueTimeout time.Duration
+	breaker      *CircuitBreaker
+}
+
+// NewResizer returns resizer due to config.
+func NewResizer(cfg *Config) *Resizer {
+	concurrency := cfg.ResizerConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Resizer{
+		URL:          cfg.ImageServiceURL,
+		client:       &http.Client{Timeout: cfg.ResizerTimeout},
+		slots:        make(chan struct{}, concurrency),
+		queueTimeout: cfg.ResizerQueueTimeout,
+		breaker:      NewCircuitBreaker(cfg.ResizerBreakerFailures, cfg.ResizerBreakerCooldown),
+	}
+}
+
+// acquire waits for free slot no longer than queue timeout & returns its release
+func (rs *Resizer) acquire(ctx context.Context) (func(), error) {
+	select {
+	case rs.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(rs.queueTimeout)
+		defer timer.Stop()
+		select {
+		case rs.slots <- struct{}{}:
+		case <-timer.C:
+			return nil, fmt.Errorf("%w: too many resizes in flight", ErrResizerUnavailable)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	resizeInFlight.Inc()
+	return func() {
+		resizeInFlight.Dec()
+		<-rs.slots
+	}, nil
+}
+
+// post posts image to resizer & returns response body.
+// Transport errors, timeouts & 5xx responses are failures of breaker, other responses are rejections of image.
+func (rs *Resizer) post(ctx context.Context, url string, mimeType string, data []byte) ([]byte, error) {
+	if err := rs.breaker.Allow(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrResizerUnavailable, err)
+	}
+
+	resp, err := postWithContext(ctx, rs.client, url, mimeType, bytes.NewReader(data))
+	var body []byte
+	if err == nil {
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+	}
+	switch {
+	case err != nil && ctx.Err() == context.Canceled:
+		rs.breaker.Cancel()
+		return nil, err
+	case err != nil:
+		rs.breaker.Failure()
+		return nil, fmt.Errorf("%w: %v", ErrResizerUnavailable, err)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		rs.breaker.Failure()
+		return nil, fmt.Errorf("%w: Image Service responded with status %v", ErrResizerUnavailable, resp.StatusCode)
+	}
+
+	rs.breaker.Success()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w with status %v", errResizerRejected, resp.StatusCode)
+	}
+	return body, nil
+}
+
+// resizeWithFallback resizes image & serves original if resizer is unavailable due to bucket policy.
+// Reports whether original is served.
+func resizeWithFallback(reqCtx context.Context, ctx *AppContext, policy *BucketPolicy, data []byte, mimeType string) (io.Reader, bool, error) {
+	result, err := ResizeImage(reqCtx, ctx, bytes.NewReader(data), mimeType)
+	if errors.Is(err, ErrResizerUnavailable) && *policy.ResizeFallback {
+		log.Println("RESIZER_UNAVAILABLE", err)
+		resizeFallbacks.Inc()
+		return bytes.NewReader(data), true, nil
+	}
+	return result, false, err
+}
+
+// renderResizeError responds with dedicated code if resizer is unavailable
+func renderResizeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrResizerUnavailable) {
+		renderError(w, err, "RESIZER_UNAVAILABLE", http.StatusServiceUnavailable)
+		return
+	}
+	renderError(w, err, "CANT_RESIZE_FILE", http.StatusInternalServerError)
+}
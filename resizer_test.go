@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker(2, 20*time.Millisecond)
+
+	// Circuit opens after consecutive failures only
+	assert.Nil(t, cb.Allow())
+	cb.Failure()
+	assert.Nil(t, cb.Allow())
+	cb.Success()
+	assert.Nil(t, cb.Allow())
+	cb.Failure()
+	assert.Nil(t, cb.Allow())
+	cb.Failure()
+	assert.Equal(t, CircuitOpen, cb.State())
+	assert.Equal(t, errCircuitOpen, cb.Allow())
+
+	// Single probe is allowed after cooldown, its failure opens circuit again
+	time.Sleep(30 * time.Millisecond)
+	assert.Nil(t, cb.Allow())
+	assert.Equal(t, CircuitHalfOpen, cb.State())
+	assert.Equal(t, errCircuitOpen, cb.Allow())
+	cb.Failure()
+	assert.Equal(t, CircuitOpen, cb.State())
+	assert.Equal(t, errCircuitOpen, cb.Allow())
+
+	// Cancelled probe allows another one, successful probe closes circuit
+	time.Sleep(30 * time.Millisecond)
+	assert.Nil(t, cb.Allow())
+	cb.Cancel()
+	assert.Nil(t, cb.Allow())
+	cb.Success()
+	assert.Equal(t, CircuitClosed, cb.State())
+	assert.Nil(t, cb.Allow())
+	assert.Nil(t, cb.Allow())
+}
+
+func TestResizerAcquire(t *testing.T) {
+	resizer := NewResizer(&Config{ResizerConcurrency: 1, ResizerQueueTimeout: 10 * time.Millisecond})
+
+	release, err := resizer.acquire(context.Background())
+	assert.Nil(t, err)
+	_, err = resizer.acquire(context.Background())
+	assert.True(t, errors.Is(err, ErrResizerUnavailable), err)
+
+	// Waiting resize gets released slot
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		release()
+	}()
+	resizer.queueTimeout = time.Second
+	release, err = resizer.acquire(context.Background())
+	assert.Nil(t, err)
+	release()
+}
+
+func TestResizeImageUnavailable(t *testing.T) {
+	var status int32 = http.StatusOK
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if strings.HasPrefix(r.URL.Path, "/slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte("resized"))
+	}))
+	defer server.Close()
+
+	cfg := &Config{
+		ImageServiceURL:        strings.TrimPrefix(server.URL, "http://"),
+		ResizerTimeout:         50 * time.Millisecond,
+		ResizerConcurrency:     1,
+		ResizerBreakerFailures: 2,
+		ResizerBreakerCooldown: time.Minute,
+	}
+	appCtx := &AppContext{Config: cfg, Resizer: NewResizer(cfg), Options: &Options{Enlarge: true}, Dimensions: []int{100}}
+	resize := func() (string, error) {
+		result, err := ResizeImage(context.Background(), appCtx, bytes.NewBufferString("image"), MIMEImageJPEG)
+		if err != nil {
+			return "", err
+		}
+		data, _ := ioutil.ReadAll(result)
+		return string(data), nil
+	}
+
+	data, err := resize()
+	assert.Nil(t, err)
+	assert.Equal(t, "resized", data)
+
+	// Rejected image is returned as is
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	data, err = resize()
+	assert.Nil(t, err)
+	assert.Equal(t, "image", data)
+
+	// Slow resizer times out
+	appCtx.Resizer.URL = strings.TrimPrefix(server.URL, "http://") + "/slow"
+	atomic.StoreInt32(&status, http.StatusOK)
+	_, err = resize()
+	assert.True(t, errors.Is(err, ErrResizerUnavailable), err)
+
+	// Circuit opens after failures & requests aren't made
+	appCtx.Resizer.URL = strings.TrimPrefix(server.URL, "http://")
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	_, err = resize()
+	assert.True(t, errors.Is(err, ErrResizerUnavailable), err)
+	made := atomic.LoadInt32(&requests)
+	_, err = resize()
+	assert.True(t, errors.Is(err, ErrResizerUnavailable), err)
+	assert.Equal(t, made, atomic.LoadInt32(&requests))
+
+	// Original is served due to bucket policy
+	fallback, noFallback := true, false
+	result, fellBack, err := resizeWithFallback(context.Background(), appCtx, &BucketPolicy{ResizeFallback: &fallback}, []byte("image"), MIMEImageJPEG)
+	assert.Nil(t, err)
+	assert.True(t, fellBack)
+	original, _ := ioutil.ReadAll(result)
+	assert.Equal(t, "image", string(original))
+	_, _, err = resizeWithFallback(context.Background(), appCtx, &BucketPolicy{ResizeFallback: &noFallback}, []byte("image"), MIMEImageJPEG)
+	assert.True(t, errors.Is(err, ErrResizerUnavailable), err)
+
+	rr := httptest.NewRecorder()
+	renderResizeError(rr, err)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
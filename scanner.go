@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+// Scanner names used as metric labels
+const (
+	ScannerClamd   = "clamd"
+	ScannerWebhook = "webhook"
+)
+
+// Scan results used as metric labels
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanFailed   = "error"
+)
+
+// clamdChunkSize is a size of INSTREAM chunks, it must be less than clamd StreamMaxLength
+const clamdChunkSize = 64 * 1024
+
+// ScanResult represents verdict of scanner
+type ScanResult struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature"` // Name of found malware
+	Scanner   string `json:"-"`
+}
+
+// Scanner scans uploaded files for malware.
+type Scanner interface {
+	// Scan returns verdict for given data or error if data wasn't scanned.
+	Scan(ctx context.Context, data []byte) (*ScanResult, error)
+	// Name returns scanner name for logs & metrics.
+	Name() string
+}
+
+// ClamdScanner scans data by ClamAV daemon using INSTREAM command.
+// See https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+type ClamdScanner struct {
+	Network string // "tcp" or "unix"
+	Address string
+	Timeout time.Duration
+}
+
+// NewClamdScanner returns clamd scanner for "host:port" or "unix:/path/to/clamd.sock" address.
+func NewClamdScanner(address string, timeout time.Duration) *ClamdScanner {
+	if strings.HasPrefix(address, "unix:") {
+		return &ClamdScanner{Network: "unix", Address: strings.TrimPrefix(address, "unix:"), Timeout: timeout}
+	}
+	return &ClamdScanner{Network: "tcp", Address: address, Timeout: timeout}
+}
+
+// Name returns scanner name.
+func (s *ClamdScanner) Name() string {
+	return ScannerClamd
+}
+
+// Scan streams data to clamd & parses its reply, f.ex. "stream: Eicar-Signature FOUND".
+func (s *ClamdScanner) Scan(ctx context.Context, data []byte) (*ScanResult, error) {
+	reply, err := s.command(ctx, "INSTREAM", func(conn net.Conn) error {
+		size := make([]byte, 4)
+		for start := 0; start < len(data); start += clamdChunkSize {
+			end := start + clamdChunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			binary.BigEndian.PutUint32(size, uint32(end-start))
+			if _, err := conn.Write(size); err != nil {
+				return err
+			}
+			if _, err := conn.Write(data[start:end]); err != nil {
+				return err
+			}
+		}
+		// Zero-length chunk terminates stream
+		_, err := conn.Write([]byte{0, 0, 0, 0})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return &ScanResult{Scanner: s.Name()}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND"), Scanner: s.Name()}, nil
+	default:
+		return nil, fmt.Errorf("Clamd responded with %q", reply)
+	}
+}
+
+// Ping checks clamd is available.
+func (s *ClamdScanner) Ping(ctx context.Context) error {
+	reply, err := s.command(ctx, "PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("Clamd responded with %q", reply)
+	}
+	return nil
+}
+
+// command sends null-terminated command with optional payload & returns null-terminated reply
+func (s *ClamdScanner) command(ctx context.Context, command string, payload func(net.Conn) error) (string, error) {
+	dialer := net.Dialer{Timeout: s.Timeout}
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	if _, err = conn.Write([]byte("z" + command + "\x00")); err != nil {
+		return "", err
+	}
+	if payload != nil {
+		if err = payload(conn); err != nil {
+			return "", err
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// WebhookScanner posts data to HTTP endpoint responding with ScanResult JSON.
+type WebhookScanner struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookScanner returns webhook scanner with given timeout.
+func NewWebhookScanner(url string, timeout time.Duration) *WebhookScanner {
+	return &WebhookScanner{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+// Name returns scanner name.
+func (s *WebhookScanner) Name() string {
+	return ScannerWebhook
+}
+
+// Scan posts data as application/octet-stream & expects {"infected": bool, "signature": string}.
+func (s *WebhookScanner) Scan(ctx context.Context, data []byte) (*ScanResult, error) {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Scanner responded unsuccessfully with status %v", resp.StatusCode)
+	}
+
+	result := &ScanResult{}
+	if err = json.Unmarshal(body, result); err != nil {
+		return nil, err
+	}
+	result.Scanner = s.Name()
+	return result, nil
+}
+
+// MultiScanner scans data by all scanners & returns the first infected verdict.
+type MultiScanner []Scanner
+
+// Name returns names of scanners.
+func (ms MultiScanner) Name() string {
+	names := make([]string, 0, len(ms))
+	for _, s := range ms {
+		names = append(names, s.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// Scan scans data by scanners in order, failure of any scanner fails scanning.
+func (ms MultiScanner) Scan(ctx context.Context, data []byte) (*ScanResult, error) {
+	result := &ScanResult{Scanner: ms.Name()}
+	for _, s := range ms {
+		var err error
+		if result, err = scanObserved(ctx, s, data); err != nil || result.Infected {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// scanObserved scans data with span & metrics of given scanner
+func scanObserved(ctx context.Context, s Scanner, data []byte) (*ScanResult, error) {
+	_, span := startSpan(ctx, "scan."+s.Name())
+	start := time.Now()
+	result, err := s.Scan(ctx, data)
+	endSpan(span, err)
+
+	verdict := ScanClean
+	if err != nil {
+		verdict = ScanFailed
+	} else if result.Infected {
+		verdict = ScanInfected
+	}
+	observeScan(s.Name(), verdict, start)
+	return result, err
+}
+
+// initScanner returns scanners due to config or nil if uploads aren't scanned
+func initScanner(cfg *Config) Scanner {
+	scanners := MultiScanner{}
+	if cfg.ScanClamdAddress != "" {
+		scanners = append(scanners, NewClamdScanner(cfg.ScanClamdAddress, cfg.ScanTimeout))
+	}
+	if cfg.ScanWebhookURL != "" {
+		scanners = append(scanners, NewWebhookScanner(cfg.ScanWebhookURL, cfg.ScanTimeout))
+	}
+	if len(scanners) == 0 {
+		return nil
+	}
+	return scanners
+}
+
+// ErrInfected is returned for uploads flagged by scanner
+var ErrInfected = errors.New("File is infected")
+
+// scanUpload scans uploaded data & copies infected one to quarantine bucket if configured.
+// Scanning failure is ignored for fail-open policy.
+func scanUpload(reqCtx context.Context, ctx *AppContext, bucketName string, data []byte, fileType string) error {
+	scanCtx, cancel := context.WithTimeout(reqCtx, ctx.Config.ScanTimeout)
+	defer cancel()
+
+	result, err := ctx.Scanner.Scan(scanCtx, data)
+	if err != nil {
+		if ctx.Config.ScanFailOpen {
+			log.Println("CANT_SCAN_FILE", err)
+			return nil
+		}
+		return err
+	}
+	if !result.Infected {
+		return nil
+	}
+
+	log.Printf("FILE_IS_INFECTED %s found by %s in upload to %s\n", result.Signature, result.Scanner, bucketName)
+	if ctx.Config.ScanQuarantineBucket != "" {
+		if err = quarantine(reqCtx, ctx, bucketName, data, fileType, result); err != nil {
+			log.Println("CANT_QUARANTINE_FILE", err)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrInfected, result.Signature)
+}
+
+// quarantine stores infected file to quarantine bucket under name of target bucket with scan verdict
+func quarantine(reqCtx context.Context, ctx *AppContext, bucketName string, data []byte, fileType string, result *ScanResult) error {
+	fileName, err := GenerateFileName(fileType)
+	if err != nil {
+		return err
+	}
+	objName := bucketName + "/" + fileName
+
+	quarantineBucket := ctx.Config.ScanQuarantineBucket
+	_, span := startSpan(reqCtx, "storage.put", storageAttributes(quarantineBucket, objName)...)
+	start := time.Now()
+	_, err = ctx.Storage.PutObject(quarantineBucket, objName, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: fileType,
+		UserMetadata: map[string]string{
+			"Scan-Signature": result.Signature,
+			"Scan-Scanner":   result.Scanner,
+		},
+	})
+	observeStorage(StorageOpPut, start, err)
+	endSpan(span, err)
+	return err
+}
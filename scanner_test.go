@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testEICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startFakeClamd serves PING & INSTREAM commands flagging data with EICAR test string
+func startFakeClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				command, err := reader.ReadString(0)
+				if err != nil {
+					return
+				}
+				switch command {
+				case "zPING\x00":
+					conn.Write([]byte("PONG\x00"))
+				case "zINSTREAM\x00":
+					data := bytes.NewBuffer(nil)
+					size := make([]byte, 4)
+					for {
+						if _, err := io.ReadFull(reader, size); err != nil {
+							return
+						}
+						n := binary.BigEndian.Uint32(size)
+						if n == 0 {
+							break
+						}
+						if _, err := io.CopyN(data, reader, int64(n)); err != nil {
+							return
+						}
+					}
+					if bytes.Contains(data.Bytes(), []byte(testEICAR)) {
+						conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					} else {
+						conn.Write([]byte("stream: OK\x00"))
+					}
+				default:
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	scanner := NewClamdScanner(startFakeClamd(t), time.Second)
+	assert.Equal(t, "tcp", scanner.Network)
+	assert.Nil(t, scanner.Ping(context.Background()))
+
+	// Data is streamed by chunks
+	clean := bytes.Repeat([]byte{0xff}, 3*clamdChunkSize+1)
+	result, err := scanner.Scan(context.Background(), clean)
+	assert.Nil(t, err)
+	assert.False(t, result.Infected)
+
+	infected := append(append([]byte{}, clean...), testEICAR...)
+	result, err = scanner.Scan(context.Background(), infected)
+	assert.Nil(t, err)
+	assert.True(t, result.Infected)
+	assert.Equal(t, "Eicar-Test-Signature", result.Signature)
+	assert.Equal(t, ScannerClamd, result.Scanner)
+
+	unix := NewClamdScanner("unix:/var/run/clamd.sock", time.Second)
+	assert.Equal(t, "unix", unix.Network)
+	assert.Equal(t, "/var/run/clamd.sock", unix.Address)
+
+	// Unavailable clamd
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listener.Close()
+	_, err = NewClamdScanner(listener.Addr().String(), time.Second).Scan(context.Background(), clean)
+	assert.NotNil(t, err)
+}
+
+func TestWebhookScanner(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := bytes.NewBuffer(nil)
+		io.Copy(body, r.Body)
+		switch {
+		case r.Header.Get("Content-Type") != "application/octet-stream":
+			w.WriteHeader(http.StatusBadRequest)
+		case body.String() == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case bytes.Contains(body.Bytes(), []byte(testEICAR)):
+			w.Write([]byte(`{"infected": true, "signature": "EICAR"}`))
+		default:
+			w.Write([]byte(`{"infected": false}`))
+		}
+	}))
+	defer server.Close()
+
+	scanner := NewWebhookScanner(server.URL, time.Second)
+	result, err := scanner.Scan(context.Background(), []byte("clean"))
+	assert.Nil(t, err)
+	assert.False(t, result.Infected)
+
+	result, err = scanner.Scan(context.Background(), []byte(testEICAR))
+	assert.Nil(t, err)
+	assert.Equal(t, &ScanResult{Infected: true, Signature: "EICAR", Scanner: ScannerWebhook}, result)
+
+	_, err = scanner.Scan(context.Background(), []byte("broken"))
+	assert.NotNil(t, err)
+}
+
+// testScanner returns fixed verdict
+type testScanner struct {
+	result *ScanResult
+	err    error
+}
+
+func (s *testScanner) Name() string {
+	return "test"
+}
+
+func (s *testScanner) Scan(ctx context.Context, data []byte) (*ScanResult, error) {
+	return s.result, s.err
+}
+
+func TestMultiScanner(t *testing.T) {
+	clean := &testScanner{result: &ScanResult{Scanner: "test"}}
+	infected := &testScanner{result: &ScanResult{Infected: true, Signature: "EICAR", Scanner: "test"}}
+	failed := &testScanner{err: errors.New("Scanner is unavailable")}
+
+	result, err := MultiScanner{clean, clean}.Scan(context.Background(), nil)
+	assert.Nil(t, err)
+	assert.False(t, result.Infected)
+
+	result, err = MultiScanner{clean, infected, failed}.Scan(context.Background(), nil)
+	assert.Nil(t, err)
+	assert.True(t, result.Infected)
+
+	_, err = MultiScanner{clean, failed, infected}.Scan(context.Background(), nil)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, "test,test", MultiScanner{clean, failed}.Name())
+}
+
+func TestScanUpload(t *testing.T) {
+	cases := []struct {
+		scanner  Scanner
+		failOpen bool
+		infected bool
+		failed   bool
+	}{
+		{&testScanner{result: &ScanResult{}}, false, false, false},
+		{&testScanner{result: &ScanResult{Infected: true, Signature: "EICAR"}}, false, true, true},
+		{&testScanner{result: &ScanResult{Infected: true, Signature: "EICAR"}}, true, true, true},
+		{&testScanner{err: errors.New("Scanner is unavailable")}, false, false, true},
+		{&testScanner{err: errors.New("Scanner is unavailable")}, true, false, false},
+	}
+
+	for _, c := range cases {
+		appCtx := &AppContext{
+			Config:  &Config{ScanTimeout: time.Second, ScanFailOpen: c.failOpen},
+			Scanner: c.scanner,
+		}
+		err := scanUpload(context.Background(), appCtx, "docs", []byte("data"), MIMEImagePNG)
+		assert.Equal(t, c.failed, err != nil, c)
+		assert.Equal(t, c.infected, errors.Is(err, ErrInfected), c)
+	}
+
+	assert.Nil(t, initScanner(&Config{}))
+	assert.Equal(t, "clamd,webhook", initScanner(&Config{ScanClamdAddress: "127.0.0.1:3310", ScanWebhookURL: "http://scanner"}).Name())
+}
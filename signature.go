@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// SignatureParam is a query param with URL signature
+const SignatureParam = "signature"
+
+type signedKey struct{}
+
+// URLSigner signs & verifies transform URLs with HMAC-SHA256.
+// It's compatible with imgproxy: signature is URL-safe base64 of HMAC of salt & path.
+type URLSigner struct {
+	key  []byte
+	salt []byte
+}
+
+// NewURLSigner returns new signer with hex-encoded key & salt.
+func NewURLSigner(key string, salt string) (*URLSigner, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("URL signature key must be hex-encoded")
+	}
+	saltBytes, err := hex.DecodeString(salt)
+	if err != nil {
+		return nil, errors.New("URL signature salt must be hex-encoded")
+	}
+	if len(keyBytes) == 0 {
+		return nil, errors.New("URL signature key can't be empty")
+	}
+	return &URLSigner{key: keyBytes, salt: saltBytes}, nil
+}
+
+// initURLSigner returns signer due to config or nil if URLs aren't signed
+func initURLSigner(cfg *Config) (*URLSigner, error) {
+	if cfg.URLSignatureKey == "" {
+		return nil, nil
+	}
+	return NewURLSigner(cfg.URLSignatureKey, cfg.URLSignatureSalt)
+}
+
+// Sign returns signature of path.
+func (s *URLSigner) Sign(path string) string {
+	return base64.RawURLEncoding.EncodeToString(s.mac(path))
+}
+
+// Verify reports whether signature of path is valid.
+func (s *URLSigner) Verify(path string, signature string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(decoded, s.mac(path))
+}
+
+func (s *URLSigner) mac(path string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(s.salt)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
+}
+
+// SignQuery returns query of path with signature param.
+// Signature covers path & sorted query params, so params can't be altered.
+func (s *URLSigner) SignQuery(path string, query url.Values) url.Values {
+	signed := url.Values{}
+	for key, values := range query {
+		if key != SignatureParam {
+			signed[key] = values
+		}
+	}
+	signed.Set(SignatureParam, s.Sign(path+"?"+signed.Encode()))
+	return signed
+}
+
+// VerifyQuery reports whether query of path has valid signature.
+func (s *URLSigner) VerifyQuery(path string, query url.Values) bool {
+	signature := query.Get(SignatureParam)
+	signed := url.Values{}
+	for key, values := range query {
+		if key != SignatureParam {
+			signed[key] = values
+		}
+	}
+	return s.Verify(path+"?"+signed.Encode(), signature)
+}
+
+// withSigned marks request as verified by signature
+func withSigned(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), signedKey{}, true))
+}
+
+// isSigned reports whether request was verified by signature
+func isSigned(r *http.Request) bool {
+	signed, _ := r.Context().Value(signedKey{}).(bool)
+	return signed
+}
+
+// RequiresQuerySignature reports whether transforming downloads require signed query.
+func (ctx *AppContext) RequiresQuerySignature() bool {
+	return ctx.URLSigner != nil && ctx.Config.URLSignatureQuery
+}
+
+// SignatureMW is a wrapper to provide appContext to signature middleware.
+type SignatureMW struct {
+	ctx *AppContext
+}
+
+// Middleware for SignatureMW requires signed query for transforming downloads if it's configured.
+// Requests of path mode are verified beforehand, see PathTransformMW.
+func (smw *SignatureMW) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signer := smw.ctx.URLSigner
+		if !smw.ctx.RequiresQuerySignature() || routeName(r) != "download" || isSigned(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Originals are served without signature
+		query := r.URL.Query()
+		if len(query) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !signer.VerifyQuery(r.URL.EscapedPath(), query) {
+			renderJSONError(w, errors.New("URL signature is invalid"), "SIGNATURE_IS_INVALID", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, withSigned(r))
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testSignatureKey  = "943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881"
+	testSignatureSalt = "520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5"
+)
+
+func testURLSigner(t *testing.T) *URLSigner {
+	signer, err := NewURLSigner(testSignatureKey, testSignatureSalt)
+	assert.Nil(t, err)
+	return signer
+}
+
+func TestNewURLSigner(t *testing.T) {
+	cases := []struct {
+		key   string
+		salt  string
+		valid bool
+	}{
+		{testSignatureKey, testSignatureSalt, true},
+		{testSignatureKey, "", true},
+		{"", testSignatureSalt, false},
+		{"secret", testSignatureSalt, false},
+		{testSignatureKey, "salt", false},
+	}
+
+	for _, c := range cases {
+		_, err := NewURLSigner(c.key, c.salt)
+		assert.Equal(t, c.valid, err == nil, c)
+	}
+}
+
+func TestURLSignerSign(t *testing.T) {
+	signer := testURLSigner(t)
+
+	// Same signature as imgproxy produces with the same key & salt
+	path := "/rs:fit:300:300/plain/http://img.example.com/pretty/image.jpg"
+	signature := signer.Sign(path)
+	assert.Equal(t, "m3k5QADfcKPDj-SDI2AIogZbC3FlAXszuwhtWXYqavc", signature)
+
+	assert.True(t, signer.Verify(path, signature))
+	assert.False(t, signer.Verify(path+"?", signature))
+	assert.False(t, signer.Verify(path, "unsafe"))
+	assert.False(t, signer.Verify(path, "!"))
+}
+
+func TestURLSignerSignQuery(t *testing.T) {
+	signer := testURLSigner(t)
+
+	query := signer.SignQuery("/avatars/a.jpg", url.Values{"resize": {"300"}, "format": {"webp"}})
+	assert.NotEmpty(t, query.Get(SignatureParam))
+	assert.True(t, signer.VerifyQuery("/avatars/a.jpg", query))
+	assert.False(t, signer.VerifyQuery("/avatars/b.jpg", query))
+
+	// Re-signing replaces previous signature
+	assert.Equal(t, query, signer.SignQuery("/avatars/a.jpg", query))
+
+	query.Set("resize", "3000")
+	assert.False(t, signer.VerifyQuery("/avatars/a.jpg", query))
+}
+
+func TestSignatureMW(t *testing.T) {
+	signer := testURLSigner(t)
+	signed := signer.SignQuery("/avatars/a.jpg", url.Values{"resize": {"300"}}).Encode()
+
+	cases := []struct {
+		method   string
+		url      string
+		query    bool
+		expected int
+	}{
+		{"GET", "/avatars/a.jpg", true, http.StatusOK},
+		{"GET", "/avatars/a.jpg?resize=300", true, http.StatusForbidden},
+		{"GET", "/avatars/a.jpg?" + signed, true, http.StatusOK},
+		{"GET", "/avatars/b.jpg?" + signed, true, http.StatusForbidden},
+		{"GET", "/avatars/a.jpg?resize=300", false, http.StatusOK},
+		{"POST", "/avatars?resize=300", true, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		appCtx := &AppContext{
+			Config:    &Config{URLSignatureQuery: c.query},
+			URLSigner: signer,
+		}
+		ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		router := mux.NewRouter()
+		router.PathPrefix("/{bucket}").Handler(ok).Methods("POST").Name("upload")
+		router.PathPrefix("/{bucket}/").Handler(ok).Methods("GET").Name("download")
+		smw := &SignatureMW{appCtx}
+		router.Use(smw.Middleware)
+
+		req, err := http.NewRequest(c.method, c.url, nil)
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expected, rr.Code, c)
+		if rr.Code != http.StatusOK {
+			er := ErrorResponse{}
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &er))
+			assert.Equal(t, "SIGNATURE_IS_INVALID", er.Error)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go"
+)
+
+// Similarity search defaults
+const (
+	DefaultSimilarityDistance = 10
+	MaxSimilarityDistance     = 20
+	MaxSimilarImages          = 100
+)
+
+// bkNode is a node of BK-tree, children are keyed by distance to node
+type bkNode struct {
+	hash     uint64
+	objects  []string
+	children map[int]*bkNode
+}
+
+// BKTree indexes hashes by Hamming distance to find near-duplicates without full scan.
+type BKTree struct {
+	root *bkNode
+}
+
+// Add adds object with given hash.
+func (t *BKTree) Add(hash uint64, object string) {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, objects: []string{object}}
+		return
+	}
+
+	node := t.root
+	for {
+		distance := HammingDistance(hash, node.hash)
+		if distance == 0 {
+			if !contains(node.objects, object, "") {
+				node.objects = append(node.objects, object)
+			}
+			return
+		}
+		child, ok := node.children[distance]
+		if !ok {
+			if node.children == nil {
+				node.children = map[int]*bkNode{}
+			}
+			node.children[distance] = &bkNode{hash: hash, objects: []string{object}}
+			return
+		}
+		node = child
+	}
+}
+
+// SimilarImage represents found near-duplicate
+type SimilarImage struct {
+	File     string `json:"file"`
+	Distance int    `json:"distance"`
+	hash     uint64
+}
+
+// Search returns objects with hashes within given distance.
+func (t *BKTree) Search(hash uint64, maxDistance int) []SimilarImage {
+	var found []SimilarImage
+	if t.root == nil {
+		return found
+	}
+
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		distance := HammingDistance(hash, node.hash)
+		if distance <= maxDistance {
+			for _, object := range node.objects {
+				found = append(found, SimilarImage{File: object, Distance: distance, hash: node.hash})
+			}
+		}
+		// Triangle inequality limits children to check
+		for childDistance, child := range node.children {
+			if childDistance >= distance-maxDistance && childDistance <= distance+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+	return found
+}
+
+// similarityRecord is a record of index log
+type similarityRecord struct {
+	Bucket  string `json:"bucket"`
+	Object  string `json:"object"`
+	PHash   string `json:"phash,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// SimilarityIndex keeps BK-trees of perceptual hashes per bucket.
+// Index is restored from append-only log file on start, it's kept in memory only without file.
+type SimilarityIndex struct {
+	mu     sync.RWMutex
+	trees  map[string]*BKTree
+	hashes map[string]map[string]uint64 // Current hashes by bucket & object
+	log    *os.File
+}
+
+// NewSimilarityIndex returns index restored from log file or in-memory index if path is empty.
+func NewSimilarityIndex(path string) (*SimilarityIndex, error) {
+	si := &SimilarityIndex{trees: map[string]*BKTree{}, hashes: map[string]map[string]uint64{}}
+	if path == "" {
+		return si, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		record := similarityRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Similarity index is malformed at line %d: %w", line, err)
+		}
+		if record.Deleted {
+			delete(si.hashes[record.Bucket], record.Object)
+			continue
+		}
+		hash, err := ParseHash(record.PHash)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Similarity index is malformed at line %d: %w", line, err)
+		}
+		si.add(record.Bucket, record.Object, hash)
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	si.log = file
+	return si, nil
+}
+
+// initSimilarityIndex returns index due to config or nil if similarity search is disabled
+func initSimilarityIndex(cfg *Config) (*SimilarityIndex, error) {
+	if !cfg.SimilarityEnabled {
+		return nil, nil
+	}
+	return NewSimilarityIndex(cfg.SimilarityIndexFile)
+}
+
+// Add indexes object hash & appends it to log.
+func (si *SimilarityIndex) Add(bucket string, object string, hash uint64) error {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	if err := si.write(similarityRecord{Bucket: bucket, Object: object, PHash: formatHash(hash)}); err != nil {
+		return err
+	}
+	si.add(bucket, object, hash)
+	return nil
+}
+
+// Remove removes object from index, it stays in BK-tree till restart but isn't found.
+func (si *SimilarityIndex) Remove(bucket string, object string) error {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	if _, ok := si.hashes[bucket][object]; !ok {
+		return nil
+	}
+	if err := si.write(similarityRecord{Bucket: bucket, Object: object, Deleted: true}); err != nil {
+		return err
+	}
+	delete(si.hashes[bucket], object)
+	return nil
+}
+
+// write appends record to log if index is persisted
+func (si *SimilarityIndex) write(record similarityRecord) error {
+	if si.log == nil {
+		return nil
+	}
+	line, _ := json.Marshal(record)
+	_, err := si.log.Write(append(line, '\n'))
+	return err
+}
+
+func (si *SimilarityIndex) add(bucket string, object string, hash uint64) {
+	tree, ok := si.trees[bucket]
+	if !ok {
+		tree = &BKTree{}
+		si.trees[bucket] = tree
+		si.hashes[bucket] = map[string]uint64{}
+	}
+	tree.Add(hash, object)
+	si.hashes[bucket][object] = hash
+}
+
+// Hash returns indexed hash of object.
+func (si *SimilarityIndex) Hash(bucket string, object string) (uint64, bool) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	hash, ok := si.hashes[bucket][object]
+	return hash, ok
+}
+
+// Search returns objects of bucket with hashes within distance sorted by distance.
+// Objects re-indexed with another hash are matched by current hash only.
+func (si *SimilarityIndex) Search(bucket string, hash uint64, distance int) []SimilarImage {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	tree, ok := si.trees[bucket]
+	if !ok {
+		return []SimilarImage{}
+	}
+	found := []SimilarImage{}
+	for _, image := range tree.Search(hash, distance) {
+		if current, ok := si.hashes[bucket][image.File]; ok && current == image.hash {
+			found = append(found, image)
+		}
+	}
+	sort.Slice(found, func(a, b int) bool {
+		if found[a].Distance != found[b].Distance {
+			return found[a].Distance < found[b].Distance
+		}
+		return found[a].File < found[b].File
+	})
+	return found
+}
+
+// SimilarResponse represents near-duplicates of image
+// swagger:model similarResponse
+type SimilarResponse struct {
+	File    string         `json:"file"`
+	PHash   string         `json:"phash"`
+	Similar []SimilarImage `json:"similar"`
+}
+
+// SimilarHandler is a wrapper to provide appContext to similar images handler.
+type SimilarHandler struct {
+	ctx *AppContext
+}
+
+// SimilarController responds with near-duplicates of image
+func (h *SimilarHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /{bucket}/similar similar
+	// ---
+	// summary: Similar images
+	// description: Find near-duplicates of image in bucket by perceptual hash computed on upload.
+	// produces:
+	//   - application/json
+	// parameters:
+	//   - in: path
+	//     name: bucket
+	//     type: string
+	//     required: true
+	//     description: Bucket name in storage.
+	//   - in: query
+	//     name: object
+	//     type: string
+	//     required: true
+	//     description: Object name in storage.
+	//   - in: query
+	//     name: distance
+	//     type: integer
+	//     description: Maximum Hamming distance of hashes, 10 by default, up to 20.
+	// responses:
+	//   '200':
+	//     description: OK. Returns similar images sorted by distance.
+	//     schema:
+	//       $ref: '#/definitions/similarResponse'
+	//   '400':
+	//     description: Bad request (SIMILARITY_PARAMS_ARE_INVALID, HASH_ISNT_COMPUTED).
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND, CANT_PROCESS_FILE_ON_STORAGE, SIMILARITY_IS_DISABLED).
+	index := h.ctx.SimilarityIndex
+	if index == nil {
+		renderJSONError(w, errors.New("Similarity search is disabled"), "SIMILARITY_IS_DISABLED", http.StatusNotFound)
+		return
+	}
+
+	bucketName := mux.Vars(r)["bucket"]
+	object := r.URL.Query().Get("object")
+	distance := DefaultSimilarityDistance
+	if value := r.URL.Query().Get("distance"); value != "" {
+		var err error
+		if distance, err = strconv.Atoi(value); err != nil || distance < 0 || distance > MaxSimilarityDistance {
+			renderJSONError(w, fmt.Errorf("Distance must be within 0..%d", MaxSimilarityDistance), "SIMILARITY_PARAMS_ARE_INVALID", http.StatusBadRequest)
+			return
+		}
+	}
+	if object == "" {
+		renderJSONError(w, errors.New("Object is required"), "SIMILARITY_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+
+	// Objects uploaded before indexing have hash in metadata only
+	hash, ok := index.Hash(bucketName, object)
+	if !ok {
+		info, err := h.statObject(r, bucketName, object)
+		if err != nil {
+			renderJSONError(w, err, "CANT_PROCESS_FILE_ON_STORAGE", http.StatusNotFound)
+			return
+		}
+		if hash, err = ParseHash(info.Metadata.Get("X-Amz-Meta-" + MetadataPHash)); err != nil {
+			renderJSONError(w, errors.New("Perceptual hash isn't computed for object"), "HASH_ISNT_COMPUTED", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Object itself & objects inaccessible for principal are skipped
+	principal := PrincipalFromRequest(r)
+	similar := []SimilarImage{}
+	for _, image := range index.Search(bucketName, hash, distance) {
+		if image.File == object || (principal != nil && !principal.CanAccessObject(image.File)) {
+			continue
+		}
+		if similar = append(similar, image); len(similar) == MaxSimilarImages {
+			break
+		}
+	}
+
+	body, _ := json.Marshal(SimilarResponse{File: object, PHash: formatHash(hash), Similar: similar})
+	w.Header().Set("Content-Type", MIMEApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// statObject returns object information with metadata
+func (h *SimilarHandler) statObject(r *http.Request, bucketName string, object string) (minio.ObjectInfo, error) {
+	objName := "/" + object
+	_, span := startSpan(r.Context(), "storage.stat", storageAttributes(bucketName, objName)...)
+	start := time.Now()
+	info, err := h.ctx.Storage.StatObject(bucketName, objName, minio.StatObjectOptions{})
+	observeStorage(StorageOpStat, start, err)
+	endSpan(span, err)
+	return info, err
+}
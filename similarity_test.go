@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBKTreeSearch(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tree := &BKTree{}
+	hashes := map[string]uint64{}
+	base := random.Uint64()
+	for i := 0; i < 500; i++ {
+		// Flip few random bits of base hash to get near-duplicates
+		hash := base
+		for j := random.Intn(24); j > 0; j-- {
+			hash ^= 1 << uint(random.Intn(64))
+		}
+		object := strconv.Itoa(i) + ".jpg"
+		hashes[object] = hash
+		tree.Add(hash, object)
+	}
+
+	for _, distance := range []int{0, 3, 10, 20} {
+		expected := []string{}
+		for object, hash := range hashes {
+			if HammingDistance(base, hash) <= distance {
+				expected = append(expected, object)
+			}
+		}
+		found := []string{}
+		for _, image := range tree.Search(base, distance) {
+			assert.Equal(t, HammingDistance(base, hashes[image.File]), image.Distance)
+			found = append(found, image.File)
+		}
+		sort.Strings(expected)
+		sort.Strings(found)
+		assert.Equal(t, expected, found, distance)
+	}
+
+	assert.Empty(t, (&BKTree{}).Search(base, 10))
+}
+
+func TestSimilarityIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "similarity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.log")
+
+	index, err := NewSimilarityIndex(path)
+	assert.Nil(t, err)
+	assert.Nil(t, index.Add("docs", "a.jpg", 0x0f))
+	assert.Nil(t, index.Add("docs", "b.jpg", 0x1f))
+	assert.Nil(t, index.Add("docs", "c.jpg", 0xff00))
+	assert.Nil(t, index.Add("avatars", "d.jpg", 0x0f))
+	// Re-indexed object is found by current hash only
+	assert.Nil(t, index.Add("docs", "c.jpg", 0x0e))
+
+	// Index is restored from log
+	restored, err := NewSimilarityIndex(path)
+	assert.Nil(t, err)
+	for _, si := range []*SimilarityIndex{index, restored} {
+		assert.Equal(t, []SimilarImage{
+			{File: "a.jpg", Distance: 0, hash: 0x0f},
+			{File: "b.jpg", Distance: 1, hash: 0x1f},
+			{File: "c.jpg", Distance: 1, hash: 0x0e},
+		}, si.Search("docs", 0x0f, 2))
+		assert.Empty(t, si.Search("docs", 0xff00, 2))
+		assert.Empty(t, si.Search("unknown", 0x0f, 2))
+
+		hash, ok := si.Hash("avatars", "d.jpg")
+		assert.True(t, ok)
+		assert.Equal(t, uint64(0x0f), hash)
+		_, ok = si.Hash("docs", "d.jpg")
+		assert.False(t, ok)
+	}
+
+	// Removed object isn't found after restore
+	assert.Nil(t, index.Remove("docs", "b.jpg"))
+	restored, err = NewSimilarityIndex(path)
+	assert.Nil(t, err)
+	for _, si := range []*SimilarityIndex{index, restored} {
+		assert.Equal(t, []SimilarImage{
+			{File: "a.jpg", Distance: 0, hash: 0x0f},
+			{File: "c.jpg", Distance: 1, hash: 0x0e},
+		}, si.Search("docs", 0x0f, 2))
+		_, ok := si.Hash("docs", "b.jpg")
+		assert.False(t, ok)
+	}
+
+	// Malformed log isn't loaded
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{\"bucket\":\"docs\",\"object\":\"a.jpg\",\"phash\":\"zz\"}\n"), 0644))
+	_, err = NewSimilarityIndex(path)
+	assert.NotNil(t, err)
+}
+
+func TestSimilarHandler(t *testing.T) {
+	cases := []struct {
+		url      string
+		expected int
+		similar  []string
+	}{
+		{"/docs/similar?object=a.jpg", http.StatusOK, []string{"b.jpg", "c.jpg"}},
+		{"/docs/similar?object=a.jpg&distance=3", http.StatusOK, []string{"b.jpg"}},
+		{"/docs/similar?object=a.jpg&distance=0", http.StatusOK, []string{}},
+		{"/docs/similar?object=a.jpg&distance=21", http.StatusBadRequest, nil},
+		{"/docs/similar?object=a.jpg&distance=-1", http.StatusBadRequest, nil},
+		{"/docs/similar?distance=1", http.StatusBadRequest, nil},
+		{"/unknown/similar?object=a.jpg", http.StatusNotFound, nil},
+	}
+
+	index, err := NewSimilarityIndex("")
+	assert.Nil(t, err)
+	assert.Nil(t, index.Add("docs", "a.jpg", 0))
+	assert.Nil(t, index.Add("docs", "b.jpg", 0x7))
+	assert.Nil(t, index.Add("docs", "c.jpg", 0x3ff))
+	assert.Nil(t, index.Add("docs", "d.jpg", 0xffffff))
+	assert.Nil(t, index.Add("avatars", "e.jpg", 0))
+
+	appCtx := &AppContext{
+		Config:          &Config{AuthAnonymousRead: true},
+		Buckets:         loadTestBucketsConfig(t),
+		SimilarityIndex: index,
+	}
+	router := InitRouter(appCtx)
+
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", c.url, nil)
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expected, rr.Code, c.url)
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		response := SimilarResponse{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		assert.Equal(t, "a.jpg", response.File)
+		assert.Equal(t, "0000000000000000", response.PHash)
+		similar := []string{}
+		for _, image := range response.Similar {
+			similar = append(similar, image.File)
+		}
+		assert.Equal(t, c.similar, similar, c.url)
+	}
+
+	// Similarity search may be disabled
+	appCtx.SimilarityIndex = nil
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/docs/similar?object=a.jpg", nil)
+	InitRouter(appCtx).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SrcsetSuffix is a suffix of object path to get its srcset
+const SrcsetSuffix = "/srcset"
+
+// MaxSrcsetWidths limits number of widths in srcset
+const MaxSrcsetWidths = 10
+
+// srcsetParams are download params of srcset request which are passed to image URLs
+var srcsetParams = []string{"format", "quality", "still"}
+
+// SrcsetResponse represents srcset & sizes attributes of responsive image
+// swagger:model srcsetResponse
+type SrcsetResponse struct {
+	Srcset string `json:"srcset"`
+	Sizes  string `json:"sizes"`
+}
+
+// ParseWidths parses comma separated widths, they're sorted & deduplicated.
+func ParseWidths(input string) ([]int, error) {
+	if input == "" {
+		return nil, errors.New("Widths are required")
+	}
+
+	unique := map[int]bool{}
+	var widths []int
+	for _, item := range strings.Split(input, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || width <= 0 || width > MaxResizeSize {
+			return nil, fmt.Errorf("Width must be within 1..%d", MaxResizeSize)
+		}
+		if !unique[width] {
+			unique[width] = true
+			widths = append(widths, width)
+		}
+	}
+	if len(widths) > MaxSrcsetWidths {
+		return nil, fmt.Errorf("Srcset can't contain more than %d widths", MaxSrcsetWidths)
+	}
+
+	sort.Ints(widths)
+	return widths, nil
+}
+
+// BuildSrcset returns srcset with width descriptors of resized image URLs & default sizes.
+// URLs are signed if signer is given.
+func BuildSrcset(base string, path string, query url.Values, widths []int, signer *URLSigner) *SrcsetResponse {
+	sources := make([]string, 0, len(widths))
+	sizes := make([]string, 0, len(widths))
+	for i, width := range widths {
+		params := url.Values{}
+		for key, values := range query {
+			params[key] = values
+		}
+		params.Set("resize", strconv.Itoa(width))
+		if signer != nil {
+			params = signer.SignQuery(path, params)
+		}
+		sources = append(sources, fmt.Sprintf("%s%s?%s %dw", base, path, params.Encode(), width))
+
+		// The largest width is used for any wider viewport
+		if i == len(widths)-1 {
+			sizes = append(sizes, fmt.Sprintf("%dpx", width))
+		} else {
+			sizes = append(sizes, fmt.Sprintf("(max-width: %dpx) %dpx", width, width))
+		}
+	}
+
+	return &SrcsetResponse{Srcset: strings.Join(sources, ", "), Sizes: strings.Join(sizes, ", ")}
+}
+
+// publicURL returns configured base URL or the one of request
+func publicURL(r *http.Request, ctx *AppContext) string {
+	if ctx.Config.PublicURL != "" {
+		return strings.TrimSuffix(ctx.Config.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// SrcsetHandler is a wrapper to provide appContext to srcset handler.
+type SrcsetHandler struct {
+	ctx *AppContext
+}
+
+// SrcsetController responds with srcset & sizes of image
+func (h *SrcsetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// swagger:operation GET /{bucket}/{object}/srcset srcset
+	// ---
+	// summary: Srcset
+	// description: Get srcset & sizes attributes of responsive image. URLs are signed for authenticated clients if URL_SIGNATURE_KEY is set.
+	// produces:
+	//   - application/json
+	// parameters:
+	//   - in: path
+	//     name: bucket
+	//     type: string
+	//     required: true
+	//     description: Bucket name in storage.
+	//   - in: path
+	//     name: object
+	//     type: string
+	//     required: true
+	//     description: Object name in storage.
+	//   - in: query
+	//     name: widths
+	//     type: string
+	//     required: true
+	//     description: Comma separated widths, f.ex. 320,640,1280.
+	//   - in: query
+	//     name: sizes
+	//     type: string
+	//     description: Sizes attribute to return instead of default one.
+	//   - in: query
+	//     name: format
+	//     type: string
+	//     description: Format, quality & still download params are passed to URLs, other params are ignored.
+	// responses:
+	//   '200':
+	//     description: OK. Returns srcset & sizes.
+	//     schema:
+	//       $ref: '#/definitions/srcsetResponse'
+	//   '400':
+	//     description: Bad request (RESIZE_PARAMS_ARE_INVALID, RESIZE_NOT_ALLOWED, WATERMARK_IS_INVALID).
+	//   '403':
+	//     description: Forbidden (FORBIDDEN).
+	//   '404':
+	//     description: Not found (BUCKET_NOT_FOUND).
+	var ctx = h.ctx.ForRequest(r)
+	var policy = BucketPolicyFromRequest(r)
+
+	widths, err := ParseWidths(r.URL.Query().Get("widths"))
+	if err != nil {
+		renderJSONError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+
+	// URLs must be valid downloads, so resizing is validated against bucket policy
+	opts := *ctx.Options
+	if opts.Resize != "" || opts.Preset != "" || opts.Op != "" || opts.DPR != 0 || opts.Enlarge || opts.Watermark != "" {
+		renderJSONError(w, errors.New("Srcset can't be combined with resize, preset, op, dpr, enlarge or watermark"), "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+	if !*policy.ResizeOnDownload {
+		renderJSONError(w, errors.New("Resizing on download is disabled in this bucket"), "RESIZE_NOT_ALLOWED", http.StatusBadRequest)
+		return
+	}
+	opts.Resize = strconv.Itoa(widths[0])
+	resolved, err := policy.ResolveOptions(&opts, ctx.Presets())
+	if err != nil {
+		renderJSONError(w, err, "RESIZE_NOT_ALLOWED", http.StatusBadRequest)
+		return
+	}
+	if err = validateOptions(resolved); err != nil {
+		renderJSONError(w, err, "RESIZE_PARAMS_ARE_INVALID", http.StatusBadRequest)
+		return
+	}
+	if _, err = ctx.WatermarkByName(resolved.Watermark); err != nil {
+		renderJSONError(w, err, "WATERMARK_IS_INVALID", http.StatusBadRequest)
+		return
+	}
+
+	// Anonymous clients can't mint signed URLs, they get unsigned ones if signature isn't required
+	signer := ctx.URLSigner
+	if signer != nil && PrincipalFromRequest(r) == nil {
+		if ctx.Config.URLSignatureQuery {
+			renderJSONError(w, errors.New("Signed srcset requires authenticated client"), "FORBIDDEN", http.StatusForbidden)
+			return
+		}
+		signer = nil
+	}
+
+	query := url.Values{}
+	for _, param := range srcsetParams {
+		if value := r.URL.Query().Get(param); value != "" {
+			query.Set(param, value)
+		}
+	}
+	path := strings.TrimSuffix(r.URL.EscapedPath(), SrcsetSuffix)
+	response := BuildSrcset(publicURL(r, ctx), path, query, widths, signer)
+	if sizes := r.URL.Query().Get("sizes"); sizes != "" {
+		response.Sizes = sizes
+	}
+
+	body, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", MIMEApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyDPR(t *testing.T) {
+	cases := []struct {
+		dimensions []int
+		dpr        int
+		expected   []int
+		valid      bool
+	}{
+		{[]int{}, 2, []int{}, true},
+		{[]int{300}, 0, []int{300}, true},
+		{[]int{300}, 1, []int{300}, true},
+		{[]int{300, 200}, 2, []int{600, 400}, true},
+		{[]int{300}, 3, []int{900}, true},
+		{[]int{2000, 1000}, 2, []int{3000, 1500}, true},
+		{[]int{1000, 2500}, 3, []int{1200, 3000}, true},
+		{[]int{4000}, 2, nil, false},
+	}
+
+	for _, c := range cases {
+		dimensions, err := ApplyDPR(c.dimensions, c.dpr)
+		assert.Equal(t, c.valid, err == nil, c)
+		assert.Equal(t, c.expected, dimensions, c)
+	}
+}
+
+func TestParseWidths(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []int
+		valid    bool
+	}{
+		{"320,640,1280", []int{320, 640, 1280}, true},
+		{"1280, 320,640,320", []int{320, 640, 1280}, true},
+		{"3000", []int{3000}, true},
+		{"", nil, false},
+		{"320,", nil, false},
+		{"0", nil, false},
+		{"3001", nil, false},
+		{"320x200", nil, false},
+		{"1,2,3,4,5,6,7,8,9,10,11", nil, false},
+	}
+
+	for _, c := range cases {
+		widths, err := ParseWidths(c.input)
+		assert.Equal(t, c.valid, err == nil, c.input)
+		assert.Equal(t, c.expected, widths, c.input)
+	}
+}
+
+func TestBuildSrcset(t *testing.T) {
+	response := BuildSrcset("https://img.example.com", "/docs/a%20b.jpg", url.Values{"format": {"webp"}}, []int{320, 640}, nil)
+	assert.Equal(t, "https://img.example.com/docs/a%20b.jpg?format=webp&resize=320 320w, https://img.example.com/docs/a%20b.jpg?format=webp&resize=640 640w", response.Srcset)
+	assert.Equal(t, "(max-width: 320px) 320px, 640px", response.Sizes)
+
+	// Signed URLs are verified by SignatureMW
+	signer := testURLSigner(t)
+	response = BuildSrcset("", "/docs/a.jpg", url.Values{}, []int{320, 640, 1280}, signer)
+	sources := strings.Split(response.Srcset, ", ")
+	assert.Len(t, sources, 3)
+	for _, source := range sources {
+		u, err := url.Parse(strings.Fields(source)[0])
+		assert.Nil(t, err)
+		assert.Equal(t, "/docs/a.jpg", u.Path)
+		assert.True(t, signer.VerifyQuery(u.EscapedPath(), u.Query()), source)
+	}
+}
+
+func TestSrcsetHandler(t *testing.T) {
+	cases := []struct {
+		url      string
+		expected int
+		srcset   string
+	}{
+		{"/docs/a.jpg/srcset?widths=640,320&format=webp", http.StatusOK, "https://img.example.com/docs/a.jpg?format=webp&resize=320 320w, https://img.example.com/docs/a.jpg?format=webp&resize=640 640w"},
+		{"/docs/dir/a.jpg/srcset?widths=320&sizes=100vw", http.StatusOK, "https://img.example.com/docs/dir/a.jpg?resize=320 320w"},
+		{"/docs/a.jpg/srcset", http.StatusBadRequest, ""},
+		{"/docs/a.jpg/srcset?widths=320&resize=100", http.StatusBadRequest, ""},
+		{"/docs/a.jpg/srcset?widths=320&dpr=2", http.StatusBadRequest, ""},
+		{"/docs/a.jpg/srcset?widths=320&quality=80&still=true&blur=3&widths=640", http.StatusOK, "https://img.example.com/docs/a.jpg?quality=80&resize=320&still=true 320w"},
+		{"/docs/a.jpg/srcset?widths=320&enlarge=true", http.StatusBadRequest, ""},
+		{"/docs/a.jpg/srcset?widths=320&watermark=logo", http.StatusBadRequest, ""},
+		{"/docs/a.jpg/srcset?widths=320&watermark=unknown", http.StatusBadRequest, ""},
+		{"/avatars/a.jpg/srcset?widths=320", http.StatusBadRequest, ""},
+		{"/photos/a.jpg/srcset?widths=320", http.StatusBadRequest, ""},
+		{"/unknown/a.jpg/srcset?widths=320", http.StatusNotFound, ""},
+	}
+
+	appCtx := &AppContext{
+		Config:  &Config{AuthAnonymousRead: true, ResizeOnDownload: true, PublicURL: "https://img.example.com/"},
+		Buckets: loadTestBucketsConfig(t),
+	}
+	router := InitRouter(appCtx)
+
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", c.url, nil)
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expected, rr.Code, c.url)
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		response := SrcsetResponse{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		assert.Equal(t, c.srcset, response.Srcset, c.url)
+		if strings.Contains(c.url, "sizes=") {
+			assert.Equal(t, "100vw", response.Sizes)
+		}
+	}
+}
+
+func TestSrcsetSigning(t *testing.T) {
+	signer := testURLSigner(t)
+	appCtx := &AppContext{
+		Config:    &Config{AuthAnonymousRead: true, ResizeOnDownload: true, URLSignatureQuery: true},
+		Buckets:   loadTestBucketsConfig(t),
+		KeyStore:  NewStaticKeyStore(testKeys),
+		URLSigner: signer,
+	}
+	appCtx.Buckets.Buckets["docs"].Public = true
+	srcset := func(key string) (int, string) {
+		req := httptest.NewRequest("GET", "/docs/a.jpg/srcset?widths=320", nil)
+		req.Header.Set(APIKeyHeader, key)
+		rr := httptest.NewRecorder()
+		InitRouter(appCtx).ServeHTTP(rr, req)
+		response := SrcsetResponse{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response.Srcset
+	}
+
+	// Anonymous clients can't mint signed URLs
+	code, _ := srcset("")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, source := srcset("admin-key")
+	assert.Equal(t, http.StatusOK, code)
+	u, err := url.Parse(strings.Fields(source)[0])
+	assert.Nil(t, err)
+	assert.True(t, signer.VerifyQuery(u.EscapedPath(), u.Query()), source)
+
+	// URLs aren't signed for anonymous clients if signature isn't required
+	appCtx.Config.URLSignatureQuery = false
+	code, source = srcset("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, source, SignatureParam+"=")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeCollector collects span names received by OTLP/HTTP endpoint.
+type fakeCollector struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+func (fc *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	req := &collectortrace.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ils := range rs.InstrumentationLibrarySpans {
+			for _, span := range ils.Spans {
+				fc.spans = append(fc.spans, span.Name)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestTracing(t *testing.T) {
+	collector := &fakeCollector{}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	var traceparent string
+	imaginaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte("resized"))
+	}))
+	defer imaginaryServer.Close()
+
+	cfg := &Config{
+		ImageServiceURL:    strings.TrimPrefix(imaginaryServer.URL, "http://"),
+		TracingEndpoint:    strings.TrimPrefix(collectorServer.URL, "http://"),
+		TracingInsecure:    true,
+		TracingSampleRatio: 1,
+	}
+	// Global tracer provider & propagator are restored for other tests
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	shutdown, err := initTracing(cfg)
+	assert.Nil(t, err)
+
+	// Resize within request span
+	appCtx := &AppContext{Config: cfg, Resizer: NewResizer(cfg), Options: &Options{Enlarge: true}, Dimensions: []int{100}}
+	ctx, span := startSpan(context.Background(), "test")
+	_, err = ResizeImage(ctx, appCtx, bytes.NewBufferString("image"), MIMEImageJPEG)
+	span.End()
+	assert.Nil(t, err)
+	assert.Contains(t, traceparent, span.SpanContext().TraceID().String())
+
+	// Serve request by router
+	router := InitRouter(appCtx)
+	req, err := http.NewRequest("GET", "/health", nil)
+	assert.Nil(t, err)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Nil(t, shutdown(context.Background()))
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	assert.Contains(t, collector.spans, "test")
+	assert.Contains(t, collector.spans, "imaginary.thumbnail")
+	assert.Contains(t, collector.spans, "options.parse")
+	assert.Contains(t, collector.spans, "HTTP GET health")
+}
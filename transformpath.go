@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TransformPathPrefix is a prefix of path mode URLs:
+// /t/{signature}/{options}/{bucket}/{object}
+const TransformPathPrefix = "/t/"
+
+var (
+	thumborSizeRegexp   = regexp.MustCompile(`^(\d+)x(\d+)$`)
+	thumborFilterRegexp = regexp.MustCompile(`(\w+)\(([^)]*)\)`)
+)
+
+// transformPath represents transforms parsed from path.
+type transformPath struct {
+	width     int
+	height    int
+	fill      bool
+	enlarge   bool
+	quality   int
+	dpr       int
+	format    string
+	preset    string
+	still     bool
+	rotate    int
+	blur      float64
+	grayscale bool
+}
+
+// ParseTransformPath parses path mode URL without prefix into download path & query.
+// Options follow imgproxy format (f.ex. "rs:fill:300:300", "q:80"),
+// Thumbor size ("300x200", "fit-in") & filters ("filters:quality(80):grayscale()") are supported too.
+// Returns signature, signed part of path, download path & query params.
+func ParseTransformPath(path string) (string, string, string, url.Values, error) {
+	segments := strings.Split(path, "/")
+	if len(segments) < 3 {
+		return "", "", "", nil, errors.New("Transform URL must contain signature, bucket & object")
+	}
+	signature, segments := segments[0], segments[1:]
+	signedPath := "/" + strings.Join(segments, "/")
+
+	tp := &transformPath{}
+	thumborSize, fitIn := false, false
+	for len(segments) > 0 && isTransformOption(segments[0]) {
+		option := segments[0]
+		segments = segments[1:]
+
+		var err error
+		switch {
+		case option == "fit-in":
+			fitIn = true
+			continue
+		case option == "smart":
+			continue
+		case thumborSizeRegexp.MatchString(option):
+			// Thumbor crops to fill requested size unless "fit-in" is presented
+			thumborSize = true
+			match := thumborSizeRegexp.FindStringSubmatch(option)
+			tp.width, _ = strconv.Atoi(match[1])
+			tp.height, _ = strconv.Atoi(match[2])
+		case strings.HasPrefix(option, "filters:"):
+			err = tp.parseThumborFilters(strings.TrimPrefix(option, "filters:"))
+		default:
+			err = tp.parseOption(option)
+		}
+		if err != nil {
+			return "", "", "", nil, err
+		}
+	}
+	if thumborSize && !fitIn {
+		tp.fill = tp.width > 0 && tp.height > 0
+	}
+
+	if len(segments) < 2 || segments[0] == "" || segments[len(segments)-1] == "" {
+		return "", "", "", nil, errors.New("Transform URL must contain bucket & object")
+	}
+
+	// imgproxy format extension, f.ex. "image.gif@webp"
+	object := strings.Join(segments[1:], "/")
+	if i := strings.LastIndex(object, "@"); i >= 0 && validateFormat(object[i+1:]) == nil {
+		tp.format, object = object[i+1:], object[:i]
+	}
+
+	query, err := tp.query()
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	return signature, signedPath, "/" + segments[0] + "/" + object, query, nil
+}
+
+// isTransformOption reports whether path segment is an option, bucket names can't contain colons
+func isTransformOption(segment string) bool {
+	return strings.Contains(segment, ":") || segment == "fit-in" || segment == "smart" || thumborSizeRegexp.MatchString(segment)
+}
+
+// parseOption parses imgproxy option
+func (tp *transformPath) parseOption(option string) error {
+	parts := strings.Split(option, ":")
+	name, args := parts[0], parts[1:]
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+
+	var err error
+	switch name {
+	case "resize", "rs":
+		if err = tp.parseResizingType(arg(0)); err == nil {
+			err = tp.parseSize(args[minInt(1, len(args)):])
+		}
+	case "size", "s":
+		err = tp.parseSize(args)
+	case "resizing_type", "rt":
+		err = tp.parseResizingType(arg(0))
+	case "width", "w":
+		tp.width, err = parseIntArg(arg(0))
+	case "height", "h":
+		tp.height, err = parseIntArg(arg(0))
+	case "enlarge", "el":
+		tp.enlarge = parseBoolArg(arg(0))
+	case "quality", "q":
+		tp.quality, err = parseIntArg(arg(0))
+	case "dpr":
+		tp.dpr, err = parseIntArg(arg(0))
+	case "format", "f", "ext":
+		tp.format = arg(0)
+	case "preset", "pr":
+		tp.preset = arg(0)
+	case "still":
+		tp.still = parseBoolArg(arg(0))
+	case "rotate", "rot":
+		tp.rotate, err = parseIntArg(arg(0))
+	case "blur", "bl":
+		tp.blur, err = strconv.ParseFloat(arg(0), 64)
+	case "grayscale", "gs":
+		tp.grayscale = parseBoolArg(arg(0))
+	default:
+		return errors.New("Unsupported option " + name)
+	}
+	if err != nil {
+		return errors.New("Option " + option + " is invalid")
+	}
+	return nil
+}
+
+func (tp *transformPath) parseResizingType(resizingType string) error {
+	switch resizingType {
+	case "", "fit":
+		tp.fill = false
+	case "fill":
+		tp.fill = true
+	default:
+		return errors.New("Unsupported resizing type " + resizingType)
+	}
+	return nil
+}
+
+// parseSize parses width, height & enlarge args, empty args are skipped
+func (tp *transformPath) parseSize(args []string) error {
+	var err error
+	if len(args) > 0 && args[0] != "" {
+		if tp.width, err = parseIntArg(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 && args[1] != "" {
+		if tp.height, err = parseIntArg(args[1]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 2 && args[2] != "" {
+		tp.enlarge = parseBoolArg(args[2])
+	}
+	return nil
+}
+
+// parseThumborFilters parses filters like "quality(80):grayscale()"
+func (tp *transformPath) parseThumborFilters(filters string) error {
+	for _, match := range thumborFilterRegexp.FindAllStringSubmatch(filters, -1) {
+		name, args := match[1], strings.Split(match[2], ",")
+		var err error
+		switch name {
+		case "quality":
+			tp.quality, err = parseIntArg(args[0])
+		case "format":
+			tp.format = args[0]
+		case "grayscale":
+			tp.grayscale = true
+		case "blur":
+			tp.blur, err = strconv.ParseFloat(args[0], 64)
+		case "rotate":
+			tp.rotate, err = parseIntArg(args[0])
+		default:
+			return errors.New("Unsupported filter " + name)
+		}
+		if err != nil {
+			return errors.New("Filter " + match[0] + " is invalid")
+		}
+	}
+	return nil
+}
+
+func parseIntArg(arg string) (int, error) {
+	value, err := strconv.Atoi(arg)
+	if err != nil || value < 0 {
+		return 0, errors.New("Argument must be non-negative integer")
+	}
+	return value, nil
+}
+
+func parseBoolArg(arg string) bool {
+	return arg == "1" || arg == "t" || arg == "true"
+}
+
+// query returns query params of download request.
+// Fill mode, rotation, blur & grayscale are expressed by operations pipeline.
+func (tp *transformPath) query() (url.Values, error) {
+	query := url.Values{}
+	if tp.width == 0 && tp.height > 0 {
+		return nil, errors.New("Resizing by height only isn't supported")
+	}
+
+	var resize string
+	if tp.width > 0 {
+		resize = strconv.Itoa(tp.width)
+		if tp.height > 0 {
+			resize += "x" + strconv.Itoa(tp.height)
+		}
+	}
+
+	var ops []string
+	if resize != "" && tp.fill {
+		ops = append(ops, "resize:"+resize+":fill")
+	}
+	if tp.rotate != 0 {
+		ops = append(ops, "rotate:"+strconv.Itoa(tp.rotate))
+	}
+	if tp.blur > 0 {
+		ops = append(ops, "blur:"+strconv.FormatFloat(tp.blur, 'f', -1, 64))
+	}
+	if tp.grayscale {
+		ops = append(ops, OpGrayscale)
+	}
+	if len(ops) > 0 && resize != "" && !tp.fill {
+		ops = append([]string{"resize:" + resize}, ops...)
+	}
+
+	if len(ops) > 0 {
+		query.Set("op", strings.Join(ops, "|"))
+	} else if resize != "" {
+		query.Set("resize", resize)
+	}
+	if tp.enlarge {
+		query.Set("enlarge", "true")
+	}
+	if tp.quality > 0 {
+		query.Set("quality", strconv.Itoa(tp.quality))
+	}
+	if tp.dpr > 0 {
+		query.Set("dpr", strconv.Itoa(tp.dpr))
+	}
+	if tp.format != "" {
+		query.Set("format", tp.format)
+	}
+	if tp.preset != "" {
+		query.Set("preset", tp.preset)
+	}
+	if tp.still {
+		query.Set("still", "true")
+	}
+	return query, nil
+}
+
+// PathTransformMW is a wrapper to provide appContext to path mode middleware.
+type PathTransformMW struct {
+	ctx *AppContext
+}
+
+// Middleware for PathTransformMW verifies signature of path mode URL
+// & rewrites it into download request with query, so it's handled the same way.
+// Any signature (f.ex. "unsafe") is accepted if URLs aren't signed.
+func (pmw *PathTransformMW) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, TransformPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		signature, signedPath, downloadPath, query, err := ParseTransformPath(strings.TrimPrefix(r.URL.EscapedPath(), TransformPathPrefix))
+		if err != nil {
+			renderJSONError(w, err, "TRANSFORM_URL_IS_INVALID", http.StatusBadRequest)
+			return
+		}
+		if pmw.ctx.URLSigner != nil && !pmw.ctx.URLSigner.Verify(signedPath, signature) {
+			renderJSONError(w, errors.New("URL signature is invalid"), "SIGNATURE_IS_INVALID", http.StatusForbidden)
+			return
+		}
+
+		rewritten := withSigned(r)
+		rewritten.URL = &url.URL{Path: downloadPath, RawQuery: query.Encode()}
+		if unescaped, err := url.PathUnescape(downloadPath); err == nil {
+			rewritten.URL.Path, rewritten.URL.RawPath = unescaped, downloadPath
+		}
+		rewritten.RequestURI = rewritten.URL.RequestURI()
+
+		next.ServeHTTP(w, rewritten)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTransformPath(t *testing.T) {
+	cases := []struct {
+		path       string
+		signedPath string
+		download   string
+		query      string
+		valid      bool
+	}{
+		// imgproxy
+		{"sig/rs:fit:300:200/avatars/a.jpg", "/rs:fit:300:200/avatars/a.jpg", "/avatars/a.jpg", "resize=300x200", true},
+		{"sig/rs:fill:300:300/q:80/avatars/a.jpg", "/rs:fill:300:300/q:80/avatars/a.jpg", "/avatars/a.jpg", "op=resize%3A300x300%3Afill&quality=80", true},
+		{"sig/w:300/el:1/avatars/dir/a.jpg", "/w:300/el:1/avatars/dir/a.jpg", "/avatars/dir/a.jpg", "enlarge=true&resize=300", true},
+		{"sig/s:300:200:1/gs:1/avatars/a.jpg", "/s:300:200:1/gs:1/avatars/a.jpg", "/avatars/a.jpg", "enlarge=true&op=resize%3A300x200%7Cgrayscale", true},
+		{"sig/pr:thumb/still:1/avatars/a.gif@webp", "/pr:thumb/still:1/avatars/a.gif@webp", "/avatars/a.gif", "format=webp&preset=thumb&still=true", true},
+		{"sig/avatars/a@2x.jpg", "/avatars/a@2x.jpg", "/avatars/a@2x.jpg", "", true},
+		{"sig/w:300/dpr:2/avatars/a.jpg", "/w:300/dpr:2/avatars/a.jpg", "/avatars/a.jpg", "dpr=2&resize=300", true},
+		{"sig/rot:90/bl:1.5/avatars/a.jpg", "/rot:90/bl:1.5/avatars/a.jpg", "/avatars/a.jpg", "op=rotate%3A90%7Cblur%3A1.5", true},
+		// Thumbor
+		{"sig/300x200/avatars/a.jpg", "/300x200/avatars/a.jpg", "/avatars/a.jpg", "op=resize%3A300x200%3Afill", true},
+		{"sig/fit-in/300x200/avatars/a.jpg", "/fit-in/300x200/avatars/a.jpg", "/avatars/a.jpg", "resize=300x200", true},
+		{"sig/300x0/smart/avatars/a.jpg", "/300x0/smart/avatars/a.jpg", "/avatars/a.jpg", "resize=300", true},
+		{"sig/fit-in/300x200/filters:quality(80):format(webp)/avatars/a.gif", "/fit-in/300x200/filters:quality(80):format(webp)/avatars/a.gif", "/avatars/a.gif", "format=webp&quality=80&resize=300x200", true},
+		{"sig/filters:grayscale():rotate(180)/avatars/a.jpg", "/filters:grayscale():rotate(180)/avatars/a.jpg", "/avatars/a.jpg", "op=rotate%3A180%7Cgrayscale", true},
+		// Invalid
+		{"sig/avatars", "", "", "", false},
+		{"sig/rs:fit:300/avatars", "", "", "", false},
+		{"sig/rs:crop:300/avatars/a.jpg", "", "", "", false},
+		{"sig/h:300/avatars/a.jpg", "", "", "", false},
+		{"sig/q:high/avatars/a.jpg", "", "", "", false},
+		{"sig/unknown:1/avatars/a.jpg", "", "", "", false},
+		{"sig/filters:sharpen(1)/avatars/a.jpg", "", "", "", false},
+		{"sig/avatars/", "", "", "", false},
+	}
+
+	for _, c := range cases {
+		signature, signedPath, download, query, err := ParseTransformPath(c.path)
+		assert.Equal(t, c.valid, err == nil, c.path)
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, "sig", signature, c.path)
+		assert.Equal(t, c.signedPath, signedPath, c.path)
+		assert.Equal(t, c.download, download, c.path)
+		assert.Equal(t, c.query, query.Encode(), c.path)
+	}
+}
+
+func TestPathTransformMW(t *testing.T) {
+	signer := testURLSigner(t)
+
+	cases := []struct {
+		signer   *URLSigner
+		url      string
+		expected int
+		download string
+	}{
+		{nil, "/t/unsafe/rs:fill:300:300/avatars/a.jpg", http.StatusOK, "/avatars/a.jpg?op=resize%3A300x300%3Afill"},
+		{signer, "/t/unsafe/rs:fill:300:300/avatars/a.jpg", http.StatusForbidden, ""},
+		{signer, "/t/" + signer.Sign("/rs:fill:300:300/avatars/a.jpg") + "/rs:fill:300:300/avatars/a.jpg", http.StatusOK, "/avatars/a.jpg?op=resize%3A300x300%3Afill"},
+		{signer, "/t/" + signer.Sign("/rs:fill:300:300/avatars/a.jpg") + "/rs:fill:600:600/avatars/a.jpg", http.StatusForbidden, ""},
+		{signer, "/t/" + signer.Sign("/avatars/a%20b.jpg") + "/avatars/a%20b.jpg", http.StatusOK, "/avatars/a%20b.jpg"},
+		{signer, "/t/sig/rs:crop:300/avatars/a.jpg", http.StatusBadRequest, ""},
+		{signer, "/avatars/a.jpg", http.StatusOK, "/avatars/a.jpg"},
+	}
+
+	for _, c := range cases {
+		appCtx := &AppContext{Config: &Config{}, URLSigner: c.signer}
+		var download string
+		var signed bool
+		router := mux.NewRouter()
+		router.PathPrefix("/{bucket}/").Methods("GET").Name("download").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			download, signed = r.URL.RequestURI(), isSigned(r)
+		})
+		ptmw := &PathTransformMW{appCtx}
+
+		req, err := http.NewRequest("GET", c.url, nil)
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		ptmw.Middleware(router).ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expected, rr.Code, c.url)
+		assert.Equal(t, c.download, download, c.url)
+		if rr.Code == http.StatusOK {
+			assert.Equal(t, c.url != c.download, signed, c.url)
+		} else {
+			er := ErrorResponse{}
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &er))
+			assert.NotEmpty(t, er.Error)
+		}
+	}
+}
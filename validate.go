@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"sort"
+)
+
+// ErrTrailingData is returned for images with data after the end of image, f.ex. polyglot files
+var ErrTrailingData = errors.New("Image has trailing data")
+
+var errTruncated = errors.New("Image is truncated")
+
+// ValidateImage checks that image header matches sniffed type & image structure ends
+// with the end of data, zero padding & images indexed by JPEG MPF segment are allowed only. Image is decoded if fullDecode is set.
+func ValidateImage(data []byte, fileType string, fullDecode bool) error {
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if "image/"+format != fileType {
+		return fmt.Errorf("Image format %s doesn't match content type %s", format, fileType)
+	}
+
+	var end int
+	switch fileType {
+	case MIMEImageJPEG:
+		end, err = jpegEnd(data)
+	case MIMEImagePNG:
+		end, err = pngEnd(data)
+	case MIMEImageGIF:
+		_, end, err = walkGIF(data, 0)
+	default:
+		err = fmt.Errorf("Validation isn't supported for %s", fileType)
+	}
+	if err != nil {
+		return err
+	}
+	for _, b := range data[end:] {
+		if b != 0 {
+			return fmt.Errorf("%w: %d bytes after the end of image", ErrTrailingData, len(data)-end)
+		}
+	}
+
+	if !fullDecode {
+		return nil
+	}
+	// All GIF frames are decoded, not the first one only
+	if fileType == MIMEImageGIF {
+		_, err = gif.DecodeAll(bytes.NewReader(data))
+	} else {
+		_, _, err = image.Decode(bytes.NewReader(data))
+	}
+	return err
+}
+
+// pngEnd walks through PNG chunks & returns offset after IEND chunk
+func pngEnd(data []byte) (int, error) {
+	pos := 8 // Signature
+	for {
+		// Length (4), type (4), data & CRC (4)
+		if pos+8 > len(data) {
+			return 0, errTruncated
+		}
+		length := int64(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := int64(pos) + 12 + length
+		if end > int64(len(data)) {
+			return 0, errTruncated
+		}
+		pos = int(end)
+		if chunkType == "IEND" {
+			return pos, nil
+		}
+	}
+}
+
+// jpegImage is a range of JPEG image within file
+type jpegImage struct {
+	start int
+	size  int
+}
+
+// jpegEnd returns offset after EOI marker of JPEG & images appended to it due to Multi-Picture Format,
+// f.ex. stereo pairs of MPO files or gain maps of Ultra HDR photos. Zero padding is allowed between images.
+func jpegEnd(data []byte) (int, error) {
+	end, images, err := walkJPEG(data)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].start < images[j].start
+	})
+	for _, img := range images {
+		if img.start < end || img.start+img.size > len(data) {
+			return 0, errors.New("MPF index is malformed")
+		}
+		for _, b := range data[end:img.start] {
+			if b != 0 {
+				return 0, fmt.Errorf("%w: data between images", ErrTrailingData)
+			}
+		}
+		// Appended image is walked without its own MPF index
+		imgEnd, _, err := walkJPEG(data[img.start : img.start+img.size])
+		if err != nil {
+			return 0, err
+		}
+		end = img.start + imgEnd
+	}
+	return end, nil
+}
+
+// walkJPEG walks through JPEG segments & entropy-coded data & returns offset after EOI marker
+// & images indexed by MPF segment
+func walkJPEG(data []byte) (int, []jpegImage, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, nil, errors.New("JPEG is malformed")
+	}
+
+	var images []jpegImage
+	pos := 2
+	for {
+		if pos+2 > len(data) {
+			return 0, nil, errTruncated
+		}
+		if data[pos] != 0xFF {
+			return 0, nil, errors.New("JPEG is malformed")
+		}
+		marker := data[pos+1]
+		// Fill bytes may precede marker
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		pos += 2
+
+		// EOI, RST & TEM markers have no payload
+		if marker == 0xD9 {
+			return pos, images, nil
+		}
+		if (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			continue
+		}
+
+		if pos+2 > len(data) {
+			return 0, nil, errTruncated
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 {
+			return 0, nil, errors.New("JPEG is malformed")
+		}
+		if pos+length > len(data) {
+			return 0, nil, errTruncated
+		}
+
+		// APP2 segment of Multi-Picture Format indexes images appended to this one
+		if payload := data[pos+2 : pos+length]; marker == 0xE2 && bytes.HasPrefix(payload, mpfIdentifier) {
+			var err error
+			images, err = mpfImages(payload[len(mpfIdentifier):], pos+2+len(mpfIdentifier))
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		pos += length
+
+		// Entropy-coded data of SOS lasts till marker other than stuffed zero & RST
+		if marker == 0xDA {
+			for {
+				if pos+2 > len(data) {
+					return 0, nil, errTruncated
+				}
+				if next := data[pos+1]; data[pos] == 0xFF && next != 0x00 && (next < 0xD0 || next > 0xD7) {
+					break
+				}
+				pos++
+			}
+		}
+	}
+}
+
+var mpfIdentifier = []byte("MPF\x00")
+
+// mpfTagEntry is a tag of MP index IFD with entries of images
+const mpfTagEntry = 0xB002
+
+// mpfImages returns images except the first one from MP index IFD, their offsets are relative
+// to MP header which starts at given offset of file
+func mpfImages(header []byte, offset int) ([]jpegImage, error) {
+	errMalformed := errors.New("MPF index is malformed")
+	if len(header) < 8 {
+		return nil, errMalformed
+	}
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, errMalformed
+	}
+
+	ifd := int64(order.Uint32(header[4:]))
+	if ifd+2 > int64(len(header)) {
+		return nil, errMalformed
+	}
+	count := int64(order.Uint16(header[ifd:]))
+	for i := int64(0); i < count; i++ {
+		tag := ifd + 2 + i*12
+		if tag+12 > int64(len(header)) {
+			return nil, errMalformed
+		}
+		if order.Uint16(header[tag:]) != mpfTagEntry {
+			continue
+		}
+
+		// Entry is attributes (4), size (4), offset (4) & dependent images (2 + 2)
+		size := int64(order.Uint32(header[tag+4:]))
+		entries := int64(order.Uint32(header[tag+8:]))
+		if size%16 != 0 || entries+size > int64(len(header)) {
+			return nil, errMalformed
+		}
+		var images []jpegImage
+		for entry := entries; entry < entries+size; entry += 16 {
+			// The first image has zero offset, it's the file itself
+			imgSize, imgOffset := order.Uint32(header[entry+4:]), order.Uint32(header[entry+8:])
+			if imgOffset != 0 {
+				images = append(images, jpegImage{start: offset + int(imgOffset), size: int(imgSize)})
+			}
+		}
+		return images, nil
+	}
+	return nil, nil
+}
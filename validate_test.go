@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeTestJPEG() []byte {
+	buf := bytes.NewBuffer(nil)
+	jpeg.Encode(buf, testQuadrants(), nil)
+	return buf.Bytes()
+}
+
+// corruptPNGData flips byte of IDAT chunk data keeping PNG structure
+func corruptPNGData(data []byte) []byte {
+	corrupted := append([]byte{}, data...)
+	pos := bytes.Index(corrupted, []byte("IDAT"))
+	corrupted[pos+6] ^= 0xff
+	return corrupted
+}
+
+// encodeTestMPF returns JPEG with MPF segment indexing appended image & data between images
+func encodeTestMPF(appended []byte, gap []byte) []byte {
+	primary := encodeTestJPEG()
+	// MP header is at offset 10 after SOI, APP2 marker, length & identifier
+	const headerOffset, segmentLength = 10, 2 + 4 + 8 + 2 + 12 + 4 + 32
+	header := bytes.NewBuffer(nil)
+	header.WriteString("MM\x00*")
+	binary.Write(header, binary.BigEndian, []uint32{8})
+	binary.Write(header, binary.BigEndian, uint16(1))
+	binary.Write(header, binary.BigEndian, []uint16{mpfTagEntry, 7})
+	binary.Write(header, binary.BigEndian, []uint32{32, 8 + 2 + 12 + 4, 0})
+	primarySize := len(primary) + 2 + segmentLength
+	binary.Write(header, binary.BigEndian, []uint32{0x20030000, uint32(primarySize), 0, 0})
+	binary.Write(header, binary.BigEndian, []uint32{0, uint32(len(appended)), uint32(primarySize + len(gap) - headerOffset), 0})
+
+	result := []byte{0xFF, 0xD8, 0xFF, 0xE2, 0, segmentLength}
+	result = append(append(result, "MPF\x00"...), header.Bytes()...)
+	result = append(result, primary[2:]...)
+	return append(append(result, gap...), appended...)
+}
+
+func TestValidateImage(t *testing.T) {
+	png, gif, jpg := encodeTestPNG(20, 10), encodeTestGIF(3), encodeTestJPEG()
+	zip := []byte("PK\x03\x04polyglot")
+
+	cases := []struct {
+		name       string
+		data       []byte
+		fileType   string
+		fullDecode bool
+		valid      bool
+	}{
+		{"png", png, MIMEImagePNG, true, true},
+		{"gif", gif, MIMEImageGIF, true, true},
+		{"jpeg", jpg, MIMEImageJPEG, true, true},
+		{"zero padding", append(append([]byte{}, jpg...), 0, 0, 0), MIMEImageJPEG, false, true},
+		{"type mismatch", gif, MIMEImagePNG, false, false},
+		{"truncated png", png[:len(png)-6], MIMEImagePNG, false, false},
+		{"truncated gif", gif[:len(gif)-1], MIMEImageGIF, false, false},
+		{"truncated jpeg", jpg[:len(jpg)-2], MIMEImageJPEG, false, false},
+		{"png with trailing data", append(append([]byte{}, png...), zip...), MIMEImagePNG, false, false},
+		{"gif with trailing data", append(append([]byte{}, gif...), zip...), MIMEImageGIF, false, false},
+		{"jpeg with trailing data", append(append([]byte{}, jpg...), zip...), MIMEImageJPEG, false, false},
+		{"mpf", encodeTestMPF(jpg, nil), MIMEImageJPEG, true, true},
+		{"mpf with padding", append(encodeTestMPF(jpg, []byte{0, 0}), 0), MIMEImageJPEG, false, true},
+		{"mpf with data between images", encodeTestMPF(jpg, zip), MIMEImageJPEG, false, false},
+		{"mpf with trailing data", append(encodeTestMPF(jpg, nil), zip...), MIMEImageJPEG, false, false},
+		{"mpf with truncated image", encodeTestMPF(jpg[:len(jpg)-2], nil), MIMEImageJPEG, false, false},
+		{"mpf indexing not an image", encodeTestMPF(zip, nil), MIMEImageJPEG, false, false},
+		{"corrupted by header", corruptPNGData(png), MIMEImagePNG, false, true},
+		{"corrupted by decode", corruptPNGData(png), MIMEImagePNG, true, false},
+		{"not an image", []byte("not an image"), MIMEImagePNG, false, false},
+	}
+
+	for _, c := range cases {
+		err := ValidateImage(c.data, c.fileType, c.fullDecode)
+		assert.Equal(t, c.valid, err == nil, c.name, err)
+	}
+
+	err := ValidateImage(append(append([]byte{}, png...), zip...), MIMEImagePNG, false)
+	assert.True(t, errors.Is(err, ErrTrailingData))
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// WatermarkImageTTL is a period of reloading watermark overlay from storage
+const WatermarkImageTTL = time.Minute
+
+// Watermark defaults
+const (
+	DefaultWatermarkSize     = 24
+	DefaultWatermarkColor    = "#ffffff"
+	DefaultWatermarkPosition = "bottom-right"
+)
+
+// Watermark positions
+var watermarkPositions = map[string][2]int{
+	"top-left":     {-1, -1},
+	"top":          {0, -1},
+	"top-right":    {1, -1},
+	"left":         {-1, 0},
+	"center":       {0, 0},
+	"right":        {1, 0},
+	"bottom-left":  {-1, 1},
+	"bottom":       {0, 1},
+	"bottom-right": {1, 1},
+}
+
+// Watermark represents text or image overlay composited on images.
+// Zero opacity means opaque watermark.
+type Watermark struct {
+	Text     string          `json:"text"`
+	Font     string          `json:"font"` // Path to TrueType/OpenType font, Go Regular by default
+	Size     float64         `json:"size"` // In px
+	Color    string          `json:"color"`
+	Image    *WatermarkImage `json:"image"`
+	Opacity  float64         `json:"opacity"`
+	Position string          `json:"position"`
+	Margin   int             `json:"margin"`
+	Tile     bool            `json:"tile"`
+
+	text image.Image
+
+	mu       sync.Mutex
+	overlay  image.Image
+	loadedAt time.Time
+}
+
+// WatermarkImage represents overlay image in storage.
+type WatermarkImage struct {
+	Bucket string `json:"bucket"`
+	Object string `json:"object"`
+}
+
+// prepare validates watermark & renders its text
+func (wm *Watermark) prepare() error {
+	if (wm.Text == "") == (wm.Image == nil) {
+		return errors.New("Watermark requires either text or image")
+	}
+	if wm.Image != nil && (wm.Image.Bucket == "" || wm.Image.Object == "") {
+		return errors.New("Watermark image requires bucket & object")
+	}
+	if wm.Opacity < 0 || wm.Opacity > 1 {
+		return errors.New("Watermark opacity must be within 0..1")
+	}
+	if wm.Position == "" {
+		wm.Position = DefaultWatermarkPosition
+	}
+	if _, ok := watermarkPositions[wm.Position]; !ok {
+		return errors.New("Unknown watermark position " + wm.Position)
+	}
+
+	if wm.Text == "" {
+		return nil
+	}
+
+	if wm.Size == 0 {
+		wm.Size = DefaultWatermarkSize
+	}
+	if wm.Color == "" {
+		wm.Color = DefaultWatermarkColor
+	}
+	textColor, err := parseHexColor(wm.Color)
+	if err != nil {
+		return err
+	}
+
+	fontData := goregular.TTF
+	if wm.Font != "" {
+		if fontData, err = ioutil.ReadFile(wm.Font); err != nil {
+			return err
+		}
+	}
+	wm.text, err = renderText(wm.Text, fontData, wm.Size, textColor)
+	return err
+}
+
+// parseHexColor parses color in #rrggbb format
+func parseHexColor(s string) (color.NRGBA, error) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(s) != 7 || s[0] != '#' {
+		return color.NRGBA{}, errors.New("Color must be in #rrggbb format")
+	}
+	return color.NRGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 0xff}, nil
+}
+
+// renderText returns image with text of given size & color on transparent background
+func renderText(text string, fontData []byte, size float64, textColor color.NRGBA) (image.Image, error) {
+	parsed, err := opentype.Parse(fontData)
+	if err != nil {
+		return nil, err
+	}
+	face, err := opentype.NewFace(parsed, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	drawer := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(textColor),
+		Face: face,
+		Dot:  fixed.Point26_6{Y: metrics.Ascent},
+	}
+	drawer.DrawString(text)
+	return img, nil
+}
+
+// mark returns watermark image, overlay is reloaded from storage periodically
+func (wm *Watermark) mark(storage *minio.Client) (image.Image, error) {
+	if wm.text != nil {
+		return wm.text, nil
+	}
+
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.overlay != nil && time.Since(wm.loadedAt) < WatermarkImageTTL {
+		return wm.overlay, nil
+	}
+
+	overlay, err := loadWatermarkImage(storage, wm.Image)
+	if err != nil {
+		// Keep previous overlay if storage is temporarily unavailable
+		if wm.overlay != nil {
+			return wm.overlay, nil
+		}
+		return nil, err
+	}
+	wm.overlay, wm.loadedAt = overlay, time.Now()
+	return overlay, nil
+}
+
+func loadWatermarkImage(storage *minio.Client, wi *WatermarkImage) (image.Image, error) {
+	if storage == nil {
+		return nil, errors.New("Storage isn't available")
+	}
+	obj, err := storage.GetObject(wi.Bucket, wi.Object, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	overlay, _, err := image.Decode(obj)
+	return overlay, err
+}
+
+// Draw composites watermark mark on image.
+// Mark is scaled down if it doesn't fit into image with margins.
+func (wm *Watermark) Draw(dst draw.Image, mark image.Image) {
+	bounds := dst.Bounds()
+	mark = fitMark(mark, bounds.Dx()-2*wm.Margin, bounds.Dy()-2*wm.Margin)
+	if mark == nil {
+		return
+	}
+
+	opacity := wm.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	mask := image.NewUniform(color.Alpha{uint8(opacity*0xff + 0.5)})
+
+	size := mark.Bounds().Size()
+	for _, pt := range wm.positions(bounds, size) {
+		draw.DrawMask(dst, image.Rectangle{pt, pt.Add(size)}, mark, mark.Bounds().Min, mask, image.Point{}, draw.Over)
+	}
+}
+
+// positions returns top left corners of marks within bounds
+func (wm *Watermark) positions(bounds image.Rectangle, size image.Point) []image.Point {
+	if wm.Tile {
+		var points []image.Point
+		for y := bounds.Min.Y + wm.Margin; y < bounds.Max.Y; y += size.Y + wm.Margin {
+			for x := bounds.Min.X + wm.Margin; x < bounds.Max.X; x += size.X + wm.Margin {
+				points = append(points, image.Pt(x, y))
+			}
+		}
+		return points
+	}
+
+	align := watermarkPositions[wm.Position]
+	place := func(min int, max int, size int, align int) int {
+		switch align {
+		case -1:
+			return min + wm.Margin
+		case 1:
+			return max - wm.Margin - size
+		}
+		return min + (max-min-size)/2
+	}
+	return []image.Point{{
+		place(bounds.Min.X, bounds.Max.X, size.X, align[0]),
+		place(bounds.Min.Y, bounds.Max.Y, size.Y, align[1]),
+	}}
+}
+
+// fitMark scales mark down to fit into given size keeping aspect ratio
+func fitMark(mark image.Image, width int, height int) image.Image {
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+	size := mark.Bounds().Size()
+	if size.X <= width && size.Y <= height {
+		return mark
+	}
+
+	fitWidth, fitHeight := fitDimensions(size.X, size.Y, []int{width, height}, false)
+	scaled := image.NewNRGBA(image.Rect(0, 0, fitWidth, fitHeight))
+	xdraw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), mark, mark.Bounds(), xdraw.Src, nil)
+	return scaled
+}
+
+// WatermarkByName returns configured watermark or nil if name is empty.
+func (ctx *AppContext) WatermarkByName(name string) (*Watermark, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if ctx.Buckets != nil {
+		if wm, ok := ctx.Buckets.Watermarks[name]; ok {
+			return wm, nil
+		}
+	}
+	return nil, errors.New("Unknown watermark " + name)
+}
+
+// watermarkFunc returns function drawing request watermark on image
+func watermarkFunc(ctx *AppContext) (func(draw.Image), error) {
+	if ctx.Watermark == nil {
+		return nil, nil
+	}
+	mark, err := ctx.Watermark.mark(ctx.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return func(img draw.Image) {
+		ctx.Watermark.Draw(img, mark)
+	}, nil
+}
+
+// watermarkImage composites request watermark on JPEG or PNG image.
+// GIFs are watermarked frame by frame on resizing, see ResizeGIF.
+func watermarkImage(reqCtx context.Context, ctx *AppContext, input io.Reader, mimeType string) (io.Reader, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startSpan(reqCtx, "image.watermark")
+	apply, err := watermarkFunc(ctx)
+	if err == nil {
+		data, err = DrawWatermark(data, mimeType, jpegQuality(ctx.Options), apply)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// DrawWatermark decodes JPEG or PNG image, draws watermark & encodes it back.
+func DrawWatermark(data []byte, mimeType string, quality int, apply func(draw.Image)) ([]byte, error) {
+	return TransformStill(data, mimeType, quality, func(img *image.NRGBA) (*image.NRGBA, error) {
+		apply(img)
+		return img, nil
+	})
+}
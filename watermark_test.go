@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatermarkPrepare(t *testing.T) {
+	cases := []struct {
+		wm    *Watermark
+		valid bool
+	}{
+		{&Watermark{Text: "ACME"}, true},
+		{&Watermark{Text: "ACME", Color: "#ff0000", Size: 12, Position: "top-left"}, true},
+		{&Watermark{Image: &WatermarkImage{Bucket: "assets", Object: "logo.png"}}, true},
+		{&Watermark{}, false},
+		{&Watermark{Text: "ACME", Image: &WatermarkImage{Bucket: "assets", Object: "logo.png"}}, false},
+		{&Watermark{Image: &WatermarkImage{Bucket: "assets"}}, false},
+		{&Watermark{Text: "ACME", Color: "red"}, false},
+		{&Watermark{Text: "ACME", Position: "middle"}, false},
+		{&Watermark{Text: "ACME", Opacity: 1.5}, false},
+		{&Watermark{Text: "ACME", Font: "unknown.ttf"}, false},
+	}
+
+	for _, c := range cases {
+		err := c.wm.prepare()
+		assert.Equal(t, c.valid, err == nil, c.wm)
+	}
+
+	wm := &Watermark{Text: "ACME"}
+	assert.Nil(t, wm.prepare())
+	assert.Equal(t, DefaultWatermarkPosition, wm.Position)
+	assert.True(t, wm.text.Bounds().Dx() > 0)
+}
+
+func TestWatermarkPositions(t *testing.T) {
+	bounds := image.Rect(0, 0, 100, 50)
+	size := image.Pt(20, 10)
+	cases := []struct {
+		wm       *Watermark
+		expected []image.Point
+	}{
+		{&Watermark{Position: "top-left", Margin: 5}, []image.Point{{5, 5}}},
+		{&Watermark{Position: "bottom-right", Margin: 5}, []image.Point{{75, 35}}},
+		{&Watermark{Position: "center"}, []image.Point{{40, 20}}},
+		{&Watermark{Position: "bottom"}, []image.Point{{40, 40}}},
+		{&Watermark{Tile: true, Margin: 30}, []image.Point{{30, 30}, {80, 30}}},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.wm.positions(bounds, size), c.wm)
+	}
+}
+
+func TestDrawWatermark(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	buf := bytes.NewBuffer(nil)
+	png.Encode(buf, src)
+
+	// Mark is larger than image, so it's scaled down to 16x16
+	mark := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(mark, mark.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	wm := &Watermark{Position: "bottom-right", Margin: 2, Opacity: 0.5}
+	apply := func(img draw.Image) {
+		wm.Draw(img, mark)
+	}
+
+	data, err := DrawWatermark(buf.Bytes(), MIMEImagePNG, ResizeJpegQuality, apply)
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, color.NRGBAModel.Convert(img.At(1, 1)))
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, color.NRGBAModel.Convert(img.At(20, 10)))
+	assert.Equal(t, color.NRGBA{127, 127, 127, 255}, color.NRGBAModel.Convert(img.At(30, 10)))
+
+	_, err = DrawWatermark(buf.Bytes(), MIMEImageGIF, ResizeJpegQuality, apply)
+	assert.NotNil(t, err)
+}
+
+func TestDrawWatermarkText(t *testing.T) {
+	wm := &Watermark{Text: "ACME", Color: "#000000", Size: 12, Position: "top-left"}
+	assert.Nil(t, wm.prepare())
+
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	wm.Draw(img, wm.text)
+
+	// Text is drawn within its bounds only
+	dark := func(r image.Rectangle) bool {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if img.NRGBAAt(x, y).R < 0x80 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	assert.True(t, dark(wm.text.Bounds()))
+	assert.False(t, dark(image.Rect(50, 20, 100, 50)))
+}
+
+func TestResizeGIFWithWatermark(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	apply := func(img draw.Image) {
+		draw.Draw(img, image.Rect(36, 16, 40, 20), image.NewUniform(red), image.Point{}, draw.Src)
+	}
+
+	result, err := ResizeGIF(testAnimatedGIF(), GIFOptions{Watermark: apply})
+	assert.Nil(t, err)
+	g, err := gif.DecodeAll(bytes.NewReader(result))
+	assert.Nil(t, err)
+	assert.Len(t, g.Image, 3)
+	assert.Equal(t, []int{10, 20, 30}, g.Delay)
+
+	for _, frame := range g.Image {
+		// Frames are full, so background of the first frame is kept
+		assert.Equal(t, image.Rect(0, 0, 40, 20), frame.Bounds())
+		assert.Equal(t, red, color.NRGBAModel.Convert(frame.At(38, 18)))
+		assert.Equal(t, color.NRGBA{0, 0, 255, 255}, color.NRGBAModel.Convert(frame.At(30, 2)))
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook event types
+const (
+	EventImageUploaded    = "image.uploaded"
+	EventImageDeleted     = "image.deleted"
+	EventVariantGenerated = "variant.generated"
+	EventUploadRejected   = "upload.rejected"
+)
+
+var webhookEventTypes = []string{EventImageUploaded, EventImageDeleted, EventVariantGenerated, EventUploadRejected}
+
+// Headers of webhook requests
+const (
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Webhook delivery results used as metric labels
+const (
+	WebhookDelivered = "delivered"
+	WebhookRetried   = "retried"
+	WebhookFailed    = "failed"
+	WebhookDropped   = "dropped"
+)
+
+// MaxWebhookBackoff limits delay between delivery attempts
+const MaxWebhookBackoff = time.Hour
+
+// outboxFailedDir is a subdirectory of outbox for deliveries exceeded attempts
+const outboxFailedDir = "failed"
+
+// errEndpointRemoved is returned for deliveries to endpoints removed from config
+var errEndpointRemoved = errors.New("Webhook endpoint is removed")
+
+// WebhookEndpoint represents endpoint receiving events of bucket.
+type WebhookEndpoint struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"` // All events by default
+}
+
+// Subscribed reports whether endpoint receives events of given type.
+func (e *WebhookEndpoint) Subscribed(eventType string) bool {
+	return len(e.Events) == 0 || contains(e.Events, eventType, "")
+}
+
+// validate checks endpoint URL, secret & event types
+func (e *WebhookEndpoint) validate() error {
+	if !strings.HasPrefix(e.URL, "http://") && !strings.HasPrefix(e.URL, "https://") {
+		return errors.New("Webhook URL must be absolute HTTP URL")
+	}
+	if e.Secret == "" {
+		return errors.New("Webhook secret can't be empty")
+	}
+	for _, eventType := range e.Events {
+		if !contains(webhookEventTypes, eventType, "") {
+			return errors.New("Unknown webhook event " + eventType)
+		}
+	}
+	return nil
+}
+
+// WebhookEvent represents image lifecycle event
+type WebhookEvent struct {
+	ID     string                 `json:"id"`
+	Type   string                 `json:"type"`
+	Time   time.Time              `json:"time"`
+	Bucket string                 `json:"bucket"`
+	File   string                 `json:"file,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+// NewWebhookEvent returns event with unique ID & current time.
+func NewWebhookEvent(eventType string, bucket string, file string, data map[string]interface{}) WebhookEvent {
+	return WebhookEvent{
+		ID:     generateID().String(),
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		Bucket: bucket,
+		File:   file,
+		Data:   data,
+	}
+}
+
+// SignWebhook returns HMAC-SHA256 of timestamp & body joined by dot in hex prefixed by "sha256=".
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDelivery is an event pending delivery to endpoint
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	Bucket      string          `json:"bucket"`
+	URL         string          `json:"url"`
+	EventID     string          `json:"eventId"`
+	Event       json.RawMessage `json:"event"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	inFlight    bool
+}
+
+// Outbox delivers webhooks with retries & exponential backoff.
+// Deliveries are persisted as files of directory to survive restarts, they're kept in memory only without it.
+type Outbox struct {
+	dir         string
+	endpoints   func(bucket string) []WebhookEndpoint
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+
+	mu         sync.Mutex
+	deliveries map[string]*webhookDelivery
+	queue      chan *webhookDelivery
+	wake       chan struct{}
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewOutbox returns outbox with deliveries restored from directory.
+// Endpoints are looked up by bucket on every attempt, so deliveries to removed endpoints are dropped.
+func NewOutbox(dir string, endpoints func(bucket string) []WebhookEndpoint, timeout time.Duration, maxAttempts int, backoff time.Duration) (*Outbox, error) {
+	o := &Outbox{
+		dir:         dir,
+		endpoints:   endpoints,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		deliveries:  map[string]*webhookDelivery{},
+		queue:       make(chan *webhookDelivery),
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	if dir == "" {
+		return o, nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, outboxFailedDir), 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		d := &webhookDelivery{}
+		if err = json.Unmarshal(data, d); err != nil {
+			return nil, fmt.Errorf("Outbox delivery %s is malformed: %w", file, err)
+		}
+		o.deliveries[d.ID] = d
+	}
+	return o, nil
+}
+
+// initOutbox returns outbox due to config or nil if no bucket has webhooks
+func initOutbox(cfg *Config, buckets *BucketsConfig) (*Outbox, error) {
+	if buckets == nil {
+		return nil, nil
+	}
+	configured := false
+	for _, policy := range buckets.Buckets {
+		configured = configured || len(policy.Webhooks) > 0
+	}
+	if !configured {
+		return nil, nil
+	}
+
+	endpoints := func(bucket string) []WebhookEndpoint {
+		if policy, ok := buckets.Buckets[bucket]; ok {
+			return policy.Webhooks
+		}
+		return nil
+	}
+	outbox, err := NewOutbox(cfg.WebhookOutboxDir, endpoints, cfg.WebhookTimeout, cfg.WebhookMaxAttempts, cfg.WebhookBackoff)
+	if err != nil {
+		return nil, err
+	}
+	outbox.Start(cfg.WebhookWorkers)
+	return outbox, nil
+}
+
+// Enqueue persists deliveries of event to subscribed endpoints of its bucket.
+func (o *Outbox) Enqueue(event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range o.endpoints(event.Bucket) {
+		if !endpoint.Subscribed(event.Type) {
+			continue
+		}
+		d := &webhookDelivery{
+			ID:          generateID().String(),
+			Bucket:      event.Bucket,
+			URL:         endpoint.URL,
+			EventID:     event.ID,
+			Event:       body,
+			NextAttempt: time.Now(),
+		}
+		if err = o.persist(d); err != nil {
+			return err
+		}
+		o.mu.Lock()
+		o.deliveries[d.ID] = d
+		o.mu.Unlock()
+	}
+
+	o.notify()
+	return nil
+}
+
+// Pending returns number of deliveries waiting for delivery.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.deliveries)
+}
+
+// Start starts dispatching deliveries by given number of workers.
+func (o *Outbox) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		o.wg.Add(1)
+		go func() {
+			defer o.wg.Done()
+			for d := range o.queue {
+				o.complete(d, o.deliver(d))
+			}
+		}()
+	}
+	o.wg.Add(1)
+	go o.dispatch()
+}
+
+// Close stops dispatching & waits for deliveries in flight, pending ones stay persisted.
+func (o *Outbox) Close() {
+	close(o.stop)
+	o.wg.Wait()
+}
+
+// notify wakes dispatcher up
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch passes due deliveries to workers & sleeps till the next due one
+func (o *Outbox) dispatch() {
+	defer o.wg.Done()
+	defer close(o.queue)
+
+	for {
+		due, next := o.due()
+		for _, d := range due {
+			select {
+			case o.queue <- d:
+			case <-o.stop:
+				return
+			}
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-timer.C:
+		case <-o.wake:
+			timer.Stop()
+		case <-o.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// due marks due deliveries as in flight & returns them with duration till the next due one
+func (o *Outbox) due() ([]*webhookDelivery, time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	next := MaxWebhookBackoff
+	var due []*webhookDelivery
+	for _, d := range o.deliveries {
+		if d.inFlight {
+			continue
+		}
+		if wait := d.NextAttempt.Sub(now); wait > 0 {
+			if wait < next {
+				next = wait
+			}
+			continue
+		}
+		d.inFlight = true
+		due = append(due, d)
+	}
+	return due, next
+}
+
+// deliver posts signed event to endpoint
+func (o *Outbox) deliver(d *webhookDelivery) error {
+	var endpoint *WebhookEndpoint
+	for _, e := range o.endpoints(d.Bucket) {
+		if e.URL == d.URL {
+			endpoint = &e
+			break
+		}
+	}
+	if endpoint == nil {
+		return errEndpointRemoved
+	}
+
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(d.Event))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", MIMEApplicationJSON)
+	req.Header.Set(WebhookIDHeader, d.EventID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(endpoint.Secret, timestamp, d.Event))
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded unsuccessfully with status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// complete removes delivered delivery or schedules the next attempt
+func (o *Outbox) complete(d *webhookDelivery, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	d.inFlight = false
+
+	switch {
+	case err == nil:
+		observeWebhook(WebhookDelivered)
+	case errors.Is(err, errEndpointRemoved):
+		observeWebhook(WebhookDropped)
+	case d.Attempts+1 >= o.maxAttempts:
+		observeWebhook(WebhookFailed)
+		log.Printf("WEBHOOK_FAILED %s to %s after %d attempts: %v\n", d.EventID, d.URL, d.Attempts+1, err)
+	default:
+		observeWebhook(WebhookRetried)
+		d.Attempts++
+		backoff := o.backoff << uint(d.Attempts-1)
+		if backoff <= 0 || backoff > MaxWebhookBackoff {
+			backoff = MaxWebhookBackoff
+		}
+		d.NextAttempt = time.Now().Add(backoff)
+		if err := o.persist(d); err != nil {
+			log.Println("CANT_PERSIST_WEBHOOK", err)
+		}
+		o.notify()
+		return
+	}
+
+	delete(o.deliveries, d.ID)
+	if o.dir == "" {
+		return
+	}
+	// Failed deliveries are kept for investigation
+	if err != nil && !errors.Is(err, errEndpointRemoved) {
+		err = os.Rename(o.path(d), filepath.Join(o.dir, outboxFailedDir, d.ID+".json"))
+	} else {
+		err = os.Remove(o.path(d))
+	}
+	if err != nil {
+		log.Println("CANT_REMOVE_WEBHOOK", err)
+	}
+}
+
+// persist writes delivery to outbox atomically
+func (o *Outbox) persist(d *webhookDelivery) error {
+	if o.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := o.path(d) + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path(d))
+}
+
+func (o *Outbox) path(d *webhookDelivery) string {
+	return filepath.Join(o.dir, d.ID+".json")
+}
+
+// emitEvent enqueues event to webhooks of bucket, failures are logged only
+func emitEvent(ctx *AppContext, eventType string, bucket string, file string, data map[string]interface{}) {
+	if ctx.Outbox == nil {
+		return
+	}
+	if err := ctx.Outbox.Enqueue(NewWebhookEvent(eventType, bucket, file, data)); err != nil {
+		log.Println("CANT_ENQUEUE_WEBHOOK", err)
+	}
+}
+
+// emitRejection enqueues upload.rejected event with error code & reason
+func emitRejection(ctx *AppContext, bucket string, code string, err error) {
+	data := map[string]interface{}{"code": code}
+	if err != nil {
+		data["reason"] = err.Error()
+	}
+	emitEvent(ctx, EventUploadRejected, bucket, "", data)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignWebhook(t *testing.T) {
+	signature := SignWebhook("secret", "1700000000", []byte(`{"id":"1"}`))
+	assert.Regexp(t, "^sha256=[0-9a-f]{64}$", signature)
+	assert.Equal(t, signature, SignWebhook("secret", "1700000000", []byte(`{"id":"1"}`)))
+	assert.NotEqual(t, signature, SignWebhook("secret", "1700000001", []byte(`{"id":"1"}`)))
+	assert.NotEqual(t, signature, SignWebhook("another", "1700000000", []byte(`{"id":"1"}`)))
+}
+
+func TestWebhookEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint WebhookEndpoint
+		valid    bool
+	}{
+		{WebhookEndpoint{URL: "https://example.com/hook", Secret: "secret"}, true},
+		{WebhookEndpoint{URL: "http://example.com/hook", Secret: "secret", Events: []string{EventImageDeleted}}, true},
+		{WebhookEndpoint{URL: "example.com/hook", Secret: "secret"}, false},
+		{WebhookEndpoint{URL: "https://example.com/hook"}, false},
+		{WebhookEndpoint{URL: "https://example.com/hook", Secret: "secret", Events: []string{"image.resized"}}, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.valid, c.endpoint.validate() == nil, c.endpoint)
+	}
+
+	assert.True(t, cases[0].endpoint.Subscribed(EventVariantGenerated))
+	assert.True(t, cases[1].endpoint.Subscribed(EventImageDeleted))
+	assert.False(t, cases[1].endpoint.Subscribed(EventImageUploaded))
+}
+
+// webhookReceiver records verified events & fails the first given number of requests
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	events   []WebhookEvent
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.attempts++
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get(WebhookSignatureHeader) != SignWebhook("secret", r.Header.Get(WebhookTimestampHeader), body) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if wr.attempts <= wr.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	event := WebhookEvent{}
+	json.Unmarshal(body, &event)
+	wr.events = append(wr.events, event)
+}
+
+func (wr *webhookReceiver) received() ([]WebhookEvent, int) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.events, wr.attempts
+}
+
+func TestOutbox(t *testing.T) {
+	receiver := &webhookReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	endpoints := func(bucket string) []WebhookEndpoint {
+		if bucket != "docs" {
+			return nil
+		}
+		return []WebhookEndpoint{
+			{URL: server.URL, Secret: "secret"},
+			{URL: server.URL + "/deleted", Secret: "secret", Events: []string{EventImageDeleted}},
+		}
+	}
+	outbox, err := NewOutbox("", endpoints, time.Second, 5, time.Millisecond)
+	assert.Nil(t, err)
+	outbox.Start(2)
+	defer outbox.Close()
+
+	event := NewWebhookEvent(EventImageUploaded, "docs", "a.jpg", map[string]interface{}{"size": 3.0})
+	assert.Nil(t, outbox.Enqueue(event))
+	assert.Nil(t, outbox.Enqueue(NewWebhookEvent(EventImageUploaded, "photos", "b.jpg", nil)))
+
+	// Event is delivered after failed attempts
+	assert.Eventually(t, func() bool { return outbox.Pending() == 0 }, 5*time.Second, 5*time.Millisecond)
+	events, attempts := receiver.received()
+	assert.Equal(t, 3, attempts)
+	assert.Len(t, events, 1)
+	assert.Equal(t, event.ID, events[0].ID)
+	assert.Equal(t, event.Data, events[0].Data)
+}
+
+func TestOutboxPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	receiver := &webhookReceiver{failures: 100}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	webhooks := []WebhookEndpoint{{URL: server.URL, Secret: "secret"}}
+	endpoints := func(bucket string) []WebhookEndpoint { return webhooks }
+
+	// Deliveries are restored from directory
+	outbox, err := NewOutbox(dir, endpoints, time.Second, 3, time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, outbox.Enqueue(NewWebhookEvent(EventImageDeleted, "docs", "a.jpg", nil)))
+	assert.Nil(t, outbox.Enqueue(NewWebhookEvent(EventImageDeleted, "docs", "b.jpg", nil)))
+	restored, err := NewOutbox(dir, endpoints, time.Second, 3, time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, restored.Pending())
+
+	// Deliveries exceeded attempts are moved to failed directory
+	restored.Start(1)
+	assert.Eventually(t, func() bool { return restored.Pending() == 0 }, 5*time.Second, 5*time.Millisecond)
+	restored.Close()
+	_, attempts := receiver.received()
+	assert.Equal(t, 6, attempts)
+	failed, _ := filepath.Glob(filepath.Join(dir, outboxFailedDir, "*.json"))
+	assert.Len(t, failed, 2)
+
+	// Deliveries to removed endpoints are dropped
+	assert.Nil(t, outbox.Enqueue(NewWebhookEvent(EventImageDeleted, "docs", "c.jpg", nil)))
+	webhooks = []WebhookEndpoint{{URL: server.URL + "/another", Secret: "secret"}}
+	dropped, err := NewOutbox(dir, endpoints, time.Second, 3, time.Millisecond)
+	assert.Nil(t, err)
+	dropped.Start(1)
+	assert.Eventually(t, func() bool { return dropped.Pending() == 0 }, 5*time.Second, 5*time.Millisecond)
+	dropped.Close()
+	pending, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Empty(t, pending)
+	_, attempts = receiver.received()
+	assert.Equal(t, 6, attempts)
+
+	// Malformed delivery isn't loaded
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "malformed.json"), []byte("{"), 0600))
+	_, err = NewOutbox(dir, endpoints, time.Second, 3, time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+func TestDeleteHandler(t *testing.T) {
+	router := InitRouter(&AppContext{Config: &Config{AuthAnonymousRead: true}, Buckets: loadTestBucketsConfig(t)})
+
+	// Deletion requires authenticated client
+	req, err := http.NewRequest("DELETE", "/docs/a.jpg", nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	req, _ = http.NewRequest("DELETE", "/unknown/a.jpg", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
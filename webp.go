@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math/bits"
+	"sort"
+)
+
+// WebP lossless (VP8L) encoder.
+// It's a simple one: subtract green transform, runs of repeated pixels & single prefix code group.
+// Output is larger than libwebp's one, but it's lossless & doesn't need cgo.
+
+const (
+	vp8lSignature       = 0x2f
+	vp8lMaxCodeLength   = 15
+	vp8lMaxCLCodeLength = 7
+	vp8lMaxRunLength    = 4096
+	vp8lNumLiterals     = 256
+	vp8lNumLengthCodes  = 24
+	vp8lNumDistCodes    = 40
+	vp8lMinRunLength    = 3
+
+	// Distance code of the previous pixel in scan order, see VP8L spec distance mapping
+	vp8lPrevPixelCode = 2
+)
+
+// Order of code length code lengths, see VP8L spec
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// WebPFrame represents animation frame placed on the whole canvas.
+type WebPFrame struct {
+	Image    *image.NRGBA
+	Duration int // In ms
+}
+
+// EncodeWebP returns still lossless WebP image.
+func EncodeWebP(img *image.NRGBA) []byte {
+	buf := bytes.NewBuffer(nil)
+	vp8l := encodeVP8L(img)
+	writeRIFFHeader(buf, 4+riffChunkSize(vp8l))
+	writeRIFFChunk(buf, "VP8L", vp8l)
+	return buf.Bytes()
+}
+
+// EncodeAnimatedWebP returns animated lossless WebP image.
+// Loop count is a number of plays, 0 means infinite playback.
+func EncodeAnimatedWebP(frames []WebPFrame, loopCount int) []byte {
+	canvas := frames[0].Image.Bounds()
+
+	// VP8X: animation & alpha flags, canvas size
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 | 0x10
+	putUint24(vp8x[4:], canvas.Dx()-1)
+	putUint24(vp8x[7:], canvas.Dy()-1)
+
+	// ANIM: transparent background & loop count
+	anim := make([]byte, 6)
+	binary.LittleEndian.PutUint16(anim[4:], uint16(loopCount))
+
+	var anmfs [][]byte
+	size := 4 + riffChunkSize(vp8x) + riffChunkSize(anim)
+	for _, frame := range frames {
+		bounds := frame.Image.Bounds()
+		vp8l := encodeVP8L(frame.Image)
+
+		// ANMF: offset / 2, size, duration & flags followed by frame data
+		anmf := bytes.NewBuffer(make([]byte, 0, 16+riffChunkSize(vp8l)))
+		header := make([]byte, 16)
+		putUint24(header[0:], (bounds.Min.X-canvas.Min.X)/2)
+		putUint24(header[3:], (bounds.Min.Y-canvas.Min.Y)/2)
+		putUint24(header[6:], bounds.Dx()-1)
+		putUint24(header[9:], bounds.Dy()-1)
+		putUint24(header[12:], frame.Duration)
+		header[15] = 0x02 // Don't blend, frames are composed already
+		anmf.Write(header)
+		writeRIFFChunk(anmf, "VP8L", vp8l)
+
+		anmfs = append(anmfs, anmf.Bytes())
+		size += riffChunkSize(anmf.Bytes())
+	}
+
+	buf := bytes.NewBuffer(nil)
+	writeRIFFHeader(buf, size)
+	writeRIFFChunk(buf, "VP8X", vp8x)
+	writeRIFFChunk(buf, "ANIM", anim)
+	for _, anmf := range anmfs {
+		writeRIFFChunk(buf, "ANMF", anmf)
+	}
+	return buf.Bytes()
+}
+
+func writeRIFFHeader(buf *bytes.Buffer, size int) {
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(size))
+	buf.WriteString("WEBP")
+}
+
+// writeRIFFChunk writes chunk padded to even size
+func writeRIFFChunk(buf *bytes.Buffer, fourCC string, data []byte) {
+	buf.WriteString(fourCC)
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func riffChunkSize(data []byte) int {
+	return 8 + len(data) + len(data)%2
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// vp8lBitWriter writes bits LSB first.
+type vp8lBitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *vp8lBitWriter) writeBits(value uint32, n uint) {
+	w.acc |= uint64(value) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *vp8lBitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
+
+// vp8lSymbol represents literal pixel or run of previous pixel if length is presented.
+type vp8lSymbol struct {
+	argb   [4]byte // Green, red, blue & alpha in coding order
+	length int
+}
+
+// prefixCode represents canonical prefix code, codes are bit reversed for LSB first writing.
+type prefixCode struct {
+	lengths []int
+	codes   []uint32
+}
+
+func (c *prefixCode) write(w *vp8lBitWriter, symbol int) {
+	w.writeBits(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// encodeVP8L returns VP8L bitstream of image
+func encodeVP8L(img *image.NRGBA) []byte {
+	bounds := img.Bounds()
+	w := &vp8lBitWriter{}
+
+	// Header: signature, size, alpha hint & version
+	w.writeBits(vp8lSignature, 8)
+	w.writeBits(uint32(bounds.Dx()-1), 14)
+	w.writeBits(uint32(bounds.Dy()-1), 14)
+	w.writeBits(boolBit(!img.Opaque()), 1)
+	w.writeBits(0, 3)
+
+	// Subtract green transform only
+	w.writeBits(1, 1)
+	w.writeBits(2, 2)
+	w.writeBits(0, 1)
+
+	// No color cache & no meta prefix codes
+	w.writeBits(0, 1)
+	w.writeBits(0, 1)
+
+	symbols := vp8lSymbols(img)
+
+	// Histograms: green with run lengths, red, blue, alpha & distance
+	histograms := [5][]int{
+		make([]int, vp8lNumLiterals+vp8lNumLengthCodes),
+		make([]int, vp8lNumLiterals),
+		make([]int, vp8lNumLiterals),
+		make([]int, vp8lNumLiterals),
+		make([]int, vp8lNumDistCodes),
+	}
+	for _, s := range symbols {
+		if s.length > 0 {
+			prefix, _, _ := vp8lPrefixEncode(s.length)
+			histograms[0][vp8lNumLiterals+prefix]++
+			distPrefix, _, _ := vp8lPrefixEncode(vp8lPrevPixelCode)
+			histograms[4][distPrefix]++
+			continue
+		}
+		for i, v := range s.argb {
+			histograms[i][v]++
+		}
+	}
+
+	var codes [5]*prefixCode
+	for i, histogram := range histograms {
+		codes[i] = writePrefixCode(w, histogram)
+	}
+
+	for _, s := range symbols {
+		if s.length > 0 {
+			prefix, extraBits, extra := vp8lPrefixEncode(s.length)
+			codes[0].write(w, vp8lNumLiterals+prefix)
+			w.writeBits(extra, extraBits)
+			distPrefix, distExtraBits, distExtra := vp8lPrefixEncode(vp8lPrevPixelCode)
+			codes[4].write(w, distPrefix)
+			w.writeBits(distExtra, distExtraBits)
+			continue
+		}
+		for i, v := range s.argb {
+			codes[i].write(w, int(v))
+		}
+	}
+
+	return w.bytes()
+}
+
+// vp8lSymbols returns transformed pixels with runs of repeated pixels as backward references
+func vp8lSymbols(img *image.NRGBA) []vp8lSymbol {
+	bounds := img.Bounds()
+	var symbols []vp8lSymbol
+	var prev [4]byte
+	run := 0
+
+	flushRun := func() {
+		for run > 0 {
+			if run < vp8lMinRunLength {
+				for ; run > 0; run-- {
+					symbols = append(symbols, vp8lSymbol{argb: prev})
+				}
+				break
+			}
+			length := run
+			if length > vp8lMaxRunLength {
+				length = vp8lMaxRunLength
+			}
+			symbols = append(symbols, vp8lSymbol{length: length})
+			run -= length
+		}
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			pixel := [4]byte{c.G, c.R - c.G, c.B - c.G, c.A}
+			if len(symbols) > 0 && pixel == prev {
+				run++
+				continue
+			}
+			flushRun()
+			symbols = append(symbols, vp8lSymbol{argb: pixel})
+			prev = pixel
+		}
+	}
+	flushRun()
+
+	return symbols
+}
+
+// vp8lPrefixEncode returns prefix code, number of extra bits & extra bits for length or distance
+func vp8lPrefixEncode(value int) (int, uint, uint32) {
+	d := value - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	high := bits.Len(uint(d)) - 1
+	second := (d >> uint(high-1)) & 1
+	extraBits := uint(high - 1)
+	return 2*high + second, extraBits, uint32(d) & (1<<extraBits - 1)
+}
+
+// writePrefixCode writes prefix code for histogram & returns it
+func writePrefixCode(w *vp8lBitWriter, histogram []int) *prefixCode {
+	var used []int
+	for symbol, count := range histogram {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	code := &prefixCode{lengths: make([]int, len(histogram)), codes: make([]uint32, len(histogram))}
+
+	// Simple code of one or two literals
+	if len(used) == 0 {
+		used = []int{0}
+	}
+	if len(used) <= 2 && used[len(used)-1] < vp8lNumLiterals {
+		w.writeBits(1, 1)
+		w.writeBits(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.writeBits(0, 1)
+			w.writeBits(uint32(used[0]), 1)
+		} else {
+			w.writeBits(1, 1)
+			w.writeBits(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.writeBits(uint32(used[1]), 8)
+			code.lengths[used[0]], code.lengths[used[1]] = 1, 1
+			code.codes[used[1]] = 1
+		}
+		return code
+	}
+
+	// Normal code needs at least two symbols
+	if len(used) == 1 {
+		histogram = append([]int{}, histogram...)
+		histogram[(used[0]+1)%len(histogram)] = 1
+	}
+	code.lengths = huffmanLengths(histogram, vp8lMaxCodeLength)
+	code.codes = canonicalCodes(code.lengths)
+
+	// Code lengths are written with code length code, literal lengths only
+	clHistogram := make([]int, len(vp8lCodeLengthOrder))
+	for _, length := range code.lengths {
+		clHistogram[length]++
+	}
+	clUsed := 0
+	for _, count := range clHistogram {
+		if count > 0 {
+			clUsed++
+		}
+	}
+	if clUsed == 1 {
+		if clHistogram[0] == 0 {
+			clHistogram[0] = 1
+		} else {
+			clHistogram[1] = 1
+		}
+	}
+	clLengths := huffmanLengths(clHistogram, vp8lMaxCLCodeLength)
+	clCodes := canonicalCodes(clLengths)
+
+	numCodeLengths := len(vp8lCodeLengthOrder)
+	for numCodeLengths > 4 && clLengths[vp8lCodeLengthOrder[numCodeLengths-1]] == 0 {
+		numCodeLengths--
+	}
+
+	w.writeBits(0, 1)
+	w.writeBits(uint32(numCodeLengths-4), 4)
+	for _, symbol := range vp8lCodeLengthOrder[:numCodeLengths] {
+		w.writeBits(uint32(clLengths[symbol]), 3)
+	}
+	w.writeBits(0, 1) // All symbols are coded
+	for _, length := range code.lengths {
+		w.writeBits(clCodes[length], uint(clLengths[length]))
+	}
+
+	return code
+}
+
+// huffmanLengths returns code lengths limited to maxLength for histogram with two symbols at least.
+// Counts are flattened till tree fits into maxLength.
+func huffmanLengths(histogram []int, maxLength int) []int {
+	counts := append([]int{}, histogram...)
+	for {
+		lengths := huffmanTreeLengths(counts)
+		max := 0
+		for _, length := range lengths {
+			if length > max {
+				max = length
+			}
+		}
+		if max <= maxLength {
+			return lengths
+		}
+		for i, count := range counts {
+			if count > 0 {
+				counts[i] = count/2 + 1
+			}
+		}
+	}
+}
+
+// huffmanTreeLengths returns depths of symbols in Huffman tree
+func huffmanTreeLengths(counts []int) []int {
+	type node struct {
+		count   int
+		symbols []int
+	}
+	var nodes []node
+	for symbol, count := range counts {
+		if count > 0 {
+			nodes = append(nodes, node{count, []int{symbol}})
+		}
+	}
+
+	lengths := make([]int, len(counts))
+	for len(nodes) > 1 {
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+		merged := node{nodes[0].count + nodes[1].count, append(append([]int{}, nodes[0].symbols...), nodes[1].symbols...)}
+		for _, symbol := range merged.symbols {
+			lengths[symbol]++
+		}
+		nodes = append([]node{merged}, nodes[2:]...)
+	}
+	return lengths
+}
+
+// canonicalCodes returns bit reversed canonical codes for code lengths
+func canonicalCodes(lengths []int) []uint32 {
+	var lengthCounts [vp8lMaxCodeLength + 1]uint32
+	for _, length := range lengths {
+		lengthCounts[length]++
+	}
+	lengthCounts[0] = 0
+
+	var next [vp8lMaxCodeLength + 1]uint32
+	code := uint32(0)
+	for length := 1; length <= vp8lMaxCodeLength; length++ {
+		code = (code + lengthCounts[length-1]) << 1
+		next[length] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		codes[symbol] = bits.Reverse32(next[length]) >> uint(32-length)
+		next[length]++
+	}
+	return codes
+}
+
+func boolBit(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/webp"
+)
+
+// testNRGBA returns image with gradient, flat area & transparency
+func testNRGBA(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			switch {
+			case y < height/3:
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 13), uint8(x ^ y), 255})
+			case y < 2*height/3:
+				img.SetNRGBA(x, y, color.NRGBA{200, 10, 30, 255})
+			default:
+				img.SetNRGBA(x, y, color.NRGBA{0, 0, 255, uint8(x * 3)})
+			}
+		}
+	}
+	return img
+}
+
+// webpChunks returns top-level or nested RIFF chunks
+func webpChunks(data []byte) map[string][][]byte {
+	chunks := map[string][][]byte{}
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		chunks[string(data[:4])] = append(chunks[string(data[:4])], data[8:8+size])
+		data = data[8+size+size%2:]
+	}
+	return chunks
+}
+
+func TestEncodeWebP(t *testing.T) {
+	cases := []*image.NRGBA{
+		testNRGBA(1, 1),
+		testNRGBA(37, 21),
+		testNRGBA(300, 90),
+		image.NewNRGBA(image.Rect(0, 0, 5000, 1)),
+	}
+
+	for _, src := range cases {
+		data := EncodeWebP(src)
+		assert.Equal(t, "RIFF", string(data[:4]))
+		assert.Equal(t, len(data)-8, int(binary.LittleEndian.Uint32(data[4:8])))
+
+		img, err := webp.Decode(bytes.NewReader(data))
+		if !assert.Nil(t, err, src.Bounds()) {
+			continue
+		}
+		assert.Equal(t, src.Bounds(), img.Bounds())
+		for y := 0; y < src.Bounds().Dy(); y++ {
+			for x := 0; x < src.Bounds().Dx(); x++ {
+				if !assert.Equal(t, src.NRGBAAt(x, y), color.NRGBAModel.Convert(img.At(x, y)), "%v at %d,%d", src.Bounds(), x, y) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeAnimatedWebP(t *testing.T) {
+	frames := []WebPFrame{
+		{Image: testNRGBA(20, 10), Duration: 100},
+		{Image: image.NewNRGBA(image.Rect(0, 0, 20, 10)), Duration: 250},
+	}
+	data := EncodeAnimatedWebP(frames, 3)
+	assert.Equal(t, len(data)-8, int(binary.LittleEndian.Uint32(data[4:8])))
+
+	chunks := webpChunks(data[12:])
+	assert.Equal(t, []byte{0x12, 0, 0, 0, 19, 0, 0, 9, 0, 0}, chunks["VP8X"][0])
+	assert.Equal(t, uint16(3), binary.LittleEndian.Uint16(chunks["ANIM"][0][4:]))
+	assert.Len(t, chunks["ANMF"], 2)
+
+	for i, anmf := range chunks["ANMF"] {
+		assert.Equal(t, frames[i].Duration, int(anmf[12])|int(anmf[13])<<8|int(anmf[14])<<16)
+
+		// Frame bitstream is decodable as still image
+		vp8l := webpChunks(anmf[16:])["VP8L"][0]
+		still := bytes.NewBuffer(nil)
+		writeRIFFHeader(still, 4+riffChunkSize(vp8l))
+		writeRIFFChunk(still, "VP8L", vp8l)
+		img, err := webp.Decode(still)
+		assert.Nil(t, err)
+		assert.Equal(t, frames[i].Image.NRGBAAt(3, 2), color.NRGBAModel.Convert(img.At(3, 2)))
+	}
+}